@@ -0,0 +1,434 @@
+// Command admin runs maintenance tasks against the chatter database
+package main
+
+import (
+	"chatter/server/config"
+	"chatter/server/internal/audit"
+	"chatter/server/internal/database"
+	"chatter/server/internal/keys"
+	"chatter/server/internal/user"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cliActor is recorded in the audit log for changes made with this command.
+const cliActor = "admin-cli"
+
+type env struct {
+	config      *config.Config
+	db          *redis.Client
+	userRepo    *database.UserRepo
+	userService *user.Service
+	audit       *audit.Log
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, e *env, args []string) error
+	// offline commands run without config or database.
+	offline bool
+}
+
+var commands = map[string]command{
+	"revoke-token": {
+		usage: "revoke-token <jti>\tdenylist an access token by its jti",
+		run:   revokeToken,
+	},
+	"generate-keys": {
+		usage:   "generate-keys [-alg RS256|ES256|EdDSA] [-dir path]\tcreate a signing key and print its public key",
+		run:     generateKeys,
+		offline: true,
+	},
+	"rotate-keys": {
+		usage: "rotate-keys\tcreate a new signing key and prune retired ones",
+		run:   rotateKeys,
+	},
+	"sessions": {
+		usage: "sessions <username>\tlist where a user is logged in",
+		run:   listSessions,
+	},
+	"hash-report": {
+		usage: "hash-report\tcount accounts by password hash format",
+		run:   hashReport,
+	},
+	"unlock": {
+		usage: "unlock [-ip] <username|address>\tlift a login lockout and clear failed attempts",
+		run:   unlock,
+	},
+	"migrate-usernames": {
+		usage: "migrate-usernames [-dry-run]\tmove the username index to case-insensitive keys and rename collisions, the server also does it at startup",
+		run:   migrateUsernames,
+	},
+	"set-role": {
+		usage: "set-role [-room id] <username> <role>\tgive a user a role, the first owner is made this way",
+		run:   setRole,
+	},
+	"roles": {
+		usage: "roles [-room id]\tlist users with a role other than member",
+		run:   listRoles,
+	},
+	"revoke-sessions": {
+		usage: "revoke-sessions <username> [session-id]\tend one or every session of a user",
+		run:   revokeSessions,
+	},
+	"audit-export": {
+		usage: "audit-export [-action a] [-actor id] [-target id] [-since t] [-until t]\twrite audit log entries as JSON Lines",
+		run:   auditExport,
+	},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+
+	ctx := audit.WithActor(context.Background(), cliActor)
+
+	if cmd.offline {
+		if err := cmd.run(ctx, nil, os.Args[2:]); err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Error loading config, %v", err)
+	}
+
+	db, err := database.NewClient(ctx, cfg.RedisAddr)
+	if err != nil {
+		log.Fatalf("Error connecting to db, %v", err)
+	}
+
+	userRepo := database.NewUserRepo(db)
+	auditLog := audit.NewLog(database.NewAuditRepo(db))
+
+	userService := user.NewService(userRepo, cfg.JWTKeys)
+	userService.SetArgon2Params(cfg.Argon2Params())
+	userService.SetAuditLog(auditLog)
+
+	e := &env{
+		config:      cfg,
+		db:          db,
+		userRepo:    userRepo,
+		userService: userService,
+		audit:       auditLog,
+	}
+
+	if err := cmd.run(ctx, e, os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+func usage() {
+	var lines []string
+	for _, cmd := range commands {
+		lines = append(lines, cmd.usage)
+	}
+	sort.Strings(lines)
+
+	fmt.Fprintln(os.Stderr, "usage: admin <command> [arguments]")
+	for _, line := range lines {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	os.Exit(2)
+}
+
+func revokeToken(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("revoke-token", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a jti")
+	}
+
+	if err := e.userService.RevokeTokenID(ctx, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	log.Printf("Token %s revoked", fs.Arg(0))
+	return nil
+}
+
+func listSessions(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a username")
+	}
+
+	u, err := e.userRepo.GetUserByUsername(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	sessions, err := e.userService.GetSessions(ctx, u.ID, "")
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIP\tCREATED\tLAST SEEN\tUSER AGENT")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, s.IP,
+			s.CreatedAt.Format(time.RFC3339), s.LastSeenAt.Format(time.RFC3339), s.UserAgent)
+	}
+
+	return w.Flush()
+}
+
+func revokeSessions(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("revoke-sessions", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("expected a username and an optional session id")
+	}
+
+	u, err := e.userRepo.GetUserByUsername(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() == 2 {
+		if err := e.userService.RevokeSession(ctx, u.ID, fs.Arg(1)); err != nil {
+			return err
+		}
+		log.Printf("Session %s revoked", fs.Arg(1))
+		return nil
+	}
+
+	revoked, err := e.userService.RevokeOtherSessions(ctx, u.ID, "")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("%d sessions revoked", revoked)
+	return nil
+}
+
+func setRole(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("set-role", flag.ExitOnError)
+	room := fs.String("room", "", "give the role in this room only")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("expected a username and a role")
+	}
+
+	role, err := user.ParseRole(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	u, err := e.userRepo.GetUserByUsername(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := e.userService.AssignRole(ctx, u.ID, *room, role); err != nil {
+		return err
+	}
+
+	if *room != "" {
+		log.Printf("%s is now %s in %s", u.Username, role, *room)
+	} else {
+		log.Printf("%s is now %s", u.Username, role)
+	}
+	return nil
+}
+
+func listRoles(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("roles", flag.ExitOnError)
+	room := fs.String("room", "", "list the roles in this room")
+	fs.Parse(args)
+
+	roles, err := e.userService.ListRoles(ctx, *room)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tROLE\tID")
+	for _, a := range roles {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", a.Username, a.Role, a.UserID)
+	}
+
+	return w.Flush()
+}
+
+func unlock(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	ip := fs.Bool("ip", false, "unlock an IP address instead of an account")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a username or address")
+	}
+
+	scope := user.LoginScopeAccount
+	if *ip {
+		scope = user.LoginScopeIP
+	}
+
+	attempts, err := e.userService.GetLoginAttempts(ctx, scope, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := e.userService.UnlockLogin(ctx, scope, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	if time.Now().Before(attempts.LockedUntil) {
+		log.Printf("Unlocked %s %s, it was locked until %s", scope, fs.Arg(0), attempts.LockedUntil.Format(time.RFC3339))
+	} else {
+		log.Printf("Cleared %d failed attempts for %s %s", attempts.Failures, scope, fs.Arg(0))
+	}
+	return nil
+}
+
+func hashReport(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("hash-report", flag.ExitOnError)
+	fs.Parse(args)
+
+	report, err := e.userService.HashReport(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "argon2id, current parameters\t%d\n", report.Current)
+	fmt.Fprintf(w, "argon2id, outdated parameters\t%d\n", report.Outdated)
+	fmt.Fprintf(w, "bcrypt\t%d\n", report.Bcrypt)
+	fmt.Fprintf(w, "no password (single sign-on)\t%d\n", report.NoHash)
+	fmt.Fprintf(w, "unknown format\t%d\n", report.Unknown)
+	fmt.Fprintf(w, "total\t%d\n", report.Total)
+
+	return w.Flush()
+}
+
+func migrateUsernames(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("migrate-usernames", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would change")
+	fs.Parse(args)
+
+	migration, err := e.userService.MigrateUsernames(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(migration.Conflicts) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CANONICAL\tKEPT\tRENAMED\tTO")
+		for _, c := range migration.Conflicts {
+			for i, u := range c.Others {
+				to := "-"
+				if i < len(c.Renamed) {
+					to = c.Renamed[i]
+				}
+				fmt.Fprintf(w, "%s\t%s (%s)\t%s (%s)\t%s\n", c.Canonical, c.Kept.Username, c.Kept.ID, u.Username, u.ID, to)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+	log.Printf("%s %d usernames of %d accounts, %d collisions", verb, migration.Migrated, migration.Total, len(migration.Conflicts))
+	return nil
+}
+
+func rotateKeys(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	fs.Parse(args)
+
+	k, err := e.config.JWTKeys.Rotate()
+	if err != nil {
+		return err
+	}
+
+	e.audit.Record(ctx, audit.Entry{
+		Action:  audit.ActionKeyRotate,
+		Details: map[string]string{"key_id": k.ID, "algorithm": k.Algorithm},
+	})
+
+	log.Printf("New signing key %s, servers start using it within a few minutes", k.ID)
+	return nil
+}
+
+func auditExport(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("audit-export", flag.ExitOnError)
+	action := fs.String("action", "", "only this action, or a group ending with a dot such as auth.")
+	actor := fs.String("actor", "", "only entries by this user id")
+	target := fs.String("target", "", "only entries about this user id")
+	since := fs.String("since", "", "only entries from this RFC 3339 time on")
+	until := fs.String("until", "", "only entries up to this RFC 3339 time")
+	fs.Parse(args)
+
+	f := audit.Filter{Action: *action, ActorID: *actor, TargetID: *target}
+	var err error
+	if f.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if f.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+
+	return e.audit.Export(ctx, f, os.Stdout)
+}
+
+// parseTime reads an RFC 3339 time, empty is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339", s)
+	}
+	return t, nil
+}
+
+func generateKeys(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("generate-keys", flag.ExitOnError)
+	alg := fs.String("alg", envOr("JWT_ALGORITHM", keys.RS256), "signing algorithm")
+	dir := fs.String("dir", envOr("JWT_KEYS_DIR", "secrets/keys"), "keys directory")
+	fs.Parse(args)
+
+	k, err := keys.Generate(*dir, *alg)
+	if err != nil {
+		return err
+	}
+
+	publicPem, err := keys.EncodePublicKey(k.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Generated %s key %s in %s", k.Algorithm, k.ID, *dir)
+	os.Stdout.Write(publicPem)
+	return nil
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
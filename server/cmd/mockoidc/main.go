@@ -0,0 +1,37 @@
+// Command mockoidc is a minimal OpenID Connect provider for local testing of
+// single sign-on. It accepts any client and logs in whoever types a name.
+package main
+
+import (
+	"chatter/server/internal/keys"
+	"chatter/server/internal/mockoidc"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9090", "issuer URL the server is reachable at")
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "mockoidc")
+	if err != nil {
+		log.Fatalf("Error creating key dir, %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keySet, err := keys.Load(dir, keys.RS256, "", "")
+	if err != nil {
+		log.Fatalf("Error loading keys, %v", err)
+	}
+	if _, err := keySet.Rotate(); err != nil {
+		log.Fatalf("Error generating key, %v", err)
+	}
+
+	p := mockoidc.New(*issuer, keySet)
+
+	log.Printf("Mock OIDC provider %s listening on %s", p.Issuer(), *addr)
+	log.Fatal(http.ListenAndServe(*addr, p.Handler()))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"chatter/server/config"
+	"chatter/server/internal/audit"
 	"chatter/server/internal/chat"
 	"chatter/server/internal/database"
 	"chatter/server/internal/middleware"
@@ -23,6 +24,10 @@ func main() {
 		log.Fatalf("Error loading config, %v", err)
 	}
 
+	if config.JWTKeys.SigningKey() == nil {
+		log.Fatalf("No jwt signing key in %s, create one with `admin generate-keys` or set DEV_MODE=true", config.JWTKeysDir)
+	}
+
 	ctx := context.Background()
 
 	db, err := database.NewClient(ctx, config.RedisAddr)
@@ -32,31 +37,78 @@ func main() {
 
 	router := chi.NewRouter()
 
+	router.Use(middleware.RealIP(config.TrustedProxies))
 	router.Use(chimiddleware.Logger)
+	router.Use(audit.Middleware)
 
 	router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: false,
 	}))
 
+	auditLog := audit.NewLog(database.NewAuditRepo(db))
+
 	userRepo := database.NewUserRepo(db)
-	userService := user.NewService(userRepo, config.JWTPrivateKey)
+	userService := user.NewService(userRepo, config.JWTKeys)
+	userService.SetAuditLog(auditLog)
+	userService.SetArgon2Params(config.Argon2Params())
+	userService.SetPasswordPolicy(config.PasswordPolicy)
+	if config.Notifier != nil {
+		userService.SetPasswordReset(config.Notifier, config.PasswordResetURL)
+	}
+	if config.OIDCIssuer != "" {
+		userService.SetOIDCProvider(user.NewOIDCProvider(user.OIDCConfig{
+			Issuer:        config.OIDCIssuer,
+			ClientID:      config.OIDCClientID,
+			ClientSecret:  config.OIDCClientSecret,
+			RedirectURL:   config.OIDCRedirectURL,
+			Scopes:        config.OIDCScopes,
+			UsernameClaim: config.OIDCUsernameClaim,
+			AppURL:        config.OIDCAppURL,
+		}))
+		log.Printf("Single sign-on enabled with %s", config.OIDCIssuer)
+	}
+	if err := userService.MigrateLegacyUsernames(audit.WithActor(ctx, user.SystemModerator)); err != nil {
+		log.Fatalf("Error migrating usernames, %v", err)
+	}
 	userHandler := user.NewHandler(userService)
 
-	router.Mount("/api/user", userHandler.Routes())
+	auth := middleware.Auth(config.JWTKeys, userService)
+	// Account and admin routes are for logged in users, access tokens only
+	// reach the chat routes their scopes allow.
+	sessionAuth := chi.Chain(auth, middleware.NoAccessTokens).Handler
+
+	router.Get("/.well-known/jwks.json", config.JWTKeys.ServeJWKS)
+
+	router.Mount("/api/user", userHandler.Routes(sessionAuth))
+
+	router.Group(func(r chi.Router) {
+		r.Use(sessionAuth)
+		r.Mount("/api/admin", userHandler.AdminRoutes(middleware.RequirePermission))
+		r.With(middleware.RequirePermission(user.PermViewAudit)).Mount("/api/admin/audit", audit.NewHandler(auditLog).Routes())
+	})
 
 	chatRepo := database.NewChatRepo(db)
-	chatService := chat.NewService(chatRepo)
+	chatService := chat.NewService(chatRepo, userRepo)
+	chatService.SetMessageFilter(config.Filters)
+	chatService.SetModerator(userService)
+	chatService.SetSpamPolicy(config.SpamPolicy)
+	chatService.SetAuditLog(auditLog)
 	chatHandler := chat.NewHandler(chatService)
+	userService.SetMessageStore(chatService, config.ErasurePolicy)
 
 	router.Group(func(r chi.Router) {
-		r.Use(middleware.Auth(config.JWTPublicKey))
+		r.Use(auth)
 		r.Mount("/api/chat", chatHandler.Routes())
 	})
 
 	go chatService.Listen(ctx)
+	go chatService.ListenEvents(ctx)
+	go config.JWTKeys.Run(ctx, config.JWTRotationInterval)
+	go userService.RunErasures(ctx)
+	go config.Filters.Run(ctx, config.FilterReloadInterval)
 
 	log.Printf("Running server on port: %s", config.ServerPort)
 
@@ -2,12 +2,16 @@
 package config
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"chatter/server/internal/chat"
+	"chatter/server/internal/filter"
+	"chatter/server/internal/keys"
+	"chatter/server/internal/notify"
+	"chatter/server/internal/user"
 	"fmt"
 	"log"
-	"os"
+	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/joho/godotenv"
@@ -19,14 +23,97 @@ const (
 )
 
 type Config struct {
-	ServerPort    string
-	RedisAddr     string
-	JWTPublicKey  *rsa.PublicKey
-	JWTPrivateKey *rsa.PrivateKey
+	ServerPort           string
+	RedisAddr            string
+	DevMode              bool
+	TrustedProxies       []netip.Prefix
+	JWTKeysDir           string
+	JWTAlgorithm         string
+	JWTKeys              *keys.Set
+	JWTRotationInterval  time.Duration
+	OIDCIssuer           string
+	OIDCClientID         string
+	OIDCClientSecret     string
+	OIDCRedirectURL      string
+	OIDCScopes           []string
+	OIDCUsernameClaim    string
+	OIDCAppURL           string
+	Argon2Memory         uint32
+	Argon2Iterations     uint32
+	Argon2Parallelism    uint8
+	PasswordPolicy       user.PasswordPolicy
+	Notifier             notify.Notifier
+	PasswordResetURL     string
+	ErasurePolicy        user.ErasurePolicy
+	Filters              *filter.Store
+	FilterReloadInterval time.Duration
+	SpamPolicy           chat.SpamPolicy
 }
 type rawConfig struct {
-	ServerPort string `env:"SERVER_PORT" envDefault:"8080"`
-	RedisAddr  string `env:"REDIS_ADDR,required"`
+	ServerPort          string        `env:"SERVER_PORT" envDefault:"8080"`
+	RedisAddr           string        `env:"REDIS_ADDR,required"`
+	DevMode             bool          `env:"DEV_MODE" envDefault:"false"`
+	TrustedProxies      []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	JWTKeysDir          string        `env:"JWT_KEYS_DIR" envDefault:"secrets/keys"`
+	JWTAlgorithm        string        `env:"JWT_ALGORITHM" envDefault:"RS256"`
+	JWTRotationInterval time.Duration `env:"JWT_KEY_ROTATION_INTERVAL" envDefault:"0"`
+	OIDCIssuer          string        `env:"OIDC_ISSUER"`
+	OIDCClientID        string        `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret    string        `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL     string        `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes          []string      `env:"OIDC_SCOPES" envSeparator:" " envDefault:"openid profile email"`
+	OIDCUsernameClaim   string        `env:"OIDC_USERNAME_CLAIM" envDefault:"preferred_username"`
+	OIDCAppURL          string        `env:"OIDC_APP_URL"`
+	Argon2Memory        uint32        `env:"ARGON2_MEMORY_KIB" envDefault:"65536"`
+	Argon2Iterations    uint32        `env:"ARGON2_ITERATIONS" envDefault:"3"`
+	Argon2Parallelism   uint8         `env:"ARGON2_PARALLELISM" envDefault:"2"`
+
+	PasswordMinLength        int    `env:"PASSWORD_MIN_LENGTH" envDefault:"8"`
+	PasswordMaxLength        int    `env:"PASSWORD_MAX_LENGTH" envDefault:"128"`
+	PasswordRequireUpper     bool   `env:"PASSWORD_REQUIRE_UPPER" envDefault:"true"`
+	PasswordRequireLower     bool   `env:"PASSWORD_REQUIRE_LOWER" envDefault:"true"`
+	PasswordRequireDigit     bool   `env:"PASSWORD_REQUIRE_DIGIT" envDefault:"true"`
+	PasswordRequireSpecial   bool   `env:"PASSWORD_REQUIRE_SPECIAL" envDefault:"true"`
+	PasswordDisallowUsername bool   `env:"PASSWORD_DISALLOW_USERNAME" envDefault:"true"`
+	PasswordBreachedList     string `env:"PASSWORD_BREACHED_LIST"`
+
+	// NotifyBackend is smtp or outbox, empty turns mails off. Dev mode
+	// defaults to the outbox.
+	NotifyBackend    string `env:"NOTIFY_BACKEND"`
+	NotifyOutboxDir  string `env:"NOTIFY_OUTBOX_DIR" envDefault:"outbox"`
+	SMTPAddr         string `env:"SMTP_ADDR"`
+	SMTPUsername     string `env:"SMTP_USERNAME"`
+	SMTPPassword     string `env:"SMTP_PASSWORD"`
+	SMTPFrom         string `env:"SMTP_FROM"`
+	PasswordResetURL string `env:"PASSWORD_RESET_URL" envDefault:"http://localhost:5173/reset-password"`
+
+	// ErasurePolicy is what happens to the messages of deleted accounts,
+	// anonymize or delete.
+	ErasurePolicy string `env:"ERASURE_POLICY" envDefault:"anonymize"`
+
+	// FilterConfig is a JSON file of message filters, checked for changes
+	// every FilterReloadInterval. Without it messages are only cleaned up.
+	FilterConfig         string        `env:"FILTER_CONFIG"`
+	FilterReloadInterval time.Duration `env:"FILTER_RELOAD_INTERVAL" envDefault:"10s"`
+
+	// SpamAction is allow, hold, drop or mute, for messages scoring at
+	// least SpamThreshold. Each rule scores for every message, link or
+	// mention over its limit.
+	SpamAction          string        `env:"SPAM_ACTION" envDefault:"hold"`
+	SpamThreshold       int           `env:"SPAM_THRESHOLD" envDefault:"6"`
+	SpamMuteDuration    time.Duration `env:"SPAM_MUTE_DURATION" envDefault:"10m"`
+	SpamWindow          time.Duration `env:"SPAM_WINDOW" envDefault:"2m"`
+	SpamRepeatLimit     int           `env:"SPAM_REPEAT_LIMIT" envDefault:"2"`
+	SpamRepeatScore     int           `env:"SPAM_REPEAT_SCORE" envDefault:"3"`
+	SpamBurstWindow     time.Duration `env:"SPAM_BURST_WINDOW" envDefault:"10s"`
+	SpamBurstLimit      int           `env:"SPAM_BURST_LIMIT" envDefault:"5"`
+	SpamBurstScore      int           `env:"SPAM_BURST_SCORE" envDefault:"2"`
+	SpamLinkLimit       int           `env:"SPAM_LINK_LIMIT" envDefault:"2"`
+	SpamLinkScore       int           `env:"SPAM_LINK_SCORE" envDefault:"2"`
+	SpamMentionLimit    int           `env:"SPAM_MENTION_LIMIT" envDefault:"5"`
+	SpamMentionScore    int           `env:"SPAM_MENTION_SCORE" envDefault:"1"`
+	SpamNewAccountAge   time.Duration `env:"SPAM_NEW_ACCOUNT_AGE" envDefault:"24h"`
+	SpamNewAccountScore int           `env:"SPAM_NEW_ACCOUNT_SCORE" envDefault:"1"`
 }
 
 func Load() (*Config, error) {
@@ -40,63 +127,192 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("config: failed to parse config: %v", err)
 	}
 
-	publicKey, err := loadPublicKey(publicPemPath)
-	if err != nil {
-		return nil, fmt.Errorf("config: error loading public key, %v", err)
+	if rawCfg.OIDCIssuer != "" && (rawCfg.OIDCClientID == "" || rawCfg.OIDCRedirectURL == "") {
+		return nil, fmt.Errorf("config: OIDC_ISSUER needs OIDC_CLIENT_ID and OIDC_REDIRECT_URL")
 	}
 
-	privateKey, err := loadPrivateKey(privatePemPath)
+	trustedProxies, err := parseTrustedProxies(rawCfg.TrustedProxies)
 	if err != nil {
-		return nil, fmt.Errorf("config: error loading private key, %v", err)
+		return nil, fmt.Errorf("config: TRUSTED_PROXIES, %v", err)
 	}
 
-	cfg := &Config{
-		ServerPort:    rawCfg.ServerPort,
-		RedisAddr:     rawCfg.RedisAddr,
-		JWTPublicKey:  publicKey,
-		JWTPrivateKey: privateKey,
+	if rawCfg.Argon2Iterations == 0 || rawCfg.Argon2Parallelism == 0 || rawCfg.Argon2Memory < 8*uint32(rawCfg.Argon2Parallelism) {
+		return nil, fmt.Errorf("config: argon2 needs at least one iteration and thread, and 8 KiB of memory per thread")
 	}
 
-	return cfg, nil
-}
+	if rawCfg.PasswordMinLength < 1 || (rawCfg.PasswordMaxLength > 0 && rawCfg.PasswordMaxLength < rawCfg.PasswordMinLength) {
+		return nil, fmt.Errorf("config: password length bounds %d-%d are invalid", rawCfg.PasswordMinLength, rawCfg.PasswordMaxLength)
+	}
 
-func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
-	data, err := os.ReadFile(path)
+	policy := user.PasswordPolicy{
+		MinLength:        rawCfg.PasswordMinLength,
+		MaxLength:        rawCfg.PasswordMaxLength,
+		RequireUpper:     rawCfg.PasswordRequireUpper,
+		RequireLower:     rawCfg.PasswordRequireLower,
+		RequireDigit:     rawCfg.PasswordRequireDigit,
+		RequireSpecial:   rawCfg.PasswordRequireSpecial,
+		DisallowUsername: rawCfg.PasswordDisallowUsername,
+	}
+	if rawCfg.PasswordBreachedList != "" {
+		breached, err := user.LoadBreachedList(rawCfg.PasswordBreachedList)
+		if err != nil {
+			return nil, fmt.Errorf("config: error loading breached password list, %v", err)
+		}
+		policy.Breached = breached
+		log.Printf("Loaded %d breached passwords from %s", policy.Breached.Count, rawCfg.PasswordBreachedList)
+	}
+
+	erasurePolicy, err := user.ParseErasurePolicy(rawCfg.ErasurePolicy)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("config: ERASURE_POLICY, %v", err)
 	}
 
-	block, _ := pem.Decode(data)
+	if rawCfg.FilterReloadInterval <= 0 {
+		return nil, fmt.Errorf("config: FILTER_RELOAD_INTERVAL must be positive")
+	}
 
-	privInterface, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	filters, err := filter.NewStore(rawCfg.FilterConfig)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("config: error loading message filters, %v", err)
 	}
-
-	key, ok := privInterface.(*rsa.PrivateKey)
-	if !ok {
-		return nil, fmt.Errorf("invalid private key")
+	if rawCfg.FilterConfig != "" {
+		log.Printf("Loaded message filters from %s", rawCfg.FilterConfig)
 	}
 
-	return key, nil
-}
+	spamPolicy := chat.SpamPolicy{
+		Threshold:       rawCfg.SpamThreshold,
+		Action:          chat.SpamAction(rawCfg.SpamAction),
+		MuteDuration:    rawCfg.SpamMuteDuration,
+		Window:          rawCfg.SpamWindow,
+		RepeatLimit:     rawCfg.SpamRepeatLimit,
+		RepeatScore:     rawCfg.SpamRepeatScore,
+		BurstWindow:     rawCfg.SpamBurstWindow,
+		BurstLimit:      rawCfg.SpamBurstLimit,
+		BurstScore:      rawCfg.SpamBurstScore,
+		LinkLimit:       rawCfg.SpamLinkLimit,
+		LinkScore:       rawCfg.SpamLinkScore,
+		MentionLimit:    rawCfg.SpamMentionLimit,
+		MentionScore:    rawCfg.SpamMentionScore,
+		NewAccountAge:   rawCfg.SpamNewAccountAge,
+		NewAccountScore: rawCfg.SpamNewAccountScore,
+	}
+	if err := spamPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("config: SPAM_*, %v", err)
+	}
 
-func loadPublicKey(path string) (*rsa.PublicKey, error) {
-	data, err := os.ReadFile(path)
+	notifier, err := loadNotifier(rawCfg)
 	if err != nil {
 		return nil, err
 	}
 
-	block, _ := pem.Decode(data)
-	pubInterface, err := x509.ParsePKIXPublicKey(block.Bytes)
+	keySet, err := keys.Load(rawCfg.JWTKeysDir, rawCfg.JWTAlgorithm, privatePemPath, publicPemPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("config: error loading jwt keys, %v", err)
+	}
+
+	// Development setups get a key on first start, production keys are
+	// created on purpose with `admin generate-keys`.
+	if rawCfg.DevMode && keySet.SigningKey() == nil {
+		k, err := keySet.Rotate()
+		if err != nil {
+			return nil, fmt.Errorf("config: error generating dev jwt key, %v", err)
+		}
+		log.Printf("Dev mode: generated %s signing key %s in %s", k.Algorithm, k.ID, rawCfg.JWTKeysDir)
+	}
+
+	cfg := &Config{
+		ServerPort:           rawCfg.ServerPort,
+		RedisAddr:            rawCfg.RedisAddr,
+		DevMode:              rawCfg.DevMode,
+		TrustedProxies:       trustedProxies,
+		JWTKeysDir:           rawCfg.JWTKeysDir,
+		JWTAlgorithm:         rawCfg.JWTAlgorithm,
+		JWTKeys:              keySet,
+		JWTRotationInterval:  rawCfg.JWTRotationInterval,
+		OIDCIssuer:           rawCfg.OIDCIssuer,
+		OIDCClientID:         rawCfg.OIDCClientID,
+		OIDCClientSecret:     rawCfg.OIDCClientSecret,
+		OIDCRedirectURL:      rawCfg.OIDCRedirectURL,
+		OIDCScopes:           rawCfg.OIDCScopes,
+		OIDCUsernameClaim:    rawCfg.OIDCUsernameClaim,
+		OIDCAppURL:           rawCfg.OIDCAppURL,
+		Argon2Memory:         rawCfg.Argon2Memory,
+		Argon2Iterations:     rawCfg.Argon2Iterations,
+		Argon2Parallelism:    rawCfg.Argon2Parallelism,
+		PasswordPolicy:       policy,
+		Notifier:             notifier,
+		PasswordResetURL:     rawCfg.PasswordResetURL,
+		ErasurePolicy:        erasurePolicy,
+		Filters:              filters,
+		FilterReloadInterval: rawCfg.FilterReloadInterval,
+		SpamPolicy:           spamPolicy,
+	}
+
+	return cfg, nil
+}
+
+// parseTrustedProxies takes networks like 10.0.0.0/8, a single address
+// stands for itself.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
 
-	key, ok := pubInterface.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("invalid public key")
+	return prefixes, nil
+}
+
+func (c *Config) Argon2Params() user.Argon2Params {
+	params := user.DefaultArgon2Params
+	params.Memory = c.Argon2Memory
+	params.Iterations = c.Argon2Iterations
+	params.Parallelism = c.Argon2Parallelism
+
+	return params
+}
+
+func loadNotifier(rawCfg *rawConfig) (notify.Notifier, error) {
+	backend := rawCfg.NotifyBackend
+	if backend == "" && rawCfg.DevMode {
+		backend = "outbox"
 	}
 
-	return key, nil
+	switch backend {
+	case "":
+		return nil, nil
+
+	case "outbox":
+		outbox, err := notify.NewOutbox(rawCfg.NotifyOutboxDir)
+		if err != nil {
+			return nil, fmt.Errorf("config: error creating outbox, %v", err)
+		}
+		log.Printf("Mails are written to %s instead of being sent", rawCfg.NotifyOutboxDir)
+		return outbox, nil
+
+	case "smtp":
+		smtp, err := notify.NewSMTP(rawCfg.SMTPAddr, rawCfg.SMTPUsername, rawCfg.SMTPPassword, rawCfg.SMTPFrom)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid smtp settings, %v", err)
+		}
+		return smtp, nil
+
+	default:
+		return nil, fmt.Errorf("config: unknown NOTIFY_BACKEND %q, use smtp or outbox", backend)
+	}
 }
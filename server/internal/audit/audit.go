@@ -0,0 +1,263 @@
+// Package audit keeps an append-only record of security and moderation
+// events
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	// scanBatch is how many entries a query reads at a time, maxScanned
+	// bounds how far a filtered query looks before returning a cursor.
+	scanBatch  = 500
+	maxScanned = 50000
+)
+
+type Outcome string
+
+const (
+	Success Outcome = "success"
+	Failure Outcome = "failure"
+	// Denied is a request turned away by a rule, such as a ban or missing
+	// permission, rather than by wrong input.
+	Denied Outcome = "denied"
+)
+
+// Actions are grouped by prefix, auth., account., role., moderation. and
+// admin., a query for "auth." matches the whole group.
+const (
+	ActionRegister         = "auth.register"
+	ActionLogin            = "auth.login"
+	ActionLogout           = "auth.logout"
+	ActionPasswordChange   = "auth.password_change"
+	ActionPasswordReset    = "auth.password_reset"
+	ActionResetRequest     = "auth.password_reset_request"
+	ActionTwoFactorEnable  = "auth.2fa_enable"
+	ActionTwoFactorDisable = "auth.2fa_disable"
+	ActionSessionRevoke    = "auth.session_revoke"
+	ActionTokenCreate      = "auth.token_create"
+	ActionTokenRevoke      = "auth.token_revoke"
+
+	ActionUsernameChange = "account.username_change"
+	ActionEmailChange    = "account.email_change"
+	ActionAccountDelete  = "account.delete"
+	ActionBotCreate      = "account.bot_create"
+
+	ActionRoleChange = "role.change"
+
+	ActionSanction      = "moderation.sanction"
+	ActionSanctionLift  = "moderation.sanction_lift"
+	ActionReportResolve = "moderation.report_resolve"
+	ActionRoomMode      = "moderation.room_mode"
+
+	ActionLoginUnlock = "admin.login_unlock"
+	ActionKeyRotate   = "admin.key_rotate"
+)
+
+var ErrInvalidFilter = errors.New("limit must be 1 to 1000, before an entry ID and until not before since")
+
+var entryIDPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// Entry is one audited event. ActorID is who did it, TargetID who or what
+// it was done to, Details anything else worth keeping.
+type Entry struct {
+	ID       string            `json:"id"`
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`
+	ActorID  string            `json:"actor_id,omitempty"`
+	TargetID string            `json:"target_id,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Outcome  Outcome           `json:"outcome"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Filter narrows a query, empty fields match everything. Action matches a
+// whole group when it ends with a dot. Before is the ID of the last entry
+// of the previous page.
+type Filter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	IP       string
+	Outcome  Outcome
+	Since    time.Time
+	Until    time.Time
+	Before   string
+	Limit    int
+}
+
+func (f *Filter) validate() error {
+	if f.Limit > maxQueryLimit ||
+		(f.Before != "" && !entryIDPattern.MatchString(f.Before)) ||
+		(!f.Since.IsZero() && !f.Until.IsZero() && f.Until.Before(f.Since)) {
+		return ErrInvalidFilter
+	}
+	return nil
+}
+
+func (f *Filter) match(e *Entry) bool {
+	if f.Action != "" {
+		if strings.HasSuffix(f.Action, ".") {
+			if !strings.HasPrefix(e.Action, f.Action) {
+				return false
+			}
+		} else if e.Action != f.Action {
+			return false
+		}
+	}
+
+	return (f.ActorID == "" || e.ActorID == f.ActorID) &&
+		(f.TargetID == "" || e.TargetID == f.TargetID) &&
+		(f.IP == "" || e.IP == f.IP) &&
+		(f.Outcome == "" || e.Outcome == f.Outcome)
+}
+
+type Repository interface {
+	AppendAudit(ctx context.Context, e *Entry) error
+	// ReadAudit returns up to count entries newest first, from before the
+	// given ID or from until, down to since. Zero times don't limit.
+	ReadAudit(ctx context.Context, before string, since, until time.Time, count int) ([]Entry, error)
+}
+
+// Log records entries and reads them back. Entries are never changed or
+// removed.
+type Log struct {
+	repo Repository
+}
+
+func NewLog(repo Repository) *Log {
+	return &Log{repo: repo}
+}
+
+// Record appends the entry, filling in the time and, from the context, the
+// actor and address. Auditing never fails the action it records, errors
+// are logged.
+func (l *Log) Record(ctx context.Context, e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.ActorID == "" {
+		e.ActorID = actor(ctx)
+	}
+	if e.IP == "" {
+		e.IP = ClientIP(ctx)
+	}
+	if e.Outcome == "" {
+		e.Outcome = Success
+	}
+
+	if err := l.repo.AppendAudit(ctx, &e); err != nil {
+		log.Printf("audit: failed to record %s by %s, %v", e.Action, e.ActorID, err)
+	}
+}
+
+// Query returns a page of matching entries, newest first, and the cursor
+// for the next page, empty after the last one. A query for rare entries
+// may return a short page with a cursor when it stopped looking.
+func (l *Log) Query(ctx context.Context, f Filter) ([]Entry, string, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultQueryLimit
+	}
+	if err := f.validate(); err != nil {
+		return nil, "", err
+	}
+
+	entries := []Entry{}
+	cursor := f.Before
+	scanned := 0
+
+	for scanned < maxScanned {
+		batch, err := l.repo.ReadAudit(ctx, cursor, f.Since, f.Until, scanBatch)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i := range batch {
+			scanned++
+			cursor = batch[i].ID
+			if !f.match(&batch[i]) {
+				continue
+			}
+
+			entries = append(entries, batch[i])
+			if len(entries) == f.Limit {
+				return entries, cursor, nil
+			}
+		}
+
+		if len(batch) < scanBatch {
+			return entries, "", nil
+		}
+	}
+
+	return entries, cursor, nil
+}
+
+// Export writes every matching entry as a line of JSON, newest first. The
+// limit and page size don't apply.
+func (l *Log) Export(ctx context.Context, f Filter, w io.Writer) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	cursor := f.Before
+
+	for {
+		batch, err := l.repo.ReadAudit(ctx, cursor, f.Since, f.Until, scanBatch)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			cursor = batch[i].ID
+			if !f.match(&batch[i]) {
+				continue
+			}
+			if err := enc.Encode(batch[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < scanBatch {
+			return nil
+		}
+	}
+}
+
+type contextKey int
+
+const (
+	ipKey contextKey = iota
+	actorKey
+)
+
+// WithClientIP remembers the address of the request being handled.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, ipKey, ip)
+}
+
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(ipKey).(string)
+	return ip
+}
+
+// WithActor names who acts where there is no logged in user, such as the
+// admin command.
+func WithActor(ctx context.Context, actorID string) context.Context {
+	return context.WithValue(ctx, actorKey, actorID)
+}
+
+func actor(ctx context.Context) string {
+	id, _ := ctx.Value(actorKey).(string)
+	return id
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+type queryResponse struct {
+	Entries []Entry `json:"entries"`
+	// Next is the before of the following page, empty after the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// Middleware keeps the client's address in the request context, so entries
+// recorded while handling it carry the address.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClientIP(r.Context(), ip)))
+	})
+}
+
+type Handler struct {
+	log *Log
+}
+
+func NewHandler(l *Log) *Handler {
+	return &Handler{log: l}
+}
+
+// Routes serves the log to admins, the routes expect to be mounted behind
+// auth and a permission check.
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Get("/", h.handleQuery)
+	r.Get("/export", h.handleExport)
+
+	return r
+}
+
+// handleQuery takes action, actor_id, target_id, ip, outcome, since and
+// until as RFC 3339, before and limit.
+func (h *Handler) handleQuery(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, next, err := h.log.Query(r.Context(), f)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(queryResponse{Entries: entries, Next: next})
+}
+
+// handleExport streams the matching entries as JSON Lines, the filters are
+// those of handleQuery without limit.
+func (h *Handler) handleExport(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := f.validate(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	name := "audit-" + time.Now().UTC().Format("20060102-150405") + ".jsonl"
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// The status is out already, a failure can only cut the export short.
+	if err := h.log.Export(r.Context(), f, w); err != nil {
+		log.Printf("audit: export failed, %v", err)
+	}
+}
+
+func parseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+	f := Filter{
+		Action:   q.Get("action"),
+		ActorID:  q.Get("actor_id"),
+		TargetID: q.Get("target_id"),
+		IP:       q.Get("ip"),
+		Outcome:  Outcome(q.Get("outcome")),
+		Before:   q.Get("before"),
+	}
+
+	switch f.Outcome {
+	case "", Success, Failure, Denied:
+	default:
+		return f, errors.New("outcome must be success, failure or denied")
+	}
+
+	var err error
+	if f.Since, err = parseTime(q.Get("since")); err != nil {
+		return f, errors.New("invalid since, expected RFC 3339")
+	}
+	if f.Until, err = parseTime(q.Get("until")); err != nil {
+		return f, errors.New("invalid until, expected RFC 3339")
+	}
+
+	if l := q.Get("limit"); l != "" {
+		if f.Limit, err = strconv.Atoi(l); err != nil || f.Limit < 1 {
+			return f, errors.New("invalid limit")
+		}
+	}
+
+	return f, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidFilter) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	log.Printf("internal server error reading the audit log, %v", err)
+	writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Message: message})
+}
@@ -0,0 +1,42 @@
+package chat
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errClientGone = errors.New("client is no longer connected")
+
+// client serializes writes to a connection, gorilla/websocket allows only
+// one concurrent writer. user is replaced as a whole on profile updates and
+// only read or written under Service.mu.
+type client struct {
+	conn      *websocket.Conn
+	user      UserInfo
+	sessionID string
+	// moderator clients also get new reports.
+	moderator bool
+	mu        sync.Mutex
+}
+
+func (c *client) write(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// close tells the peer why it is being dropped before closing the
+// connection, the read loop in the handler then removes the client.
+func (c *client) close(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.conn.Close()
+}
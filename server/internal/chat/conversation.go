@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ChatroomID = "chatroom"
+
+	directPrefix    = "dm:"
+	permalinkPrefix = "/chat/"
+)
+
+var (
+	ErrInvalidConversation = errors.New("invalid conversation")
+	ErrInvalidPermalink    = errors.New("invalid permalink")
+	ErrForbidden           = errors.New("not a participant of this conversation")
+)
+
+var messageIDPattern = regexp.MustCompile(`^\d+-\d+$`)
+
+// DirectConversationID returns the conversation shared by two users. The
+// participants are sorted so both sides resolve to the same ID.
+func DirectConversationID(user1, user2 string) string {
+	if user1 < user2 {
+		return fmt.Sprintf("%s%s:%s", directPrefix, user1, user2)
+	}
+	return fmt.Sprintf("%s%s:%s", directPrefix, user2, user1)
+}
+
+// ConversationID returns the conversation a message belongs to.
+func ConversationID(m *Message) string {
+	if m.To == "" {
+		return ChatroomID
+	}
+	return DirectConversationID(m.From, m.To)
+}
+
+// Participants returns the two members of a direct conversation.
+func Participants(conversation string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(conversation, directPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	user1, user2, ok := strings.Cut(rest, ":")
+	if !ok || user1 == "" || user2 == "" {
+		return "", "", false
+	}
+
+	return user1, user2, true
+}
+
+// Permalink returns the shareable link for a message.
+func Permalink(conversation, messageID string) string {
+	return permalinkPrefix + conversation + "/" + messageID
+}
+
+// ParsePermalink splits a link created by Permalink back into its
+// conversation and message ID.
+func ParsePermalink(link string) (string, string, error) {
+	rest, ok := strings.CutPrefix(link, permalinkPrefix)
+	if !ok {
+		return "", "", ErrInvalidPermalink
+	}
+
+	i := strings.LastIndex(rest, "/")
+	if i < 0 {
+		return "", "", ErrInvalidPermalink
+	}
+
+	conversation, messageID := rest[:i], rest[i+1:]
+	if validateConversation(conversation) != nil || !messageIDPattern.MatchString(messageID) {
+		return "", "", ErrInvalidPermalink
+	}
+
+	return conversation, messageID, nil
+}
+
+func validateConversation(conversation string) error {
+	if conversation == ChatroomID {
+		return nil
+	}
+	if _, _, ok := Participants(conversation); ok {
+		return nil
+	}
+	return ErrInvalidConversation
+}
+
+func canAccess(userID, conversation string) bool {
+	if conversation == ChatroomID {
+		return true
+	}
+
+	user1, user2, ok := Participants(conversation)
+	return ok && (userID == user1 || userID == user2)
+}
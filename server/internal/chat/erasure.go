@@ -0,0 +1,233 @@
+package chat
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"fmt"
+)
+
+const (
+	erasureBatchSize = 500
+
+	// DeletedUserID and DeletedUserName replace the sender of anonymized
+	// messages.
+	DeletedUserID   = "deleted"
+	DeletedUserName = "Deleted user"
+)
+
+// UserExport is the chat part of a user's data export. Reports are the
+// ones on the user's messages, held messages included, without who filed
+// or handled them.
+type UserExport struct {
+	Messages      []Message         `json:"messages"`
+	ReadMarkers   map[string]string `json:"readMarkers"`
+	Reports       []Report          `json:"reports"`
+	FilterRecords []FilterRecord    `json:"filterRecords"`
+}
+
+// UserConversations lists the chatroom and every direct conversation of the
+// user, the ones an erasure has to go through.
+func (s *Service) UserConversations(ctx context.Context, userID string) ([]string, error) {
+	direct, err := s.repo.UserConversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{ChatroomID}, direct...), nil
+}
+
+// EraseMessages deletes or anonymizes the user's messages following the
+// job's policy, takes them out of reports and the filter log, then removes
+// their read markers.
+func (s *Service) EraseMessages(ctx context.Context, job *user.ErasureJob, checkpoint func() error) error {
+	for ; job.Index < len(job.Conversations); job.Index, job.Cursor = job.Index+1, "" {
+		conversation := job.Conversations[job.Index]
+
+		var err error
+		switch job.Policy {
+		case user.ErasureDelete:
+			err = s.deleteMessages(ctx, job, conversation, checkpoint)
+		case user.ErasureAnonymize:
+			err = s.anonymizeMessages(ctx, job, conversation, checkpoint)
+		default:
+			err = user.ErrInvalidErasurePolicy
+		}
+		if errors.Is(err, user.ErrErasureLocked) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("chat: failed to erase messages in %s, %v", conversation, err)
+		}
+	}
+
+	if err := s.eraseReports(ctx, job); err != nil {
+		return fmt.Errorf("chat: failed to erase reports, %v", err)
+	}
+
+	// The log can't be rewritten in place, and a record nobody can be
+	// held to is of no use to moderators.
+	if _, err := s.repo.DeleteFilterRecords(ctx, job.UserID); err != nil {
+		return fmt.Errorf("chat: failed to delete filter records, %v", err)
+	}
+
+	if err := s.repo.DeleteReadMarkers(ctx, job.UserID); err != nil {
+		return fmt.Errorf("chat: failed to delete read markers, %v", err)
+	}
+
+	return checkpoint()
+}
+
+func (s *Service) deleteMessages(ctx context.Context, job *user.ErasureJob, conversation string, checkpoint func() error) error {
+	for {
+		cursor := job.Cursor
+		if cursor == "" {
+			cursor = "0-0"
+		}
+
+		messages, err := s.repo.GetMessagesAfter(ctx, conversation, cursor, erasureBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		var ids []string
+		for _, m := range messages {
+			if m.From == job.UserID {
+				ids = append(ids, m.ID)
+			}
+		}
+		if err := s.repo.DeleteMessages(ctx, conversation, ids); err != nil {
+			return err
+		}
+
+		job.Messages += len(ids)
+		job.Cursor = messages[len(messages)-1].ID
+		if err := checkpoint(); err != nil {
+			return err
+		}
+
+		if len(messages) < erasureBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *Service) anonymizeMessages(ctx context.Context, job *user.ErasureJob, conversation string, checkpoint func() error) error {
+	anonymize := func(m *Message) bool {
+		if m.From != job.UserID {
+			return false
+		}
+		m.From = DeletedUserID
+		m.FromName = DeletedUserName
+		return true
+	}
+
+	for {
+		cursor, done, changed, err := s.repo.RewriteMessages(ctx, conversation, job.ID, job.Cursor, erasureBatchSize, anonymize)
+		if err != nil {
+			return err
+		}
+
+		job.Cursor = cursor
+		job.Messages += changed
+		if err := checkpoint(); err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// eraseReports replaces the author of reported and held messages, the delete
+// policy drops their text as well. Held messages still waiting for a
+// moderator are dismissed, there is no account left to post them for.
+func (s *Service) eraseReports(ctx context.Context, job *user.ErasureJob) error {
+	reports, err := s.repo.AuthorReports(ctx, job.UserID)
+	if err != nil {
+		return err
+	}
+
+	for _, report := range reports {
+		_, err := s.repo.UpdateReport(ctx, report.ID, func(r *Report) (*ReportEntry, error) {
+			if r.AuthorID != job.UserID {
+				return nil, nil
+			}
+
+			r.AuthorID = DeletedUserID
+			r.AuthorName = DeletedUserName
+			if job.Policy == user.ErasureDelete {
+				r.Content = ""
+			}
+			if r.Held && (r.Status == ReportOpen || r.Status == ReportClaimed) {
+				r.Status = ReportResolved
+				r.Resolution = ResolutionDismiss
+				return &ReportEntry{Action: ReportActionResolved, ActorID: user.SystemModerator, Note: "author's account was deleted"}, nil
+			}
+			return nil, nil
+		})
+		if errors.Is(err, ErrReportNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExportMessages collects the user's messages from every conversation,
+// their read markers, the reports on their messages and what the filters
+// did to them.
+func (s *Service) ExportMessages(ctx context.Context, userID string) (any, error) {
+	conversations, err := s.UserConversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := UserExport{Messages: []Message{}}
+	for _, conversation := range conversations {
+		cursor := "0-0"
+		for {
+			messages, err := s.repo.GetMessagesAfter(ctx, conversation, cursor, erasureBatchSize)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range messages {
+				if m.From == userID {
+					export.Messages = append(export.Messages, m)
+				}
+			}
+			if len(messages) < erasureBatchSize {
+				break
+			}
+			cursor = messages[len(messages)-1].ID
+		}
+	}
+
+	export.ReadMarkers, err = s.repo.GetReadMarkers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	export.Reports, err = s.repo.AuthorReports(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range export.Reports {
+		export.Reports[i].ReporterID = ""
+		export.Reports[i].ClaimedBy = ""
+	}
+
+	export.FilterRecords, err = s.repo.UserFilterRecords(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
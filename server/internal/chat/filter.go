@@ -0,0 +1,62 @@
+package chat
+
+import (
+	"chatter/server/internal/filter"
+	"context"
+	"log"
+	"time"
+)
+
+// MessageFilter checks and cleans up text before it is stored,
+// filter.Store implements it.
+type MessageFilter interface {
+	Apply(text string) (*filter.Result, error)
+}
+
+// FilterRecord is what the filters did to one message, kept for
+// moderators. MessageID is empty when the message was rejected.
+type FilterRecord struct {
+	ID           string            `json:"id"`
+	UserID       string            `json:"userId"`
+	Conversation string            `json:"conversation"`
+	MessageID    string            `json:"messageId,omitempty"`
+	Original     string            `json:"original"`
+	Text         string            `json:"text"`
+	Decisions    []filter.Decision `json:"decisions"`
+	Rejected     bool              `json:"rejected"`
+	CreatedAt    time.Time         `json:"createdAt"`
+}
+
+// SetMessageFilter replaces the default filters, which only strip invisible
+// characters and normalize.
+func (s *Service) SetMessageFilter(f MessageFilter) {
+	s.filter = f
+}
+
+// recordFilter keeps the decisions of a filtered message, failing to do so
+// doesn't stop the message.
+func (s *Service) recordFilter(ctx context.Context, m *Message, original string, result *filter.Result, rejected bool) {
+	if result == nil || len(result.Decisions) == 0 {
+		return
+	}
+
+	record := FilterRecord{
+		UserID:       m.From,
+		Conversation: ConversationID(m),
+		MessageID:    m.ID,
+		Original:     original,
+		Text:         result.Text,
+		Decisions:    result.Decisions,
+		Rejected:     rejected,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if err := s.repo.AddFilterRecord(ctx, &record); err != nil {
+		log.Printf("chat: failed to record filter decisions, %v", err)
+	}
+}
+
+// GetFilterRecords pages backwards through the filter log, from the newest
+// record or from before the given ID.
+func (s *Service) GetFilterRecords(ctx context.Context, before string, count int) ([]FilterRecord, error) {
+	return s.repo.GetFilterRecords(ctx, before, count)
+}
@@ -2,11 +2,15 @@
 package chat
 
 import (
+	"chatter/server/internal/filter"
 	"chatter/server/internal/middleware"
 	"chatter/server/internal/user"
 	"encoding/json"
 	"errors"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -15,11 +19,12 @@ import (
 )
 
 const (
-	maxConnections = 1000
-	maxMessageSize = 512
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = 54 * time.Second
+	maxFilterRecords = 100
+	maxConnections   = 1000
+	maxMessageSize   = 512
+	writeWait        = 10 * time.Second
+	pongWait         = 60 * time.Second
+	pingPeriod       = 54 * time.Second
 )
 
 type messageType string
@@ -37,16 +42,105 @@ type sendMessageRequest struct {
 	Message string `json:"message"`
 }
 
+type readMarkerRequest struct {
+	Conversation string `json:"conversation"`
+	MessageID    string `json:"messageId"`
+}
+
+type unreadResponse struct {
+	Unread []UnreadCount `json:"unread"`
+}
+
+type seenByResponse struct {
+	UserIDs []string `json:"userIds"`
+}
+
 type errorResponse struct {
 	Message string `json:"message"`
 }
 
+type reportRequest struct {
+	Conversation string `json:"conversation"`
+	Reason       string `json:"reason"`
+}
+
+type reportsResponse struct {
+	Reports []Report `json:"reports"`
+}
+
+type commentRequest struct {
+	Comment string `json:"comment"`
+}
+
+// resolveRequest takes the duration of a mute or ban as "30m" or "24h",
+// empty for one that lasts until lifted.
+type resolveRequest struct {
+	Resolution string `json:"resolution"`
+	Note       string `json:"note"`
+	Duration   string `json:"duration"`
+}
+
+// roomModeRequest takes the slow mode interval and how long the modes last
+// as "30s" or "15m", an empty duration keeps them until changed.
+type roomModeRequest struct {
+	SlowMode string `json:"slowMode"`
+	ReadOnly bool   `json:"readOnly"`
+	Duration string `json:"duration"`
+}
+
+// roomModeErrorResponse tells a rejected sender how many seconds are left
+// until they can post, zero when that isn't known.
+type roomModeErrorResponse struct {
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+type filterLogResponse struct {
+	Records []FilterRecord `json:"records"`
+}
+
 func (h *Handler) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Post("/chatroom", h.sendChatroomMessage)
-	r.Get("/ws", h.readChatroomMessages)
-	r.Get("/history", h.loadMoreHistory)
+	r.With(
+		middleware.RequireScope(user.ScopeSendMessages),
+		middleware.RequireRoomPermission(ChatroomID, user.PermSendMessages),
+	).Post("/chatroom", h.sendChatroomMessage)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(user.ScopeReadHistory))
+
+		r.Get("/ws", h.readChatroomMessages)
+		r.Get("/history", h.loadMoreHistory)
+		r.Get("/messages/{id}", h.getMessage)
+		r.Get("/permalink", h.resolvePermalink)
+		r.Post("/read", h.markRead)
+		r.Get("/unread", h.getUnreadCounts)
+		r.Get("/seen", h.getSeenBy)
+		r.Get("/rooms/{room}/mode", h.getRoomMode)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequireScope(user.ScopeManageRooms), middleware.RequirePermission(user.PermModerate))
+
+		r.Put("/rooms/{room}/mode", h.setRoomMode)
+		r.Delete("/rooms/{room}/mode", h.setRoomMode)
+	})
+
+	r.With(middleware.NoAccessTokens).Post("/messages/{id}/report", h.reportMessage)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.NoAccessTokens, middleware.RequirePermission(user.PermModerate))
+
+		r.Get("/filter-log", h.getFilterLog)
+		r.Get("/reports", h.listReports)
+		r.Get("/reports/{id}", h.getReport)
+		r.Post("/reports/{id}/claim", h.claimReport)
+		r.Post("/reports/{id}/resolve", h.resolveReport)
+		r.Post("/reports/{id}/comments", h.commentReport)
+		r.Get("/spam", h.getSpamStats)
+		r.Delete("/spam/counters", h.resetSpamCounters)
+	})
 
 	return r
 }
@@ -74,7 +168,23 @@ func (h *Handler) sendChatroomMessage(w http.ResponseWriter, r *http.Request) {
 	m.Content = req.Message
 
 	if err := h.service.SendChatroomMessage(r.Context(), &m); err != nil {
-		if errors.Is(err, ErrNoMessage) || errors.Is(err, ErrMessageLimit) {
+		if errors.Is(err, ErrMessageHeld) {
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+			return
+		}
+		var sanctioned *user.SanctionError
+		if errors.As(err, &sanctioned) {
+			user.WriteSanctioned(w, sanctioned)
+			return
+		}
+		var limited *RoomModeError
+		if errors.As(err, &limited) {
+			writeRoomModeError(w, limited)
+			return
+		}
+		var rejected *filter.RejectedError
+		if errors.Is(err, ErrNoMessage) || errors.Is(err, ErrMessageLimit) || errors.As(err, &rejected) {
 			w.WriteHeader(http.StatusBadRequest)
 			json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
 			return
@@ -105,6 +215,17 @@ func (h *Handler) readChatroomMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.service.CheckConnect(r.Context(), claims.UserID, clientIP(r)); err != nil {
+		var sanctioned *user.SanctionError
+		if errors.As(err, &sanctioned) {
+			user.WriteSanctioned(w, sanctioned)
+			return
+		}
+		log.Printf("chat: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		http.Error(w, "Unable to upgrade", http.StatusBadRequest)
@@ -121,8 +242,11 @@ func (h *Handler) readChatroomMessages(w http.ResponseWriter, r *http.Request) {
 
 	u := UserInfo{ID: claims.UserID, Username: claims.Username}
 
-	h.service.Addclient(r.Context(), conn, &u)
-	defer h.service.RemoveClient(conn, &u)
+	// Moderator events stay with logged in moderators, a token only reads the
+	// room.
+	moderator := !claims.IsAccessToken() && claims.Can(user.PermModerate, ChatroomID)
+	h.service.Addclient(r.Context(), conn, u, claims.SessionID, moderator)
+	defer h.service.RemoveClient(conn)
 
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
@@ -132,9 +256,11 @@ func (h *Handler) readChatroomMessages(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer close(done)
 		for {
-			if _, _, err := conn.NextReader(); err != nil {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
 				break
 			}
+			h.service.HandleClientMessage(conn, data)
 		}
 	}()
 
@@ -143,8 +269,7 @@ func (h *Handler) readChatroomMessages(w http.ResponseWriter, r *http.Request) {
 		case <-done:
 			return
 		case <-ticker.C:
-			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := h.service.ping(conn); err != nil {
 				return
 			}
 		}
@@ -164,10 +289,432 @@ func (h *Handler) loadMoreHistory(w http.ResponseWriter, r *http.Request) {
 
 	messages, err := h.service.LoadHistoryMessages(r.Context(), after)
 	if err != nil {
-		http.Error(w, "no messages", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(historyResponse{Messages: messages})
+}
+
+func (h *Handler) getMessage(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	conversation := r.URL.Query().Get("conversation")
+	if conversation == "" {
+		conversation = ChatroomID
+	}
+
+	mc, err := h.service.GetMessage(r.Context(), claims.UserID, conversation, chi.URLParam(r, "id"))
+	writeMessageContext(w, mc, err)
+}
+
+func (h *Handler) resolvePermalink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	mc, err := h.service.ResolvePermalink(r.Context(), claims.UserID, r.URL.Query().Get("link"))
+	writeMessageContext(w, mc, err)
+}
+
+func writeMessageContext(w http.ResponseWriter, mc *MessageContext, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mc)
+}
+
+func writeRoomModeError(w http.ResponseWriter, err *RoomModeError) {
+	status := http.StatusForbidden
+	if errors.Is(err, ErrSlowMode) {
+		status = http.StatusTooManyRequests
+	}
+
+	// Round up, a client retrying after a rounded down wait is rejected
+	// again.
+	seconds := int((err.RetryAfter + time.Second - 1) / time.Second)
+	if seconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(roomModeErrorResponse{Message: err.Error(), RetryAfter: seconds})
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case errors.Is(err, ErrInvalidMessageID),
+		errors.Is(err, ErrInvalidConversation),
+		errors.Is(err, ErrInvalidPermalink),
+		errors.Is(err, ErrReportReason),
+		errors.Is(err, ErrReportComment),
+		errors.Is(err, ErrInvalidResolution),
+		errors.Is(err, ErrInvalidRoomMode),
+		errors.Is(err, user.ErrSanctionReason),
+		errors.Is(err, user.ErrSanctionDuration):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+	case errors.Is(err, ErrForbidden),
+		errors.Is(err, ErrReportSelf),
+		errors.Is(err, user.ErrSanctionForbidden),
+		errors.Is(err, user.ErrSanctionSelf):
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+	case errors.Is(err, ErrMessageNotFound),
+		errors.Is(err, ErrReportNotFound),
+		errors.Is(err, ErrRoomNotFound),
+		errors.Is(err, user.ErrUserNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+	case errors.Is(err, ErrReportDuplicate),
+		errors.Is(err, ErrReportClaimed),
+		errors.Is(err, ErrReportResolved),
+		errors.Is(err, ErrReportResolving),
+		errors.Is(err, ErrReportNotHeld):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+	default:
+		log.Printf("chat: internal server error, %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Something went wrong"})
+	}
+}
+
+func (h *Handler) markRead(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	var req readMarkerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Can't decode the JSON"})
+		return
+	}
+	if req.Conversation == "" {
+		req.Conversation = ChatroomID
+	}
+
+	marker, err := h.service.MarkRead(r.Context(), claims.UserID, req.Conversation, req.MessageID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(marker)
+}
+
+func (h *Handler) getUnreadCounts(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	counts, err := h.service.GetUnreadCounts(r.Context(), claims.UserID, r.URL.Query()["conversation"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(unreadResponse{Unread: counts})
+}
+
+func (h *Handler) getSeenBy(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	conversation := r.URL.Query().Get("conversation")
+	if conversation == "" {
+		conversation = ChatroomID
+	}
+
+	userIDs, err := h.service.SeenBy(r.Context(), claims.UserID, conversation, r.URL.Query().Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(seenByResponse{UserIDs: userIDs})
+}
+
+// getFilterLog pages through filter decisions, newest first. before is the
+// ID of the last record of the previous page.
+func (h *Handler) getFilterLog(w http.ResponseWriter, r *http.Request) {
+	limit := maxFilterRecords
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errorResponse{Message: "invalid limit"})
+			return
+		}
+		limit = min(n, maxFilterRecords)
+	}
+
+	records, err := h.service.GetFilterRecords(r.Context(), r.URL.Query().Get("before"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(filterLogResponse{Records: records})
+}
+
+func (h *Handler) reportMessage(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	var req reportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Can't decode the JSON"})
+		return
+	}
+	if req.Conversation == "" {
+		req.Conversation = ChatroomID
+	}
+
+	report, err := h.service.ReportMessage(r.Context(), claims.UserID, req.Conversation, chi.URLParam(r, "id"), req.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// listReports returns the queue, or the latest resolved reports with
+// status=resolved.
+func (h *Handler) listReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := h.service.ListReports(r.Context(), r.URL.Query().Get("status") == string(ReportResolved))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reportsResponse{Reports: reports})
+}
+
+func (h *Handler) getReport(w http.ResponseWriter, r *http.Request) {
+	report, err := h.service.GetReport(r.Context(), chi.URLParam(r, "id"))
+	writeReport(w, report, err)
+}
+
+func (h *Handler) claimReport(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	report, err := h.service.ClaimReport(r.Context(), claims, chi.URLParam(r, "id"))
+	writeReport(w, report, err)
+}
+
+func (h *Handler) resolveReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	var req resolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Can't decode the JSON"})
+		return
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.Duration); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errorResponse{Message: "invalid duration"})
+			return
+		}
+	}
+
+	report, err := h.service.ResolveReport(r.Context(), claims, chi.URLParam(r, "id"), ResolveRequest{
+		Resolution: Resolution(req.Resolution),
+		Note:       req.Note,
+		Duration:   duration,
+	})
+	writeReport(w, report, err)
+}
+
+func (h *Handler) commentReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	var req commentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Can't decode the JSON"})
+		return
+	}
+
+	report, err := h.service.CommentReport(r.Context(), claims, chi.URLParam(r, "id"), req.Comment)
+	writeReport(w, report, err)
+}
+
+func writeReport(w http.ResponseWriter, report *Report, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *Handler) getSpamStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.service.GetSpamStats(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *Handler) resetSpamCounters(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.ResetSpamCounters(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getRoomMode(w http.ResponseWriter, r *http.Request) {
+	state, err := h.service.GetRoomState(r.Context(), chi.URLParam(r, "room"))
+	writeRoomState(w, state, err)
+}
+
+// setRoomMode changes the room's modes, DELETE turns them off.
+func (h *Handler) setRoomMode(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := r.Context().Value(middleware.UserKey).(*user.CustomClaims)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(errorResponse{Message: "Unauthorized"})
+		return
+	}
+
+	var req roomModeRequest
+	if r.Method != http.MethodDelete {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(errorResponse{Message: "Can't decode the JSON"})
+			return
+		}
+	}
+
+	slowMode, err := parseDuration(req.SlowMode)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	duration, err := parseDuration(req.Duration)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	state, err := h.service.SetRoomMode(r.Context(), claims, chi.URLParam(r, "room"), RoomModeRequest{
+		SlowMode: slowMode,
+		ReadOnly: req.ReadOnly,
+		Duration: duration,
+	})
+	writeRoomState(w, state, err)
+}
+
+// parseDuration reads "30s" or "15m", empty is zero.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, ErrInvalidRoomMode
+	}
+	return d, nil
+}
+
+func writeRoomState(w http.ResponseWriter, state *RoomState, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(state)
 }
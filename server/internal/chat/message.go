@@ -1,6 +1,9 @@
 package chat
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Message struct {
 	ID        string    `json:"id"`
@@ -23,11 +26,19 @@ const (
 	typeChat     messageType = "chat"
 	typeUserList messageType = "user_list"
 	typeHistory  messageType = "history"
+	typeTyping   messageType = "typing"
+	typeError    messageType = "error"
+
+	typeTypingStart messageType = "typing_start"
+	typeTypingStop  messageType = "typing_stop"
 )
 
 type UserInfo struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+	StatusText  string `json:"statusText,omitempty"`
 }
 
 type PresenceMessage struct {
@@ -39,3 +50,15 @@ type WSMessage struct {
 	Type messageType `json:"type"`
 	Data any         `json:"data"`
 }
+
+type ClientMessage struct {
+	Type messageType     `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type MessageContext struct {
+	Message   Message   `json:"message"`
+	Before    []Message `json:"before"`
+	After     []Message `json:"after"`
+	Permalink string    `json:"permalink"`
+}
@@ -0,0 +1,73 @@
+package chat
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"chatter/server/internal/user"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// AuditLog records moderation actions, audit.Log implements it.
+type AuditLog interface {
+	Record(ctx context.Context, e audit.Entry)
+}
+
+func (s *Service) SetAuditLog(l AuditLog) {
+	s.audit = l
+}
+
+func (s *Service) record(ctx context.Context, e audit.Entry) {
+	if s.audit != nil {
+		s.audit.Record(ctx, e)
+	}
+}
+
+// CheckConnect turns away users who are banned, by account or address, or
+// were kicked and are still waiting to come back.
+func (s *Service) CheckConnect(ctx context.Context, userID, ip string) error {
+	if err := s.checkSanction(ctx, user.SanctionBan, userID, ip); err != nil {
+		return err
+	}
+	return s.checkSanction(ctx, user.SanctionKick, userID, "")
+}
+
+func (s *Service) checkSanction(ctx context.Context, kind user.SanctionKind, userID, ip string) error {
+	sanction, err := s.users.ActiveSanction(ctx, kind, userID, ip)
+	if err != nil {
+		return fmt.Errorf("chat: failed to check %s, %v", kind, err)
+	}
+	if sanction != nil {
+		return &user.SanctionError{Sanction: sanction}
+	}
+
+	return nil
+}
+
+// applyModeration drops the connections of a kicked or banned user, the
+// event itself then goes out to everyone as a system message. The reason
+// stays in the event, close frames are too short for it.
+func (s *Service) applyModeration(data json.RawMessage) {
+	var action events.ModerationAction
+	if err := json.Unmarshal(data, &action); err != nil {
+		log.Printf("chat: invalid moderation event, %v", err)
+		return
+	}
+	if action.Lifted {
+		return
+	}
+
+	var reason string
+	switch user.SanctionKind(action.Kind) {
+	case user.SanctionKick:
+		reason = "kicked by a moderator"
+	case user.SanctionBan:
+		reason = "banned by a moderator"
+	default:
+		return
+	}
+
+	s.disconnect(func(c *client) bool { return c.user.ID == action.UserID }, reason)
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"chatter/server/internal/events"
+	"context"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// maxUnreadCount caps how far the stream is scanned when counting unread
+// messages, clients show anything above it as "99+".
+const maxUnreadCount = 100
+
+type ReadMarker struct {
+	Conversation string `json:"conversation"`
+	MessageID    string `json:"messageId"`
+}
+
+type UnreadCount struct {
+	Conversation string `json:"conversation"`
+	LastReadID   string `json:"lastReadId,omitempty"`
+	Count        int    `json:"count"`
+}
+
+func (s *Service) MarkRead(ctx context.Context, userID, conversation, id string) (*ReadMarker, error) {
+	if err := validateConversation(conversation); err != nil {
+		return nil, err
+	}
+	if !messageIDPattern.MatchString(id) {
+		return nil, ErrInvalidMessageID
+	}
+	if !canAccess(userID, conversation) {
+		return nil, ErrForbidden
+	}
+
+	if _, err := s.repo.GetMessage(ctx, conversation, id); err != nil {
+		return nil, err
+	}
+
+	current, err := s.repo.SetReadMarker(ctx, userID, conversation, id)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := &ReadMarker{Conversation: conversation, MessageID: current}
+	if err := s.publish(ctx, events.ReadMarker, userID, marker); err != nil {
+		log.Printf("chat: failed to publish read marker, %v", err)
+	}
+
+	return marker, nil
+}
+
+// GetUnreadCounts counts messages from other users after the read marker of
+// each conversation. Without conversations it reports the chatroom and every
+// conversation the user has read before.
+func (s *Service) GetUnreadCounts(ctx context.Context, userID string, conversations []string) ([]UnreadCount, error) {
+	markers, err := s.repo.GetReadMarkers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conversations) == 0 {
+		conversations = append(conversations, ChatroomID)
+		for conversation := range markers {
+			if conversation != ChatroomID {
+				conversations = append(conversations, conversation)
+			}
+		}
+	}
+
+	counts := make([]UnreadCount, 0, len(conversations))
+	for _, conversation := range conversations {
+		if err := validateConversation(conversation); err != nil {
+			return nil, err
+		}
+		if !canAccess(userID, conversation) {
+			return nil, ErrForbidden
+		}
+
+		lastRead := markers[conversation]
+		count, err := s.repo.CountMessagesAfter(ctx, conversation, lastRead, userID, maxUnreadCount)
+		if err != nil {
+			return nil, err
+		}
+
+		counts = append(counts, UnreadCount{
+			Conversation: conversation,
+			LastReadID:   lastRead,
+			Count:        count,
+		})
+	}
+
+	return counts, nil
+}
+
+// SeenBy returns the users whose read marker is at or past the message.
+func (s *Service) SeenBy(ctx context.Context, userID, conversation, id string) ([]string, error) {
+	if err := validateConversation(conversation); err != nil {
+		return nil, err
+	}
+	if !messageIDPattern.MatchString(id) {
+		return nil, ErrInvalidMessageID
+	}
+	if !canAccess(userID, conversation) {
+		return nil, ErrForbidden
+	}
+
+	markers, err := s.repo.GetConversationReadMarkers(ctx, conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	seenBy := []string{}
+	for reader, lastRead := range markers {
+		if CompareMessageIDs(lastRead, id) >= 0 {
+			seenBy = append(seenBy, reader)
+		}
+	}
+
+	return seenBy, nil
+}
+
+// CompareMessageIDs orders two stream IDs, returning -1, 0 or 1.
+func CompareMessageIDs(a, b string) int {
+	aMs, aSeq := splitMessageID(a)
+	bMs, bSeq := splitMessageID(b)
+
+	switch {
+	case aMs < bMs:
+		return -1
+	case aMs > bMs:
+		return 1
+	case aSeq < bSeq:
+		return -1
+	case aSeq > bSeq:
+		return 1
+	}
+	return 0
+}
+
+func splitMessageID(id string) (uint64, uint64) {
+	msStr, seqStr, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msStr, 10, 64)
+	seq, _ := strconv.ParseUint(seqStr, 10, 64)
+	return ms, seq
+}
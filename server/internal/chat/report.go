@@ -0,0 +1,427 @@
+package chat
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxReportTextLength = 500
+	maxReports          = 100
+	// reportResolveTimeout is how long a report stays locked by a
+	// resolution that didn't finish.
+	reportResolveTimeout = time.Minute
+)
+
+// ReportStatus is where a report is in the moderation queue.
+type ReportStatus string
+
+const (
+	ReportOpen    ReportStatus = "open"
+	ReportClaimed ReportStatus = "claimed"
+	// ReportResolving is a report a moderator is acting on.
+	ReportResolving ReportStatus = "resolving"
+	ReportResolved  ReportStatus = "resolved"
+)
+
+// Resolution is what a moderator did about a report.
+type Resolution string
+
+const (
+	ResolutionDismiss Resolution = "dismiss"
+	ResolutionDelete  Resolution = "delete"
+	ResolutionMute    Resolution = "mute"
+	ResolutionBan     Resolution = "ban"
+	// ResolutionApprove posts a held message.
+	ResolutionApprove Resolution = "approve"
+)
+
+// ReportAction names an entry in a report's trail.
+type ReportAction string
+
+const (
+	ReportActionCreated   ReportAction = "created"
+	ReportActionClaimed   ReportAction = "claimed"
+	ReportActionCommented ReportAction = "commented"
+	ReportActionResolved  ReportAction = "resolved"
+)
+
+var (
+	ErrReportReason      = errors.New("reason must be 1 to 500 characters")
+	ErrReportComment     = errors.New("comment must be 1 to 500 characters")
+	ErrReportSelf        = errors.New("can't report your own message")
+	ErrReportDuplicate   = errors.New("you already reported this message")
+	ErrReportNotFound    = errors.New("report not found")
+	ErrReportClaimed     = errors.New("report is claimed by another moderator")
+	ErrReportResolved    = errors.New("report is already resolved")
+	ErrReportResolving   = errors.New("report is being resolved")
+	ErrInvalidResolution = errors.New("resolution must be dismiss, delete, approve, mute or ban")
+	ErrReportNotHeld     = errors.New("only held messages can be approved")
+)
+
+// Moderator sanctions the authors of reported messages and spammers,
+// user.Service implements it.
+type Moderator interface {
+	Sanction(ctx context.Context, actor *user.CustomClaims, req user.SanctionRequest) (*user.Sanction, error)
+	AutoSanction(ctx context.Context, req user.SanctionRequest) (*user.Sanction, error)
+}
+
+// Report is a user pointing moderators at a message. The message is copied
+// so the report still makes sense once it is deleted. Held reports are
+// filed by the spam detector for messages that weren't posted, they have
+// no MessageID until approved.
+type Report struct {
+	ID           string        `json:"id"`
+	Conversation string        `json:"conversation"`
+	MessageID    string        `json:"messageId"`
+	AuthorID     string        `json:"authorId"`
+	AuthorName   string        `json:"authorName"`
+	Content      string        `json:"content"`
+	ReporterID   string        `json:"reporterId"`
+	Reason       string        `json:"reason"`
+	Held         bool          `json:"held,omitempty"`
+	Status       ReportStatus  `json:"status"`
+	ClaimedBy    string        `json:"claimedBy,omitempty"`
+	Resolution   Resolution    `json:"resolution,omitempty"`
+	SanctionID   string        `json:"sanctionId,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	UpdatedAt    time.Time     `json:"updatedAt"`
+	Trail        []ReportEntry `json:"trail,omitempty"`
+}
+
+// ReportEntry is one step in the handling of a report, every claim,
+// comment and resolution adds one.
+type ReportEntry struct {
+	Action    ReportAction `json:"action"`
+	ActorID   string       `json:"actorId"`
+	Note      string       `json:"note,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// ResolveRequest closes a report. Duration limits a mute or ban, Note is
+// kept in the trail and is the sanction's reason when set.
+type ResolveRequest struct {
+	Resolution Resolution
+	Note       string
+	Duration   time.Duration
+}
+
+// SetModerator lets reports be resolved by muting or banning the author.
+func (s *Service) SetModerator(m Moderator) {
+	s.moderator = m
+}
+
+// ReportMessage puts a message the user can see into the moderation queue
+// and tells the moderators online.
+func (s *Service) ReportMessage(ctx context.Context, reporterID, conversation, messageID, reason string) (*Report, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" || utf8.RuneCountInString(reason) > maxReportTextLength {
+		return nil, ErrReportReason
+	}
+	if err := validateConversation(conversation); err != nil {
+		return nil, err
+	}
+	if !messageIDPattern.MatchString(messageID) {
+		return nil, ErrInvalidMessageID
+	}
+	if !canAccess(reporterID, conversation) {
+		return nil, ErrForbidden
+	}
+
+	m, err := s.repo.GetMessage(ctx, conversation, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if m.From == reporterID {
+		return nil, ErrReportSelf
+	}
+
+	now := time.Now().UTC()
+	report := &Report{
+		ID:           uuid.NewString(),
+		Conversation: conversation,
+		MessageID:    m.ID,
+		AuthorID:     m.From,
+		AuthorName:   m.FromName,
+		Content:      m.Content,
+		ReporterID:   reporterID,
+		Reason:       reason,
+		Status:       ReportOpen,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	entry := ReportEntry{Action: ReportActionCreated, ActorID: reporterID, Note: reason, CreatedAt: now}
+
+	if err := s.repo.AddReport(ctx, report, entry); err != nil {
+		return nil, err
+	}
+	report.Trail = []ReportEntry{entry}
+
+	if err := s.publish(ctx, events.ReportCreated, "", report); err != nil {
+		log.Printf("chat: failed to announce report %s, %v", report.ID, err)
+	}
+
+	return report, nil
+}
+
+// holdMessage files the message as a held report, reported by
+// user.SystemModerator.
+func (s *Service) holdMessage(ctx context.Context, m *Message, reason string) error {
+	now := time.Now().UTC()
+	report := &Report{
+		ID:           uuid.NewString(),
+		Conversation: ConversationID(m),
+		AuthorID:     m.From,
+		AuthorName:   m.FromName,
+		Content:      m.Content,
+		ReporterID:   user.SystemModerator,
+		Reason:       reason,
+		Held:         true,
+		Status:       ReportOpen,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	entry := ReportEntry{Action: ReportActionCreated, ActorID: user.SystemModerator, Note: reason, CreatedAt: now}
+
+	if err := s.repo.AddReport(ctx, report, entry); err != nil {
+		return fmt.Errorf("chat: failed to hold message, %v", err)
+	}
+
+	if err := s.publish(ctx, events.ReportCreated, "", report); err != nil {
+		log.Printf("chat: failed to announce report %s, %v", report.ID, err)
+	}
+
+	return nil
+}
+
+// ListReports returns the open and claimed reports oldest first, or with
+// resolved set the latest resolved ones.
+func (s *Service) ListReports(ctx context.Context, resolved bool) ([]Report, error) {
+	return s.repo.ListReports(ctx, resolved, maxReports)
+}
+
+func (s *Service) GetReport(ctx context.Context, id string) (*Report, error) {
+	return s.repo.GetReport(ctx, id)
+}
+
+// ClaimReport tells other moderators the actor is looking at the report.
+func (s *Service) ClaimReport(ctx context.Context, actor *user.CustomClaims, id string) (*Report, error) {
+	report, err := s.repo.UpdateReport(ctx, id, func(r *Report) (*ReportEntry, error) {
+		if err := checkReportOpen(r, actor.UserID); err != nil {
+			return nil, err
+		}
+		if r.ClaimedBy == actor.UserID {
+			return nil, nil
+		}
+
+		r.Status = ReportClaimed
+		r.ClaimedBy = actor.UserID
+		return &ReportEntry{Action: ReportActionClaimed, ActorID: actor.UserID}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("chat: report %s claimed by %s", id, actor.UserID)
+	return report, nil
+}
+
+// CommentReport adds a moderator's note to the report's trail, resolved
+// reports can still be commented on.
+func (s *Service) CommentReport(ctx context.Context, actor *user.CustomClaims, id, comment string) (*Report, error) {
+	comment = strings.TrimSpace(comment)
+	if comment == "" || utf8.RuneCountInString(comment) > maxReportTextLength {
+		return nil, ErrReportComment
+	}
+
+	return s.repo.UpdateReport(ctx, id, func(r *Report) (*ReportEntry, error) {
+		return &ReportEntry{Action: ReportActionCommented, ActorID: actor.UserID, Note: comment}, nil
+	})
+}
+
+// ResolveReport acts on the reported message or its author and closes the
+// report. A report claimed by someone else can only be resolved by them. A
+// held message is only posted when approved. The report is marked as being
+// resolved before anything is done, so two moderators can't both act on
+// it.
+func (s *Service) ResolveReport(ctx context.Context, actor *user.CustomClaims, id string, req ResolveRequest) (*Report, error) {
+	req.Note = strings.TrimSpace(req.Note)
+	if utf8.RuneCountInString(req.Note) > maxReportTextLength {
+		return nil, ErrReportComment
+	}
+
+	switch req.Resolution {
+	case ResolutionDismiss, ResolutionDelete, ResolutionApprove:
+	case ResolutionMute, ResolutionBan:
+		if s.moderator == nil {
+			return nil, fmt.Errorf("chat: no moderator to %s with", req.Resolution)
+		}
+	default:
+		return nil, ErrInvalidResolution
+	}
+
+	var status ReportStatus
+	var claimedBy string
+	report, err := s.repo.UpdateReport(ctx, id, func(r *Report) (*ReportEntry, error) {
+		if err := checkReportOpen(r, actor.UserID); err != nil {
+			return nil, err
+		}
+		if req.Resolution == ResolutionApprove && !r.Held {
+			return nil, ErrReportNotHeld
+		}
+
+		status, claimedBy = r.Status, r.ClaimedBy
+		if status == ReportResolving {
+			// Taking over from a resolution that never finished.
+			status = ReportClaimed
+		}
+		r.Status = ReportResolving
+		r.ClaimedBy = actor.UserID
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sanctionID, messageID, err := s.applyResolution(ctx, actor, report, req)
+	if err != nil {
+		s.reopenReport(ctx, actor, id, status, claimedBy)
+		return nil, err
+	}
+
+	report, err = s.repo.UpdateReport(ctx, id, func(r *Report) (*ReportEntry, error) {
+		if r.Status == ReportResolved {
+			return nil, ErrReportResolved
+		}
+
+		r.Status = ReportResolved
+		r.Resolution = req.Resolution
+		r.SanctionID = sanctionID
+		if messageID != "" {
+			r.MessageID = messageID
+		}
+		r.ClaimedBy = actor.UserID
+		return &ReportEntry{Action: ReportActionResolved, ActorID: actor.UserID, Note: req.Note}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("chat: report %s resolved by %s with %s", id, actor.UserID, req.Resolution)
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionReportResolve,
+		ActorID:  actor.UserID,
+		TargetID: report.AuthorID,
+		Details: map[string]string{
+			"report_id":    report.ID,
+			"resolution":   string(report.Resolution),
+			"conversation": report.Conversation,
+			"message_id":   report.MessageID,
+			"sanction_id":  report.SanctionID,
+			"note":         req.Note,
+		},
+	})
+
+	return report, nil
+}
+
+// applyResolution does what the resolution says to the reported message or
+// its author. It returns the sanction placed or the message posted.
+func (s *Service) applyResolution(ctx context.Context, actor *user.CustomClaims, report *Report, req ResolveRequest) (sanctionID, messageID string, err error) {
+	switch req.Resolution {
+	case ResolutionDelete:
+		if report.Held {
+			return "", "", nil
+		}
+		return "", "", s.deleteReportedMessage(ctx, report)
+	case ResolutionApprove:
+		m := Message{From: report.AuthorID, FromName: report.AuthorName, Content: report.Content}
+		if err := s.repo.AddChatroomMessage(ctx, &m); err != nil {
+			return "", "", fmt.Errorf("chat: failed to post held message, %v", err)
+		}
+		return "", m.ID, nil
+	case ResolutionMute, ResolutionBan:
+		reason := req.Note
+		if reason == "" {
+			reason = report.Reason
+		}
+		sanction, err := s.moderator.Sanction(ctx, actor, user.SanctionRequest{
+			Kind:     user.SanctionKind(req.Resolution),
+			UserID:   report.AuthorID,
+			Reason:   reason,
+			Duration: req.Duration,
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return sanction.ID, "", nil
+	}
+
+	return "", "", nil
+}
+
+// reopenReport puts a report back the way it was when its resolution
+// failed, unless someone else has taken it over since.
+func (s *Service) reopenReport(ctx context.Context, actor *user.CustomClaims, id string, status ReportStatus, claimedBy string) {
+	_, err := s.repo.UpdateReport(ctx, id, func(r *Report) (*ReportEntry, error) {
+		if r.Status != ReportResolving || r.ClaimedBy != actor.UserID {
+			return nil, nil
+		}
+
+		r.Status = status
+		r.ClaimedBy = claimedBy
+		return nil, nil
+	})
+	if err != nil {
+		log.Printf("chat: failed to reopen report %s, %v", id, err)
+	}
+}
+
+// checkReportOpen lets the actor act on a report that is open or claimed by
+// them. One being resolved is left alone until reportResolveTimeout has
+// passed, in case its resolution never finished.
+func checkReportOpen(r *Report, actorID string) error {
+	switch {
+	case r.Status == ReportResolved:
+		return ErrReportResolved
+	case r.Status == ReportResolving && time.Since(r.UpdatedAt) < reportResolveTimeout:
+		return ErrReportResolving
+	case r.ClaimedBy != "" && r.ClaimedBy != actorID:
+		return ErrReportClaimed
+	}
+	return nil
+}
+
+// deleteReportedMessage removes the message and tells the clients that
+// can see it to drop it.
+func (s *Service) deleteReportedMessage(ctx context.Context, r *Report) error {
+	if err := s.repo.DeleteMessages(ctx, r.Conversation, []string{r.MessageID}); err != nil {
+		return fmt.Errorf("chat: failed to delete message %s, %v", r.MessageID, err)
+	}
+
+	deleted := events.DeletedMessage{Conversation: r.Conversation, MessageID: r.MessageID}
+	var err error
+	if user1, user2, ok := Participants(r.Conversation); ok {
+		err = errors.Join(
+			s.publish(ctx, events.MessageDeleted, user1, deleted),
+			s.publish(ctx, events.MessageDeleted, user2, deleted),
+		)
+	} else {
+		err = s.publish(ctx, events.MessageDeleted, "", deleted)
+	}
+	if err != nil {
+		log.Printf("chat: failed to announce deletion of %s, %v", r.MessageID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package chat
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"chatter/server/internal/user"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const maxSlowMode = time.Hour
+
+var (
+	ErrRoomNotFound    = errors.New("room not found")
+	ErrInvalidRoomMode = errors.New("slow mode must be between 0 and 1h and the duration not negative")
+	ErrSlowMode        = errors.New("slow mode is on, wait before posting again")
+	ErrReadOnly        = errors.New("room is read-only")
+)
+
+// RoomModeError rejects a message the room's mode doesn't allow right now.
+// RetryAfter is zero for a read-only room without an end.
+type RoomModeError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RoomModeError) Error() string { return e.Err.Error() }
+func (e *RoomModeError) Unwrap() error { return e.Err }
+
+// RoomState is how a room limits posting. SlowMode is the seconds a user
+// waits between messages, in a read-only room only moderators post. Both
+// end at ExpiresAt when it is set.
+type RoomState struct {
+	Room      string    `json:"room"`
+	SlowMode  int       `json:"slowMode"`
+	ReadOnly  bool      `json:"readOnly"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+}
+
+func (r *RoomState) active() bool {
+	return r.SlowMode > 0 || r.ReadOnly
+}
+
+// RoomModeRequest switches the modes, Duration ends them after a while.
+// Neither mode set turns them off.
+type RoomModeRequest struct {
+	SlowMode time.Duration
+	ReadOnly bool
+	Duration time.Duration
+}
+
+// GetRoomState returns the room's modes, all off when none are set.
+func (s *Service) GetRoomState(ctx context.Context, room string) (*RoomState, error) {
+	if room != ChatroomID {
+		return nil, ErrRoomNotFound
+	}
+
+	state, err := s.repo.GetRoomState(ctx, room)
+	if err != nil {
+		return nil, fmt.Errorf("chat: failed to load room state, %v", err)
+	}
+	if state == nil {
+		state = &RoomState{Room: room}
+	}
+
+	return state, nil
+}
+
+// SetRoomMode changes the room's modes and tells everyone connected.
+func (s *Service) SetRoomMode(ctx context.Context, actor *user.CustomClaims, room string, req RoomModeRequest) (*RoomState, error) {
+	if room != ChatroomID {
+		return nil, ErrRoomNotFound
+	}
+	if req.SlowMode < 0 || req.SlowMode > maxSlowMode || req.Duration < 0 {
+		return nil, ErrInvalidRoomMode
+	}
+
+	now := time.Now().UTC()
+	state := &RoomState{
+		Room:      room,
+		SlowMode:  int(req.SlowMode.Round(time.Second).Seconds()),
+		ReadOnly:  req.ReadOnly,
+		UpdatedBy: actor.UserID,
+		UpdatedAt: now,
+	}
+
+	var err error
+	if state.active() {
+		if req.Duration > 0 {
+			state.ExpiresAt = now.Add(req.Duration)
+		}
+		err = s.repo.SaveRoomState(ctx, state)
+	} else {
+		err = s.repo.DeleteRoomState(ctx, room)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chat: failed to save room state, %v", err)
+	}
+
+	log.Printf("chat: %s set by %s to slow mode %ds, read-only %t, for %v", room, actor.UserID, state.SlowMode, state.ReadOnly, req.Duration)
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionRoomMode,
+		ActorID:  actor.UserID,
+		TargetID: room,
+		Details: map[string]string{
+			"slow_mode": strconv.Itoa(state.SlowMode),
+			"read_only": strconv.FormatBool(state.ReadOnly),
+			"duration":  req.Duration.String(),
+		},
+	})
+	if err := s.publish(ctx, events.RoomState, "", state); err != nil {
+		log.Printf("chat: failed to publish room state, %v", err)
+	}
+
+	return state, nil
+}
+
+// checkRoomMode lets moderators through and holds everyone else to the
+// room's modes. A message allowed under slow mode starts the user's wait.
+// sender is nil when the user couldn't be loaded.
+func (s *Service) checkRoomMode(ctx context.Context, userID string, sender *user.User, room string) error {
+	state, err := s.repo.GetRoomState(ctx, room)
+	if err != nil {
+		return fmt.Errorf("chat: failed to load room state, %v", err)
+	}
+	if state == nil || !state.active() {
+		return nil
+	}
+	if s.isModerator(ctx, sender, room) {
+		return nil
+	}
+
+	if state.ReadOnly {
+		var wait time.Duration
+		if !state.ExpiresAt.IsZero() {
+			wait = time.Until(state.ExpiresAt)
+		}
+		return &RoomModeError{Err: ErrReadOnly, RetryAfter: wait}
+	}
+
+	wait, err := s.repo.ClaimSlowModeSlot(ctx, room, userID, time.Duration(state.SlowMode)*time.Second)
+	if err != nil {
+		return fmt.Errorf("chat: failed to check slow mode, %v", err)
+	}
+	if wait > 0 {
+		return &RoomModeError{Err: ErrSlowMode, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// isModerator tells whether the user moderates the room, through their
+// global role or a role in the room.
+func (s *Service) isModerator(ctx context.Context, u *user.User, room string) bool {
+	if u == nil {
+		return false
+	}
+	if u.Role.Can(user.PermModerate) {
+		return true
+	}
+
+	roles, err := s.users.GetRoomRoles(ctx, u.ID)
+	if err != nil {
+		log.Printf("chat: failed to load room roles of %s, %v", u.ID, err)
+		return false
+	}
+	return roles[room].Can(user.PermModerate)
+}
+
+// scheduleRoomReset tells this instance's clients when modes with an end
+// are over, every instance gets the event and keeps its own timer.
+func (s *Service) scheduleRoomReset(data json.RawMessage) {
+	var state RoomState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("chat: invalid room state event, %v", err)
+		return
+	}
+
+	s.roomTimersMu.Lock()
+	defer s.roomTimersMu.Unlock()
+
+	if timer, ok := s.roomTimers[state.Room]; ok {
+		timer.Stop()
+		delete(s.roomTimers, state.Room)
+	}
+	if state.ExpiresAt.IsZero() {
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(state.ExpiresAt), func() {
+		s.roomTimersMu.Lock()
+		if s.roomTimers[state.Room] == timer {
+			delete(s.roomTimers, state.Room)
+		}
+		s.roomTimersMu.Unlock()
+
+		s.broadcast(WSMessage{Type: messageType(events.RoomState), Data: RoomState{Room: state.Room}})
+	})
+	s.roomTimers[state.Room] = timer
+}
+
+// sendRoomState tells a new client about the room's modes if any are on.
+func (s *Service) sendRoomState(ctx context.Context, c *client) {
+	state, err := s.repo.GetRoomState(ctx, ChatroomID)
+	if err != nil {
+		log.Printf("chat: failed to load room state, %v", err)
+		return
+	}
+	if state == nil || !state.active() {
+		return
+	}
+
+	data, _ := json.Marshal(WSMessage{Type: messageType(events.RoomState), Data: state})
+	c.write(websocket.TextMessage, data)
+}
@@ -1,6 +1,9 @@
 package chat
 
 import (
+	"chatter/server/internal/events"
+	"chatter/server/internal/filter"
+	"chatter/server/internal/user"
 	"context"
 	"encoding/json"
 	"errors"
@@ -8,6 +11,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -18,30 +22,93 @@ const (
 
 	maxMessageLength = 1000
 	historyCount     = 20
+	contextCount     = 5
 )
 
+var newLines = regexp.MustCompile(newLinePlus)
+
 var (
 	ErrNoMessage    = errors.New("no message found")
 	ErrMessageLimit = errors.New("message limit reached")
+
+	ErrInvalidMessageID = errors.New("invalid message id")
+	ErrMessageNotFound  = errors.New("message not found")
+
+	ErrUnknownMessageType = errors.New("unknown message type")
 )
 
 type Repository interface {
 	AddChatroomMessage(context.Context, *Message) error
 	GetChatroomMessages(context.Context, string) ([]Message, string, error)
 	GetHistory(context.Context, string, int) ([]Message, error)
+	GetMessage(ctx context.Context, conversation, id string) (*Message, error)
+	FirstMessageID(ctx context.Context, conversation string) (string, error)
+	GetMessagesBefore(ctx context.Context, conversation, id string, count int) ([]Message, error)
+	GetMessagesAfter(ctx context.Context, conversation, id string, count int) ([]Message, error)
+	SetReadMarker(ctx context.Context, userID, conversation, id string) (string, error)
+	GetReadMarkers(ctx context.Context, userID string) (map[string]string, error)
+	GetConversationReadMarkers(ctx context.Context, conversation string) (map[string]string, error)
+	CountMessagesAfter(ctx context.Context, conversation, id, excludeFrom string, limit int) (int, error)
+	UserConversations(ctx context.Context, userID string) ([]string, error)
+	DeleteMessages(ctx context.Context, conversation string, ids []string) error
+	RewriteMessages(ctx context.Context, conversation, jobID, cursor string, count int, rewrite func(*Message) bool) (string, bool, int, error)
+	DeleteReadMarkers(ctx context.Context, userID string) error
+	AddFilterRecord(ctx context.Context, record *FilterRecord) error
+	GetFilterRecords(ctx context.Context, before string, count int) ([]FilterRecord, error)
+	UserFilterRecords(ctx context.Context, userID string) ([]FilterRecord, error)
+	DeleteFilterRecords(ctx context.Context, userID string) (int, error)
+	AddReport(ctx context.Context, report *Report, entry ReportEntry) error
+	GetReport(ctx context.Context, id string) (*Report, error)
+	ListReports(ctx context.Context, resolved bool, count int) ([]Report, error)
+	AuthorReports(ctx context.Context, authorID string) ([]Report, error)
+	UpdateReport(ctx context.Context, id string, update func(*Report) (*ReportEntry, error)) (*Report, error)
+	RecordRecentMessage(ctx context.Context, userID string, m RecentMessage, window time.Duration) ([]RecentMessage, error)
+	IncrSpamCounters(ctx context.Context, counters []string) error
+	GetSpamCounters(ctx context.Context) (map[string]int64, error)
+	ResetSpamCounters(ctx context.Context) error
+	GetRoomState(ctx context.Context, room string) (*RoomState, error)
+	SaveRoomState(ctx context.Context, state *RoomState) error
+	DeleteRoomState(ctx context.Context, room string) error
+	ClaimSlowModeSlot(ctx context.Context, room, userID string, interval time.Duration) (time.Duration, error)
+	PublishEvent(context.Context, events.Event) error
+	SubscribeEvents(context.Context) <-chan events.Event
+}
+
+type UserStore interface {
+	GetUserByID(ctx context.Context, id string) (*user.User, error)
+	ActiveSanction(ctx context.Context, kind user.SanctionKind, userID, ip string) (*user.Sanction, error)
+	GetRoomRoles(ctx context.Context, userID string) (map[string]user.Role, error)
 }
 
 type Service struct {
-	repo    Repository
-	clients map[*websocket.Conn]*UserInfo
-	mu      *sync.RWMutex
+	repo   Repository
+	users  UserStore
+	filter MessageFilter
+	spam   SpamPolicy
+	// moderator is set when reports can sanction users.
+	moderator Moderator
+	audit     AuditLog
+	clients   map[*websocket.Conn]*client
+	mu        *sync.RWMutex
+
+	typing   map[typingKey]*typingState
+	typingMu sync.Mutex
+
+	roomTimers   map[string]*time.Timer
+	roomTimersMu sync.Mutex
 }
 
-func NewService(repo Repository) *Service {
+func NewService(repo Repository, users UserStore) *Service {
 	return &Service{
 		repo:    repo,
-		clients: make(map[*websocket.Conn]*UserInfo),
+		users:   users,
+		filter:  filter.DefaultPipeline(),
+		spam:    DefaultSpamPolicy,
+		clients: make(map[*websocket.Conn]*client),
 		mu:      &sync.RWMutex{},
+		typing:  make(map[typingKey]*typingState),
+
+		roomTimers: make(map[string]*time.Timer),
 	}
 }
 
@@ -55,22 +122,95 @@ func (s *Service) SendChatroomMessage(ctx context.Context, m *Message) error {
 		return ErrMessageLimit
 	}
 
-	re := regexp.MustCompile(newLinePlus)
-	m.Content = re.ReplaceAllString(m.Content, newLine)
+	if err := s.checkSanction(ctx, user.SanctionMute, m.From, ""); err != nil {
+		return err
+	}
+
+	original := m.Content
+	result, err := s.filter.Apply(m.Content)
+	if err != nil {
+		s.recordFilter(ctx, m, original, result, true)
+		return err
+	}
+
+	// Filters may leave nothing but whitespace behind.
+	m.Content = newLines.ReplaceAllString(strings.TrimSpace(result.Text), newLine)
+	if m.Content == "" {
+		return ErrNoMessage
+	}
+
+	sender, err := s.users.GetUserByID(ctx, m.From)
+	if err == nil {
+		m.FromName = sender.Name()
+	}
+
+	if err := s.checkRoomMode(ctx, m.From, sender, ChatroomID); err != nil {
+		return err
+	}
+
+	// A failed spam check lets the message through rather than blocking
+	// everyone while Redis has trouble.
+	verdict, err := s.checkSpam(ctx, sender, m)
+	if err != nil {
+		log.Printf("chat: spam check failed, %v", err)
+	} else if verdict.Action != "" && verdict.Action != SpamAllow {
+		s.recordFilter(ctx, m, original, result, false)
+		return s.applySpamAction(ctx, m, verdict)
+	}
+
+	if err := s.repo.AddChatroomMessage(ctx, m); err != nil {
+		return err
+	}
 
-	return s.repo.AddChatroomMessage(ctx, m)
+	s.recordFilter(ctx, m, original, result, false)
+	return nil
 }
 
 func (s *Service) broadcast(m WSMessage) {
+	s.send(m, func(*client) bool { return true })
+}
+
+func (s *Service) sendToUser(userID string, m WSMessage) {
+	s.send(m, func(c *client) bool { return c.user.ID == userID })
+}
+
+func (s *Service) send(m WSMessage, match func(*client) bool) {
 	data, _ := json.Marshal(m)
+
+	var failed []*websocket.Conn
+
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for c := range s.clients {
-		if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
-			c.Close()
-			delete(s.clients, c)
+	for conn, c := range s.clients {
+		if !match(c) {
+			continue
 		}
+		if err := c.write(websocket.TextMessage, data); err != nil {
+			failed = append(failed, conn)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(failed) == 0 {
+		return
 	}
+
+	s.mu.Lock()
+	for _, conn := range failed {
+		conn.Close()
+		delete(s.clients, conn)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Service) ping(conn *websocket.Conn) error {
+	s.mu.RLock()
+	c, ok := s.clients[conn]
+	s.mu.RUnlock()
+	if !ok {
+		return errClientGone
+	}
+
+	return c.write(websocket.PingMessage, nil)
 }
 
 func (s *Service) Listen(ctx context.Context) {
@@ -92,69 +232,335 @@ func (s *Service) Listen(ctx context.Context) {
 	}
 }
 
-func (s *Service) Addclient(ctx context.Context, c *websocket.Conn, u *UserInfo) {
+func (s *Service) ListenEvents(ctx context.Context) {
+	for e := range s.repo.SubscribeEvents(ctx) {
+		switch e.Type {
+		case events.Typing:
+			s.deliverTyping(e.Data)
+			continue
+		case events.UserUpdated:
+			s.updateUserInfo(e.Data)
+		case events.SessionRevoked:
+			s.closeSession(e.Data)
+			continue
+		case events.Moderation:
+			s.applyModeration(e.Data)
+		case events.RoomState:
+			s.scheduleRoomReset(e.Data)
+		case events.ShadowMessage:
+			s.sendToUser(e.UserID, WSMessage{Type: typeChat, Data: e.Data})
+			continue
+		case events.ReportCreated:
+			s.send(WSMessage{Type: messageType(e.Type), Data: e.Data}, func(c *client) bool { return c.moderator })
+			continue
+		}
+
+		m := WSMessage{
+			Type: messageType(e.Type),
+			Data: e.Data,
+		}
+
+		if e.UserID != "" {
+			s.sendToUser(e.UserID, m)
+		} else {
+			s.broadcast(m)
+		}
+	}
+}
+
+func (s *Service) publish(ctx context.Context, t events.Type, userID string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.PublishEvent(ctx, events.Event{Type: t, UserID: userID, Data: raw})
+}
+
+func (s *Service) Addclient(ctx context.Context, conn *websocket.Conn, u UserInfo, sessionID string, moderator bool) {
+	if profile, err := s.users.GetUserByID(ctx, u.ID); err == nil {
+		u.DisplayName = profile.DisplayName
+		u.AvatarURL = profile.AvatarURL()
+		u.StatusText = profile.StatusText
+	}
+
+	c := &client{conn: conn, user: u, sessionID: sessionID, moderator: moderator}
+
 	activeUsers := s.getActiveUsers()
 	if len(activeUsers) > 0 {
 		m := WSMessage{
 			Type: typeUserList,
-			Data: s.getActiveUsers(),
+			Data: activeUsers,
 		}
 		data, _ := json.Marshal(m)
-		c.WriteMessage(websocket.TextMessage, data)
+		c.write(websocket.TextMessage, data)
 	}
+	s.sendRoomState(ctx, c)
 
 	s.mu.Lock()
-	s.clients[c] = u
+	s.clients[conn] = c
 	s.mu.Unlock()
 
 	s.broadcast(WSMessage{
 		Type: typePresence,
 		Data: PresenceMessage{
 			Status: statusJoined,
-			User:   *u,
+			User:   u,
 		},
 	})
 
 	lastID := "+"
 	history, _ := s.repo.GetHistory(ctx, lastID, historyCount)
+	s.resolveNames(ctx, history)
 	m := WSMessage{
 		Type: typeHistory,
 		Data: history,
 	}
 
 	data, _ := json.Marshal(m)
-	c.WriteMessage(websocket.TextMessage, data)
+	c.write(websocket.TextMessage, data)
 }
 
-func (s *Service) RemoveClient(c *websocket.Conn, u *UserInfo) {
+// HandleClientMessage processes a frame sent by the client. Failures are
+// reported back on the same connection.
+func (s *Service) HandleClientMessage(conn *websocket.Conn, data []byte) {
+	if err := s.handleClientMessage(conn, data); err != nil {
+		s.sendError(conn, err)
+	}
+}
+
+func (s *Service) handleClientMessage(conn *websocket.Conn, data []byte) error {
+	var m ClientMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	u, ok := s.clientUser(conn)
+	if !ok {
+		return errClientGone
+	}
+
+	switch m.Type {
+	case typeTypingStart, typeTypingStop:
+		var req typingRequest
+		if len(m.Data) > 0 {
+			if err := json.Unmarshal(m.Data, &req); err != nil {
+				return err
+			}
+		}
+		if req.Conversation == "" {
+			req.Conversation = ChatroomID
+		}
+
+		if m.Type == typeTypingStart {
+			return s.startTyping(conn, u, req.Conversation)
+		}
+		s.stopTyping(u.ID, req.Conversation)
+		return nil
+	}
+
+	return ErrUnknownMessageType
+}
+
+func (s *Service) sendError(conn *websocket.Conn, err error) {
+	s.mu.RLock()
+	c, ok := s.clients[conn]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	data, _ := json.Marshal(WSMessage{Type: typeError, Data: errorResponse{Message: err.Error()}})
+	c.write(websocket.TextMessage, data)
+}
+
+func (s *Service) RemoveClient(conn *websocket.Conn) {
 	s.mu.Lock()
-	delete(s.clients, c)
+	c, ok := s.clients[conn]
+	delete(s.clients, conn)
 	s.mu.Unlock()
 
+	s.clearTyping(conn)
+	if !ok {
+		return
+	}
+
 	s.broadcast(WSMessage{
 		Type: "presence",
 		Data: PresenceMessage{
 			Status: statusLeft,
-			User:   *u,
+			User:   c.user,
 		},
 	})
 }
 
-func (s *Service) getActiveUsers() []*UserInfo {
-	var users []*UserInfo
+// updateUserInfo applies a profile update to the user's open connections so
+// later user lists carry the new name. The info is swapped rather than
+// changed in place, readers hold a copy taken under s.mu.
+func (s *Service) updateUserInfo(data json.RawMessage) {
+	var p events.UserProfile
+	if err := json.Unmarshal(data, &p); err != nil {
+		log.Printf("chat: invalid profile event, %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		if c.user.ID == p.ID {
+			c.user = UserInfo{
+				ID:          c.user.ID,
+				Username:    p.Username,
+				DisplayName: p.DisplayName,
+				AvatarURL:   p.AvatarURL,
+				StatusText:  p.StatusText,
+			}
+		}
+	}
+}
 
-	for _, u := range s.clients {
-		users = append(users, u)
+func (s *Service) closeSession(data json.RawMessage) {
+	var rs events.RevokedSession
+	if err := json.Unmarshal(data, &rs); err != nil {
+		log.Printf("chat: invalid session event, %v", err)
+		return
+	}
+	if rs.SessionID == "" {
+		return
+	}
+
+	s.disconnect(func(c *client) bool { return c.sessionID == rs.SessionID }, "session revoked")
+}
+
+func (s *Service) disconnect(match func(*client) bool, reason string) {
+	var matched []*client
+
+	s.mu.RLock()
+	for _, c := range s.clients {
+		if match(c) {
+			matched = append(matched, c)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, c := range matched {
+		c.close(reason)
+	}
+}
+
+func (s *Service) getActiveUsers() []UserInfo {
+	var users []UserInfo
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.clients {
+		users = append(users, c.user)
 	}
 
 	return users
 }
 
+// clientUser returns a copy of the info of the user on conn.
+func (s *Service) clientUser(conn *websocket.Conn) (UserInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.clients[conn]
+	if !ok {
+		return UserInfo{}, false
+	}
+	return c.user, true
+}
+
+// LoadHistoryMessages returns the chatroom messages before after. The
+// message itself may have been deleted since, paging goes on from where it
+// was. Only a cursor older than the room's oldest message is not found,
+// the history it points into was trimmed.
 func (s *Service) LoadHistoryMessages(ctx context.Context, after string) ([]Message, error) {
+	if !messageIDPattern.MatchString(after) {
+		return nil, ErrInvalidMessageID
+	}
+	first, err := s.repo.FirstMessageID(ctx, ChatroomID)
+	if err != nil {
+		return nil, err
+	}
+	if first != "" && CompareMessageIDs(after, first) < 0 {
+		return nil, ErrMessageNotFound
+	}
+
 	history, err := s.repo.GetHistory(ctx, after, historyCount)
 	if err != nil {
 		return nil, err
 	}
+	s.resolveNames(ctx, history)
 
 	return history, nil
 }
+
+func (s *Service) GetMessage(ctx context.Context, userID, conversation, id string) (*MessageContext, error) {
+	if err := validateConversation(conversation); err != nil {
+		return nil, err
+	}
+	if !messageIDPattern.MatchString(id) {
+		return nil, ErrInvalidMessageID
+	}
+	if !canAccess(userID, conversation) {
+		return nil, ErrForbidden
+	}
+
+	m, err := s.repo.GetMessage(ctx, conversation, id)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := s.repo.GetMessagesBefore(ctx, conversation, id, contextCount)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := s.repo.GetMessagesAfter(ctx, conversation, id, contextCount)
+	if err != nil {
+		return nil, err
+	}
+
+	message := []Message{*m}
+	s.resolveNames(ctx, message, before, after)
+
+	return &MessageContext{
+		Message:   message[0],
+		Before:    before,
+		After:     after,
+		Permalink: Permalink(conversation, id),
+	}, nil
+}
+
+// resolveNames replaces the stored sender names with the senders' current
+// ones, FromName is only a snapshot from when the message was sent.
+func (s *Service) resolveNames(ctx context.Context, lists ...[]Message) {
+	names := make(map[string]string)
+
+	for _, messages := range lists {
+		for i := range messages {
+			m := &messages[i]
+			name, ok := names[m.From]
+			if !ok {
+				if u, err := s.users.GetUserByID(ctx, m.From); err == nil {
+					name = u.Name()
+				}
+				names[m.From] = name
+			}
+			if name != "" {
+				m.FromName = name
+			}
+		}
+	}
+}
+
+func (s *Service) ResolvePermalink(ctx context.Context, userID, link string) (*MessageContext, error) {
+	conversation, id, err := ParsePermalink(link)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetMessage(ctx, userID, conversation, id)
+}
@@ -0,0 +1,271 @@
+package chat
+
+import (
+	"chatter/server/internal/events"
+	"chatter/server/internal/filter"
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SpamAction is what happens to a message that scores as spam.
+type SpamAction string
+
+const (
+	// SpamAllow lets it through, the counters still show what would have
+	// been caught.
+	SpamAllow SpamAction = "allow"
+	// SpamHold keeps it out of the chat until a moderator approves it from
+	// the report queue.
+	SpamHold SpamAction = "hold"
+	// SpamDrop shows it only to the sender.
+	SpamDrop SpamAction = "drop"
+	// SpamMute drops it and mutes the sender.
+	SpamMute SpamAction = "mute"
+)
+
+// Spam rule names, used in verdicts and counters.
+const (
+	spamRuleRepeat     = "repeat"
+	spamRuleBurst      = "burst"
+	spamRuleLinks      = "links"
+	spamRuleMentions   = "mentions"
+	spamRuleNewAccount = "new_account"
+)
+
+var (
+	ErrInvalidSpamAction = errors.New("spam action must be allow, hold, drop or mute")
+	ErrInvalidSpamPolicy = errors.New("spam threshold, limits and windows must be positive, the burst window at most the window")
+	ErrMessageHeld       = errors.New("message is held for review")
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@[\p{L}\p{N}_.-]+`)
+
+func ParseSpamAction(s string) (SpamAction, error) {
+	switch SpamAction(s) {
+	case SpamAllow, SpamHold, SpamDrop, SpamMute:
+		return SpamAction(s), nil
+	}
+	return "", ErrInvalidSpamAction
+}
+
+// SpamPolicy scores each message, a message reaching Threshold gets
+// Action. Repeats, bursts, links and mentions add their score for every
+// one over the limit, a new account adds its score once. Repeats are
+// messages that read the same once case, digits, punctuation and spacing
+// are ignored.
+type SpamPolicy struct {
+	Threshold    int           `json:"threshold"`
+	Action       SpamAction    `json:"action"`
+	MuteDuration time.Duration `json:"muteDuration"`
+
+	// Window is how far back repeats are looked for.
+	Window      time.Duration `json:"window"`
+	RepeatLimit int           `json:"repeatLimit"`
+	RepeatScore int           `json:"repeatScore"`
+
+	BurstWindow time.Duration `json:"burstWindow"`
+	BurstLimit  int           `json:"burstLimit"`
+	BurstScore  int           `json:"burstScore"`
+
+	LinkLimit    int `json:"linkLimit"`
+	LinkScore    int `json:"linkScore"`
+	MentionLimit int `json:"mentionLimit"`
+	MentionScore int `json:"mentionScore"`
+
+	NewAccountAge   time.Duration `json:"newAccountAge"`
+	NewAccountScore int           `json:"newAccountScore"`
+}
+
+var DefaultSpamPolicy = SpamPolicy{
+	Threshold:       6,
+	Action:          SpamHold,
+	MuteDuration:    10 * time.Minute,
+	Window:          2 * time.Minute,
+	RepeatLimit:     2,
+	RepeatScore:     3,
+	BurstWindow:     10 * time.Second,
+	BurstLimit:      5,
+	BurstScore:      2,
+	LinkLimit:       2,
+	LinkScore:       2,
+	MentionLimit:    5,
+	MentionScore:    1,
+	NewAccountAge:   24 * time.Hour,
+	NewAccountScore: 1,
+}
+
+func (p SpamPolicy) Validate() error {
+	if _, err := ParseSpamAction(string(p.Action)); err != nil {
+		return err
+	}
+	if p.Threshold < 1 || p.Window <= 0 || p.BurstWindow <= 0 || p.BurstWindow > p.Window ||
+		p.RepeatLimit < 0 || p.BurstLimit < 0 || p.LinkLimit < 0 || p.MentionLimit < 0 ||
+		(p.Action == SpamMute && p.MuteDuration <= 0) {
+		return ErrInvalidSpamPolicy
+	}
+	return nil
+}
+
+// RecentMessage is a message the sender sent within the spam window.
+type RecentMessage struct {
+	Fingerprint string
+	SentAt      time.Time
+}
+
+// SpamVerdict is how a message scored. Action is empty below the
+// threshold.
+type SpamVerdict struct {
+	Score  int        `json:"score"`
+	Rules  []string   `json:"rules"`
+	Action SpamAction `json:"action,omitempty"`
+}
+
+// SpamStats is the policy in use and how often each rule and action hit
+// since the counters were last reset.
+type SpamStats struct {
+	Policy   SpamPolicy       `json:"policy"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+// SetSpamPolicy replaces DefaultSpamPolicy, the policy must be valid.
+func (s *Service) SetSpamPolicy(p SpamPolicy) {
+	s.spam = p
+}
+
+// checkSpam scores the message against the sender's recent messages and
+// counts the rules that fired. Staff and bots aren't checked.
+func (s *Service) checkSpam(ctx context.Context, sender *user.User, m *Message) (*SpamVerdict, error) {
+	verdict := &SpamVerdict{}
+	if sender != nil && sender.Bot || s.isModerator(ctx, sender, ChatroomID) {
+		return verdict, nil
+	}
+
+	now := time.Now().UTC()
+	fingerprint := spamFingerprint(m.Content)
+	recent, err := s.repo.RecordRecentMessage(ctx, m.From, RecentMessage{Fingerprint: fingerprint, SentAt: now}, s.spam.Window)
+	if err != nil {
+		return nil, fmt.Errorf("chat: failed to load recent messages, %v", err)
+	}
+
+	repeats, burst := 0, 0
+	for _, r := range recent {
+		if r.Fingerprint == fingerprint {
+			repeats++
+		}
+		if now.Sub(r.SentAt) <= s.spam.BurstWindow {
+			burst++
+		}
+	}
+
+	verdict.add(spamRuleRepeat, repeats-s.spam.RepeatLimit, s.spam.RepeatScore)
+	verdict.add(spamRuleBurst, burst-s.spam.BurstLimit, s.spam.BurstScore)
+	verdict.add(spamRuleLinks, filter.CountLinks(m.Content)-s.spam.LinkLimit, s.spam.LinkScore)
+	verdict.add(spamRuleMentions, len(mentionPattern.FindAllStringIndex(m.Content, -1))-s.spam.MentionLimit, s.spam.MentionScore)
+	if sender != nil && now.Sub(sender.CreatedAt) < s.spam.NewAccountAge {
+		verdict.add(spamRuleNewAccount, 1, s.spam.NewAccountScore)
+	}
+
+	counters := []string{"checked"}
+	for _, rule := range verdict.Rules {
+		counters = append(counters, "rule:"+rule)
+	}
+	if verdict.Score >= s.spam.Threshold {
+		verdict.Action = s.spam.Action
+		counters = append(counters, "action:"+string(verdict.Action))
+	}
+	if err := s.repo.IncrSpamCounters(ctx, counters); err != nil {
+		log.Printf("chat: failed to count spam checks, %v", err)
+	}
+
+	return verdict, nil
+}
+
+// add scores a rule that went over its limit by over.
+func (v *SpamVerdict) add(rule string, over, score int) {
+	if over <= 0 || score <= 0 {
+		return
+	}
+	v.Score += over * score
+	v.Rules = append(v.Rules, rule)
+}
+
+// applySpamAction handles a message that reached the threshold. A nil
+// error for a dropped message lets the sender believe it was sent.
+func (s *Service) applySpamAction(ctx context.Context, m *Message, verdict *SpamVerdict) error {
+	reason := fmt.Sprintf("spam score %d: %s", verdict.Score, strings.Join(verdict.Rules, ", "))
+	log.Printf("chat: message of %s scored as spam, %s, %s", m.From, reason, verdict.Action)
+
+	switch verdict.Action {
+	case SpamHold:
+		if err := s.holdMessage(ctx, m, reason); err != nil {
+			return err
+		}
+		return ErrMessageHeld
+	case SpamDrop:
+		// Nothing was stored, so the message has no ID a reply, reaction
+		// or report could refer to.
+		m.ID = ""
+		m.Timestamp = time.Now().UTC()
+		return s.publish(ctx, events.ShadowMessage, m.From, m)
+	case SpamMute:
+		if s.moderator == nil {
+			return fmt.Errorf("chat: no moderator to mute with")
+		}
+		sanction, err := s.moderator.AutoSanction(ctx, user.SanctionRequest{
+			Kind:     user.SanctionMute,
+			UserID:   m.From,
+			Reason:   reason,
+			Duration: s.spam.MuteDuration,
+		})
+		if err != nil {
+			return err
+		}
+		return &user.SanctionError{Sanction: sanction}
+	}
+
+	return nil
+}
+
+// GetSpamStats returns the policy and its counters.
+func (s *Service) GetSpamStats(ctx context.Context) (*SpamStats, error) {
+	counters, err := s.repo.GetSpamCounters(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SpamStats{Policy: s.spam, Counters: counters}, nil
+}
+
+// ResetSpamCounters starts counting again, after the policy was tuned.
+func (s *Service) ResetSpamCounters(ctx context.Context) error {
+	return s.repo.ResetSpamCounters(ctx)
+}
+
+// spamFingerprint keeps only the letters of the text, so copies with a
+// changed number or punctuation still match. Text without letters is
+// compared as it is.
+func spamFingerprint(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) {
+			b.WriteRune(r)
+		}
+	}
+
+	key := b.String()
+	if key == "" {
+		key = strings.Join(strings.Fields(text), " ")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%x", h.Sum64())
+}
@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSpamRepo keeps the recent messages and counters the spam check
+// uses, the rest of Repository is left unimplemented.
+type fakeSpamRepo struct {
+	Repository
+	recent   []RecentMessage
+	counters map[string]int
+}
+
+func (r *fakeSpamRepo) RecordRecentMessage(ctx context.Context, userID string, m RecentMessage, window time.Duration) ([]RecentMessage, error) {
+	var recent []RecentMessage
+	for _, prev := range r.recent {
+		if m.SentAt.Sub(prev.SentAt) <= window {
+			recent = append(recent, prev)
+		}
+	}
+	r.recent = append(recent, m)
+	return recent, nil
+}
+
+func (r *fakeSpamRepo) IncrSpamCounters(ctx context.Context, counters []string) error {
+	for _, counter := range counters {
+		r.counters[counter]++
+	}
+	return nil
+}
+
+type fakeRoomRoles struct {
+	UserStore
+	roles map[string]user.Role
+}
+
+func (u *fakeRoomRoles) GetRoomRoles(ctx context.Context, userID string) (map[string]user.Role, error) {
+	return u.roles, nil
+}
+
+// sent is a message the sender sent ago before the one checked.
+type sent struct {
+	text string
+	ago  time.Duration
+}
+
+func repeat(text string, n int, ago time.Duration) []sent {
+	messages := make([]sent, n)
+	for i := range messages {
+		messages[i] = sent{text: text, ago: ago}
+	}
+	return messages
+}
+
+func TestCheckSpam(t *testing.T) {
+	member := &user.User{ID: "u1", CreatedAt: time.Now().Add(-30 * 24 * time.Hour)}
+	newcomer := &user.User{ID: "u1", CreatedAt: time.Now().Add(-time.Hour)}
+	moderator := &user.User{ID: "u1", CreatedAt: member.CreatedAt, Role: user.RoleModerator}
+	bot := &user.User{ID: "u1", CreatedAt: time.Now(), Bot: true}
+
+	var distinct []sent
+	for i := range 7 {
+		distinct = append(distinct, sent{text: strings.Repeat("x", i+1), ago: time.Second})
+	}
+
+	tests := []struct {
+		name      string
+		sender    *user.User
+		roomRoles map[string]user.Role
+		policy    *SpamPolicy
+		history   []sent
+		text      string
+		score     int
+		rules     []string
+		action    SpamAction
+	}{
+		{name: "plain message", sender: member, text: "hello"},
+		{name: "new account", sender: newcomer, text: "hello", score: 1, rules: []string{spamRuleNewAccount}},
+		{name: "unknown sender", sender: nil, text: "hello"},
+		{
+			name: "repeats up to the limit", sender: member,
+			history: repeat("buy now", 2, time.Minute), text: "buy now",
+		},
+		{
+			name: "one repeat over the limit", sender: member,
+			history: repeat("buy now", 3, time.Minute), text: "buy now",
+			score: 3, rules: []string{spamRuleRepeat},
+		},
+		{
+			name: "repeats reach the threshold", sender: member,
+			history: repeat("buy now", 4, time.Minute), text: "buy now",
+			score: 6, rules: []string{spamRuleRepeat}, action: SpamHold,
+		},
+		{
+			name: "repeats ignore case, digits and punctuation", sender: member,
+			history: repeat("Buy now 1!!", 4, time.Minute), text: "buy NOW 2",
+			score: 6, rules: []string{spamRuleRepeat}, action: SpamHold,
+		},
+		{
+			name: "repeats outside the window", sender: member,
+			history: repeat("buy now", 4, 5*time.Minute), text: "buy now",
+		},
+		{
+			name: "burst", sender: member,
+			history: distinct, text: "hello",
+			score: 4, rules: []string{spamRuleBurst},
+		},
+		{
+			name: "messages outside the burst window", sender: member,
+			history: append(repeat("a", 4, 30*time.Second), repeat("b", 4, 30*time.Second)...), text: "hello",
+		},
+		{
+			name: "links over the limit", sender: member,
+			text: "https://a.example https://b.example www.c.example", score: 2, rules: []string{spamRuleLinks},
+		},
+		{
+			name: "mentions over the limit", sender: member,
+			text: "@a @b @c @d @e @f @g", score: 2, rules: []string{spamRuleMentions},
+		},
+		{
+			name: "email addresses aren't mentions", sender: member,
+			text: "a@b c@d e@f g@h i@j k@l m@n",
+		},
+		{
+			name: "rules add up", sender: newcomer,
+			history: repeat("see https://a.example https://b.example https://c.example", 3, time.Second),
+			text:    "see https://a.example https://b.example https://c.example",
+			score:   6, rules: []string{spamRuleRepeat, spamRuleLinks, spamRuleNewAccount}, action: SpamHold,
+		},
+		{
+			name: "policy action", sender: member,
+			policy:  &SpamPolicy{Threshold: 3, Action: SpamMute, MuteDuration: time.Minute, Window: time.Minute, BurstWindow: time.Second, RepeatLimit: 0, RepeatScore: 3},
+			history: repeat("hi", 1, time.Second), text: "hi",
+			score: 3, rules: []string{spamRuleRepeat}, action: SpamMute,
+		},
+		{
+			name: "moderators aren't checked", sender: moderator,
+			history: repeat("buy now", 4, time.Minute), text: "buy now",
+		},
+		{
+			name: "room moderators aren't checked", sender: member, roomRoles: map[string]user.Role{ChatroomID: user.RoleModerator},
+			history: repeat("buy now", 4, time.Minute), text: "buy now",
+		},
+		{
+			name: "bots aren't checked", sender: bot,
+			history: repeat("buy now", 4, time.Minute), text: "buy now",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now().UTC()
+			repo := &fakeSpamRepo{counters: make(map[string]int)}
+			for _, m := range tt.history {
+				repo.recent = append(repo.recent, RecentMessage{Fingerprint: spamFingerprint(m.text), SentAt: now.Add(-m.ago)})
+			}
+
+			s := NewService(repo, &fakeRoomRoles{roles: tt.roomRoles})
+			if tt.policy != nil {
+				s.SetSpamPolicy(*tt.policy)
+			}
+
+			verdict, err := s.checkSpam(context.Background(), tt.sender, &Message{From: "u1", Content: tt.text})
+			if err != nil {
+				t.Fatalf("checkSpam: %v", err)
+			}
+
+			if verdict.Score != tt.score || verdict.Action != tt.action || !reflect.DeepEqual(verdict.Rules, tt.rules) {
+				t.Errorf("checkSpam(%q) = %+v, want score %d, rules %v, action %q", tt.text, *verdict, tt.score, tt.rules, tt.action)
+			}
+
+			checked := 1
+			if tt.sender != nil && (tt.sender.Bot || tt.sender.Role == user.RoleModerator || tt.roomRoles != nil) {
+				checked = 0
+			}
+			if repo.counters["checked"] != checked {
+				t.Errorf("checked counter = %d, want %d", repo.counters["checked"], checked)
+			}
+			for _, rule := range tt.rules {
+				if repo.counters["rule:"+rule] != 1 {
+					t.Errorf("rule:%s counter = %d, want 1", rule, repo.counters["rule:"+rule])
+				}
+			}
+			if tt.action != "" && repo.counters["action:"+string(tt.action)] != 1 {
+				t.Errorf("action:%s counter = %d, want 1", tt.action, repo.counters["action:"+string(tt.action)])
+			}
+		})
+	}
+}
+
+func TestSpamFingerprint(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"Buy now!", "buy now", true},
+		{"buy now 1", "buy now 2", true},
+		{"b u y  n o w", "buynow", true},
+		{"Купи сейчас", "купи СЕЙЧАС!!", true},
+		{"buy now", "buy later", false},
+		{"123", "123", true},
+		{"123", "456", false},
+		{"1  2 3", "1 2 3", true},
+	}
+
+	for _, tt := range tests {
+		a, b := spamFingerprint(tt.a), spamFingerprint(tt.b)
+		if (a == b) != tt.same {
+			t.Errorf("spamFingerprint(%q) == spamFingerprint(%q) is %v, want %v", tt.a, tt.b, a == b, tt.same)
+		}
+	}
+}
+
+func TestSpamPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *SpamPolicy)
+		want   error
+	}{
+		{"default", func(p *SpamPolicy) {}, nil},
+		{"unknown action", func(p *SpamPolicy) { p.Action = "ban" }, ErrInvalidSpamAction},
+		{"zero threshold", func(p *SpamPolicy) { p.Threshold = 0 }, ErrInvalidSpamPolicy},
+		{"no window", func(p *SpamPolicy) { p.Window = 0 }, ErrInvalidSpamPolicy},
+		{"burst window longer than the window", func(p *SpamPolicy) { p.BurstWindow = p.Window + time.Second }, ErrInvalidSpamPolicy},
+		{"negative limit", func(p *SpamPolicy) { p.LinkLimit = -1 }, ErrInvalidSpamPolicy},
+		{"mute without a duration", func(p *SpamPolicy) { p.Action, p.MuteDuration = SpamMute, 0 }, ErrInvalidSpamPolicy},
+		{"hold without a mute duration", func(p *SpamPolicy) { p.MuteDuration = 0 }, nil},
+	}
+
+	for _, tt := range tests {
+		p := DefaultSpamPolicy
+		tt.change(&p)
+		if err := p.Validate(); err != tt.want {
+			t.Errorf("%s: Validate() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
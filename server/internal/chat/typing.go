@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// typingThrottle is the minimum gap between two typing broadcasts for
+	// the same user and conversation.
+	typingThrottle = 3 * time.Second
+	// typingTimeout stops an indicator that hasn't been refreshed, which
+	// also covers clients that disconnect without sending typing_stop.
+	typingTimeout = 6 * time.Second
+)
+
+type TypingMessage struct {
+	Conversation string     `json:"conversation"`
+	User         UserInfo   `json:"user"`
+	Typing       bool       `json:"typing"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+}
+
+type typingRequest struct {
+	Conversation string `json:"conversation"`
+}
+
+type typingKey struct {
+	conversation string
+	userID       string
+}
+
+type typingState struct {
+	conn     *websocket.Conn
+	user     UserInfo
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+func (s *Service) startTyping(conn *websocket.Conn, u UserInfo, conversation string) error {
+	if err := validateConversation(conversation); err != nil {
+		return err
+	}
+	if !canAccess(u.ID, conversation) {
+		return ErrForbidden
+	}
+
+	key := typingKey{conversation: conversation, userID: u.ID}
+	now := time.Now()
+
+	s.typingMu.Lock()
+	st, ok := s.typing[key]
+	if ok {
+		st.conn = conn
+		st.timer.Reset(typingTimeout)
+		if now.Sub(st.lastSent) < typingThrottle {
+			s.typingMu.Unlock()
+			return nil
+		}
+	} else {
+		st = &typingState{conn: conn, user: u}
+		st.timer = time.AfterFunc(typingTimeout, func() {
+			s.stopTyping(u.ID, conversation)
+		})
+		s.typing[key] = st
+	}
+	st.lastSent = now
+	s.typingMu.Unlock()
+
+	expiresAt := now.Add(typingTimeout).UTC()
+	s.publishTyping(TypingMessage{
+		Conversation: conversation,
+		User:         u,
+		Typing:       true,
+		ExpiresAt:    &expiresAt,
+	})
+
+	return nil
+}
+
+func (s *Service) stopTyping(userID, conversation string) {
+	key := typingKey{conversation: conversation, userID: userID}
+
+	s.typingMu.Lock()
+	st, ok := s.typing[key]
+	if ok {
+		st.timer.Stop()
+		delete(s.typing, key)
+	}
+	s.typingMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	s.publishTyping(TypingMessage{
+		Conversation: conversation,
+		User:         st.user,
+		Typing:       false,
+	})
+}
+
+// clearTyping stops every indicator started from conn.
+func (s *Service) clearTyping(conn *websocket.Conn) {
+	var stopped []typingKey
+	var states []*typingState
+
+	s.typingMu.Lock()
+	for key, st := range s.typing {
+		if st.conn == conn {
+			st.timer.Stop()
+			delete(s.typing, key)
+			stopped = append(stopped, key)
+			states = append(states, st)
+		}
+	}
+	s.typingMu.Unlock()
+
+	for i, key := range stopped {
+		s.publishTyping(TypingMessage{
+			Conversation: key.conversation,
+			User:         states[i].user,
+			Typing:       false,
+		})
+	}
+}
+
+func (s *Service) publishTyping(t TypingMessage) {
+	if err := s.publish(context.Background(), events.Typing, "", t); err != nil {
+		log.Printf("chat: failed to publish typing event, %v", err)
+	}
+}
+
+// deliverTyping sends a typing event to the other participants of its
+// conversation.
+func (s *Service) deliverTyping(data json.RawMessage) {
+	var t TypingMessage
+	if err := json.Unmarshal(data, &t); err != nil {
+		log.Printf("chat: invalid typing event, %v", err)
+		return
+	}
+
+	s.send(WSMessage{Type: typeTyping, Data: t}, func(c *client) bool {
+		return c.user.ID != t.User.ID && canAccess(c.user.ID, t.Conversation)
+	})
+}
@@ -0,0 +1,243 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// botsKey lists the IDs of bot accounts.
+const botsKey = "bots"
+
+// CreateAccessToken stores the token under its ID and indexes it by hash.
+// Tokens with an end expire from redis by themselves.
+func (r *UserRepo) CreateAccessToken(ctx context.Context, t *user.AccessToken, hash string) error {
+	fields := accessTokenToMap(t)
+	fields["hash"] = hash
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, accessTokenKey(t.ID), fields)
+		p.Set(ctx, accessTokenHashKey(hash), t.ID, 0)
+		if !t.ExpiresAt.IsZero() {
+			p.ExpireAt(ctx, accessTokenKey(t.ID), t.ExpiresAt)
+			p.ExpireAt(ctx, accessTokenHashKey(hash), t.ExpiresAt)
+		}
+		p.SAdd(ctx, userAccessTokensKey(t.UserID), t.ID)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) GetAccessTokenByHash(ctx context.Context, hash string) (*user.AccessToken, error) {
+	id, err := r.db.Get(ctx, accessTokenHashKey(hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, user.ErrAccessTokenNotFound
+		}
+		return nil, err
+	}
+
+	m, err := r.db.HGetAll(ctx, accessTokenKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, user.ErrAccessTokenNotFound
+	}
+
+	return redisMapToAccessToken(m), nil
+}
+
+// ListAccessTokens returns the user's tokens newest first and forgets the
+// ones that expired.
+func (r *UserRepo) ListAccessTokens(ctx context.Context, userID string) ([]user.AccessToken, error) {
+	setKey := userAccessTokensKey(userID)
+	ids, err := r.db.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.HGetAll(ctx, accessTokenKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []user.AccessToken{}
+	var expired []any
+	for i, cmd := range cmds {
+		m := cmd.Val()
+		if len(m) == 0 {
+			expired = append(expired, ids[i])
+			continue
+		}
+		tokens = append(tokens, *redisMapToAccessToken(m))
+	}
+
+	if len(expired) > 0 {
+		if err := r.db.SRem(ctx, setKey, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(tokens, func(a, b user.AccessToken) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return tokens, nil
+}
+
+// DeleteAccessToken removes one of the user's tokens, tokens of other
+// users are not found.
+func (r *UserRepo) DeleteAccessToken(ctx context.Context, userID, id string) error {
+	key := accessTokenKey(id)
+	m, err := r.db.HMGet(ctx, key, "user_id", "hash").Result()
+	if err != nil {
+		return err
+	}
+	owner, _ := m[0].(string)
+	hash, _ := m[1].(string)
+	if owner != userID {
+		return user.ErrAccessTokenNotFound
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key, accessTokenHashKey(hash))
+		p.SRem(ctx, userAccessTokensKey(userID), id)
+		return nil
+	})
+
+	return err
+}
+
+// TouchAccessToken never recreates a token that was revoked in the
+// meantime.
+func (r *UserRepo) TouchAccessToken(ctx context.Context, id string, at time.Time, ip string) error {
+	key := accessTokenKey(id)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return user.ErrAccessTokenNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, "last_used_at", at.Format(time.RFC3339), "last_used_ip", ip)
+			return nil
+		})
+
+		return err
+	}, key)
+}
+
+func (r *UserRepo) ListBots(ctx context.Context) ([]user.User, error) {
+	ids, err := r.db.SMembers(ctx, botsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	bots := []user.User{}
+	for _, id := range ids {
+		u, err := r.GetUserByID(ctx, id)
+		if err == user.ErrUserNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, *u)
+	}
+
+	slices.SortFunc(bots, func(a, b user.User) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+
+	return bots, nil
+}
+
+// deleteAccessTokens removes every token of a deleted account.
+func (r *UserRepo) deleteAccessTokens(ctx context.Context, userID string) error {
+	setKey := userAccessTokensKey(userID)
+	ids, err := r.db.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := r.DeleteAccessToken(ctx, userID, id); err != nil && err != user.ErrAccessTokenNotFound {
+			return err
+		}
+	}
+
+	return r.db.Del(ctx, setKey).Err()
+}
+
+func accessTokenToMap(t *user.AccessToken) map[string]any {
+	scopes := make([]string, len(t.Scopes))
+	for i, s := range t.Scopes {
+		scopes[i] = string(s)
+	}
+
+	m := map[string]any{
+		"id":         t.ID,
+		"user_id":    t.UserID,
+		"name":       t.Name,
+		"scopes":     strings.Join(scopes, ","),
+		"hint":       t.Hint,
+		"created_by": t.CreatedBy,
+		"created_at": t.CreatedAt.Format(time.RFC3339),
+	}
+	if !t.ExpiresAt.IsZero() {
+		m["expires_at"] = t.ExpiresAt.Format(time.RFC3339)
+	}
+
+	return m
+}
+
+func redisMapToAccessToken(m map[string]string) *user.AccessToken {
+	t := user.AccessToken{
+		ID:         m["id"],
+		UserID:     m["user_id"],
+		Name:       m["name"],
+		Scopes:     []user.Scope{},
+		Hint:       m["hint"],
+		CreatedBy:  m["created_by"],
+		LastUsedIP: m["last_used_ip"],
+	}
+	for _, s := range strings.Split(m["scopes"], ",") {
+		if s != "" {
+			t.Scopes = append(t.Scopes, user.Scope(s))
+		}
+	}
+	t.CreatedAt, _ = time.Parse(time.RFC3339, m["created_at"])
+	t.ExpiresAt, _ = time.Parse(time.RFC3339, m["expires_at"])
+	t.LastUsedAt, _ = time.Parse(time.RFC3339, m["last_used_at"])
+
+	return &t
+}
+
+func accessTokenKey(id string) string {
+	return fmt.Sprintf("access_token:%s", id)
+}
+
+func accessTokenHashKey(hash string) string {
+	return fmt.Sprintf("access_token_hash:%s", hash)
+}
+
+func userAccessTokensKey(userID string) string {
+	return fmt.Sprintf("user_access_tokens:%s", userID)
+}
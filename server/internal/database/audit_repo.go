@@ -0,0 +1,85 @@
+package database
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// auditLogKey is never trimmed, the audit log keeps everything.
+const auditLogKey = "audit_log"
+
+type AuditRepo struct {
+	db *redis.Client
+}
+
+func NewAuditRepo(db *redis.Client) *AuditRepo {
+	return &AuditRepo{db: db}
+}
+
+func (r *AuditRepo) AppendAudit(ctx context.Context, e *audit.Entry) error {
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	id, err := r.db.XAdd(ctx, &redis.XAddArgs{
+		Stream: auditLogKey,
+		Values: map[string]any{
+			"time":      e.Time.Format(time.RFC3339Nano),
+			"action":    e.Action,
+			"actor_id":  e.ActorID,
+			"target_id": e.TargetID,
+			"ip":        e.IP,
+			"outcome":   string(e.Outcome),
+			"details":   details,
+		},
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	e.ID = id
+	return nil
+}
+
+// ReadAudit goes by the entry IDs, which are the milliseconds the entries
+// were added at.
+func (r *AuditRepo) ReadAudit(ctx context.Context, before string, since, until time.Time, count int) ([]audit.Entry, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	} else if !until.IsZero() {
+		end = strconv.FormatInt(until.UnixMilli(), 10)
+	}
+	start := "-"
+	if !since.IsZero() {
+		start = strconv.FormatInt(since.UnixMilli(), 10)
+	}
+
+	messages, err := r.db.XRevRangeN(ctx, auditLogKey, end, start, int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]audit.Entry, 0, len(messages))
+	for _, m := range messages {
+		e := audit.Entry{
+			ID:       m.ID,
+			Action:   stringValue(m.Values, "action"),
+			ActorID:  stringValue(m.Values, "actor_id"),
+			TargetID: stringValue(m.Values, "target_id"),
+			IP:       stringValue(m.Values, "ip"),
+			Outcome:  audit.Outcome(stringValue(m.Values, "outcome")),
+		}
+		e.Time, _ = time.Parse(time.RFC3339Nano, stringValue(m.Values, "time"))
+		json.Unmarshal([]byte(stringValue(m.Values, "details")), &e.Details)
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
@@ -2,9 +2,12 @@ package database
 
 import (
 	"chatter/server/internal/chat"
+	"chatter/server/internal/events"
+	"chatter/server/internal/user"
 	"context"
 	"fmt"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -22,12 +25,16 @@ const chatroomKey = "chatroom"
 
 func (r *ChatRepo) AddChatroomMessage(ctx context.Context, m *chat.Message) error {
 	m.Timestamp = time.Now().UTC()
-	_, err := r.db.XAdd(ctx, &redis.XAddArgs{
+	id, err := r.db.XAdd(ctx, &redis.XAddArgs{
 		Stream: chatroomKey,
 		Values: messageToMap(m),
 	}).Result()
+	if err != nil {
+		return err
+	}
 
-	return err
+	m.ID = id
+	return nil
 }
 
 func (r *ChatRepo) GetChatroomMessages(ctx context.Context, after string) ([]chat.Message, string, error) {
@@ -72,6 +79,61 @@ func (r *ChatRepo) GetHistory(ctx context.Context, lastID string, count int) ([]
 	return streamsToMessages([]redis.XStream{{Messages: stream}}), nil
 }
 
+func (r *ChatRepo) GetMessage(ctx context.Context, conversation, id string) (*chat.Message, error) {
+	stream, err := r.db.XRangeN(ctx, streamKey(conversation), id, id, 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(stream) == 0 {
+		return nil, chat.ErrMessageNotFound
+	}
+
+	messages := streamsToMessages([]redis.XStream{{Messages: stream}})
+
+	return &messages[0], nil
+}
+
+// FirstMessageID returns the oldest message still in the conversation, or
+// "" when there is none.
+func (r *ChatRepo) FirstMessageID(ctx context.Context, conversation string) (string, error) {
+	stream, err := r.db.XRangeN(ctx, streamKey(conversation), "-", "+", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(stream) == 0 {
+		return "", nil
+	}
+
+	return stream[0].ID, nil
+}
+
+func (r *ChatRepo) GetMessagesBefore(ctx context.Context, conversation, id string, count int) ([]chat.Message, error) {
+	stream, err := r.db.XRevRangeN(ctx, streamKey(conversation), "("+id, "-", int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(stream)
+
+	return streamsToMessages([]redis.XStream{{Messages: stream}}), nil
+}
+
+func (r *ChatRepo) GetMessagesAfter(ctx context.Context, conversation, id string, count int) ([]chat.Message, error) {
+	stream, err := r.db.XRangeN(ctx, streamKey(conversation), "("+id, "+", int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return streamsToMessages([]redis.XStream{{Messages: stream}}), nil
+}
+
+func streamKey(conversation string) string {
+	if user1, user2, ok := chat.Participants(conversation); ok {
+		return sortedKey(user1, user2)
+	}
+	return chatroomKey
+}
+
 func sortedKey(user1, user2 string) string {
 	if user1 < user2 {
 		return fmt.Sprintf("%s:%s", user1, user2)
@@ -117,3 +179,287 @@ func streamsToMessages(streams []redis.XStream) []chat.Message {
 
 	return messages
 }
+
+// SetReadMarker moves the user's read marker forward and returns the stored
+// marker, which stays put if id is older than it.
+func (r *ChatRepo) SetReadMarker(ctx context.Context, userID, conversation, id string) (string, error) {
+	userKey := fmt.Sprintf("read_markers:%s", userID)
+	conversationKey := fmt.Sprintf("read_receipts:%s", conversation)
+
+	current := id
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		stored, err := tx.HGet(ctx, userKey, conversation).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if stored != "" && chat.CompareMessageIDs(stored, id) >= 0 {
+			current = stored
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, userKey, conversation, id)
+			p.HSet(ctx, conversationKey, userID, id)
+			return nil
+		})
+
+		return err
+	}, userKey)
+
+	return current, err
+}
+
+func (r *ChatRepo) GetReadMarkers(ctx context.Context, userID string) (map[string]string, error) {
+	return r.db.HGetAll(ctx, fmt.Sprintf("read_markers:%s", userID)).Result()
+}
+
+func (r *ChatRepo) GetConversationReadMarkers(ctx context.Context, conversation string) (map[string]string, error) {
+	return r.db.HGetAll(ctx, fmt.Sprintf("read_receipts:%s", conversation)).Result()
+}
+
+func (r *ChatRepo) CountMessagesAfter(ctx context.Context, conversation, id, excludeFrom string, limit int) (int, error) {
+	start := "-"
+	if id != "" {
+		start = "(" + id
+	}
+
+	stream, err := r.db.XRangeN(ctx, streamKey(conversation), start, "+", int64(limit)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range stream {
+		if entry.Values["from"] != excludeFrom {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (r *ChatRepo) PublishEvent(ctx context.Context, e events.Event) error {
+	return publishEvent(ctx, r.db, e)
+}
+
+func (r *ChatRepo) SubscribeEvents(ctx context.Context) <-chan events.Event {
+	return subscribeEvents(ctx, r.db)
+}
+
+// UserConversations finds the direct conversations the user is part of by
+// their stream keys.
+func (r *ChatRepo) UserConversations(ctx context.Context, userID string) ([]string, error) {
+	seen := make(map[string]bool)
+	var conversations []string
+
+	for _, pattern := range []string{userID + ":*", "*:" + userID} {
+		iter := r.db.ScanType(ctx, 0, pattern, 100, "stream").Iterator()
+		for iter.Next(ctx) {
+			user1, user2, ok := strings.Cut(iter.Val(), ":")
+			// Streams with more parts are copies being rewritten.
+			if !ok || strings.Contains(user2, ":") || (user1 != userID && user2 != userID) {
+				continue
+			}
+			conversation := chat.DirectConversationID(user1, user2)
+			if !seen[conversation] {
+				seen[conversation] = true
+				conversations = append(conversations, conversation)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return conversations, nil
+}
+
+func (r *ChatRepo) DeleteMessages(ctx context.Context, conversation string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return r.db.XDel(ctx, streamKey(conversation), ids...).Err()
+}
+
+// rewriteLockTime is how long a job keeps a conversation to itself between
+// two batches of a rewrite.
+const rewriteLockTime = 5 * time.Minute
+
+// RewriteMessages copies the next count messages after cursor into a new
+// stream of the job, changing those rewrite returns true for, and returns
+// the cursor to continue from. Stream entries can't be edited in place,
+// once everything is copied the new stream replaces the old one
+// atomically. One job at a time rewrites a conversation, the others get
+// user.ErrErasureLocked until it is done.
+func (r *ChatRepo) RewriteMessages(ctx context.Context, conversation, jobID, cursor string, count int, rewrite func(*chat.Message) bool) (string, bool, int, error) {
+	key := streamKey(conversation)
+	tmpKey := rewriteKey(conversation, jobID)
+	lockKey := rewriteLockKey(conversation)
+
+	acquired, err := r.lockRewrite(ctx, lockKey, jobID)
+	if err != nil {
+		return cursor, false, 0, err
+	}
+	// Without the lock all along, another job may have swapped in its copy
+	// since, ours is stale.
+	if acquired {
+		cursor = ""
+	}
+
+	cursor, err = r.resumeRewrite(ctx, tmpKey, cursor)
+	if err != nil {
+		return cursor, false, 0, err
+	}
+
+	batch, err := r.db.XRangeN(ctx, key, "("+cursor, "+", int64(count)).Result()
+	if err != nil {
+		return cursor, false, 0, err
+	}
+
+	if len(batch) == count {
+		changed, err := r.copyMessages(ctx, r.db, tmpKey, batch, rewrite)
+		if err != nil {
+			return cursor, false, 0, err
+		}
+		return batch[len(batch)-1].ID, false, changed, nil
+	}
+
+	// The rest is copied and swapped in one transaction, so nothing sent
+	// in the meantime gets lost.
+	changed := 0
+	err = r.db.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ctx, lockKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if owner != jobID {
+			return user.ErrErasureLocked
+		}
+
+		rest, err := tx.XRange(ctx, key, "("+cursor, "+").Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			changed, err = r.copyMessages(ctx, p, tmpKey, rest, rewrite)
+			if err != nil {
+				return err
+			}
+			if cursor == "0-0" && len(rest) == 0 {
+				// Nothing to copy, the stream is empty or gone.
+				p.Del(ctx, tmpKey)
+			} else {
+				p.Rename(ctx, tmpKey, key)
+			}
+			p.Del(ctx, lockKey)
+			return nil
+		})
+
+		return err
+	}, key, lockKey)
+	if err != nil {
+		return cursor, false, 0, err
+	}
+
+	return "", true, changed, nil
+}
+
+// lockRewrite takes or extends the job's hold on the conversation and
+// reports whether the job had to take it anew.
+func (r *ChatRepo) lockRewrite(ctx context.Context, lockKey, jobID string) (bool, error) {
+	acquired := false
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ctx, lockKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil && owner != jobID {
+			return user.ErrErasureLocked
+		}
+		acquired = err == redis.Nil
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, lockKey, jobID, rewriteLockTime)
+			return nil
+		})
+		return err
+	}, lockKey)
+
+	return acquired, err
+}
+
+// resumeRewrite brings the job's copy back to cursor, dropping what was
+// copied after the last saved cursor. Without a cursor it starts over.
+func (r *ChatRepo) resumeRewrite(ctx context.Context, tmpKey, cursor string) (string, error) {
+	if cursor != "" {
+		extra, err := r.db.XRange(ctx, tmpKey, "("+cursor, "+").Result()
+		if err != nil {
+			return cursor, err
+		}
+		if len(extra) > 0 {
+			ids := make([]string, len(extra))
+			for i, m := range extra {
+				ids[i] = m.ID
+			}
+			if err := r.db.XDel(ctx, tmpKey, ids...).Err(); err != nil {
+				return cursor, err
+			}
+		}
+
+		n, err := r.db.XLen(ctx, tmpKey).Result()
+		if err != nil || n > 0 {
+			return cursor, err
+		}
+	}
+
+	return "0-0", r.db.Del(ctx, tmpKey).Err()
+}
+
+func rewriteKey(conversation, jobID string) string {
+	return fmt.Sprintf("%s:rewrite:%s", streamKey(conversation), jobID)
+}
+
+func rewriteLockKey(conversation string) string {
+	return fmt.Sprintf("rewrite_lock:%s", streamKey(conversation))
+}
+
+func (r *ChatRepo) copyMessages(ctx context.Context, c redis.Cmdable, key string, entries []redis.XMessage, rewrite func(*chat.Message) bool) (int, error) {
+	changed := 0
+	for _, m := range streamsToMessages([]redis.XStream{{Messages: entries}}) {
+		if rewrite(&m) {
+			changed++
+		}
+		err := c.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			ID:     m.ID,
+			Values: messageToMap(&m),
+		}).Err()
+		if err != nil {
+			return changed, err
+		}
+	}
+
+	return changed, nil
+}
+
+// DeleteReadMarkers removes the user's read markers and their read receipts
+// in every conversation.
+func (r *ChatRepo) DeleteReadMarkers(ctx context.Context, userID string) error {
+	userKey := fmt.Sprintf("read_markers:%s", userID)
+
+	conversations, err := r.db.HKeys(ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, conversation := range conversations {
+			p.HDel(ctx, fmt.Sprintf("read_receipts:%s", conversation), userID)
+		}
+		p.Del(ctx, userKey)
+		return nil
+	})
+
+	return err
+}
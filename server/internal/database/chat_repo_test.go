@@ -0,0 +1,213 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestChatRepo(t *testing.T) (*ChatRepo, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	db, err := NewClient(context.Background(), mr.Addr())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewChatRepo(db), mr
+}
+
+// anonymize rewrites the messages of userID the way an erasure does.
+func anonymize(userID string) func(*chat.Message) bool {
+	return func(m *chat.Message) bool {
+		if m.From != userID {
+			return false
+		}
+		m.From = chat.DeletedUserID
+		return true
+	}
+}
+
+type rewriteJob struct {
+	id, userID, cursor string
+	done               bool
+	changed            int
+}
+
+// step rewrites one batch of the chatroom for the job.
+func (j *rewriteJob) step(t *testing.T, r *ChatRepo) error {
+	t.Helper()
+
+	cursor, done, changed, err := r.RewriteMessages(context.Background(), chat.ChatroomID, j.id, j.cursor, 10, anonymize(j.userID))
+	if err != nil {
+		return err
+	}
+	j.cursor, j.done = cursor, done
+	j.changed += changed
+	return nil
+}
+
+func (j *rewriteJob) finish(t *testing.T, r *ChatRepo) {
+	t.Helper()
+
+	for !j.done {
+		if err := j.step(t, r); err != nil {
+			t.Fatalf("job %s: %v", j.id, err)
+		}
+	}
+}
+
+func addChatroomMessages(t *testing.T, r *ChatRepo, senders ...string) {
+	t.Helper()
+
+	for i := 0; i < 25; i++ {
+		for _, from := range senders {
+			if err := r.AddChatroomMessage(context.Background(), &chat.Message{From: from, FromName: from, Content: "hi"}); err != nil {
+				t.Fatalf("AddChatroomMessage: %v", err)
+			}
+		}
+	}
+}
+
+func chatroomSenders(t *testing.T, r *ChatRepo) map[string]int {
+	t.Helper()
+
+	messages, err := r.GetMessagesAfter(context.Background(), chat.ChatroomID, "0-0", 1000)
+	if err != nil {
+		t.Fatalf("GetMessagesAfter: %v", err)
+	}
+
+	senders := make(map[string]int)
+	for _, m := range messages {
+		senders[m.From]++
+	}
+	return senders
+}
+
+func TestRewriteMessagesInterleavedJobs(t *testing.T) {
+	r, _ := newTestChatRepo(t)
+	addChatroomMessages(t, r, "alice", "bob", "carol")
+
+	a := &rewriteJob{id: "job-a", userID: "alice"}
+	b := &rewriteJob{id: "job-b", userID: "bob"}
+
+	if err := a.step(t, r); err != nil {
+		t.Fatalf("job a: %v", err)
+	}
+	if err := b.step(t, r); !errors.Is(err, user.ErrErasureLocked) {
+		t.Fatalf("job b while a rewrites = %v, want %v", err, user.ErrErasureLocked)
+	}
+
+	a.finish(t, r)
+	b.finish(t, r)
+
+	senders := chatroomSenders(t, r)
+	want := map[string]int{chat.DeletedUserID: 50, "carol": 25}
+	if len(senders) != len(want) || senders[chat.DeletedUserID] != want[chat.DeletedUserID] || senders["carol"] != want["carol"] {
+		t.Errorf("senders after both jobs = %v, want %v", senders, want)
+	}
+	if a.changed != 25 || b.changed != 25 {
+		t.Errorf("changed = %d and %d, want 25 each", a.changed, b.changed)
+	}
+}
+
+func TestRewriteMessagesAfterLostLock(t *testing.T) {
+	r, mr := newTestChatRepo(t)
+	addChatroomMessages(t, r, "alice", "bob")
+
+	a := &rewriteJob{id: "job-a", userID: "alice"}
+	if err := a.step(t, r); err != nil {
+		t.Fatalf("job a: %v", err)
+	}
+
+	// Job a stalls, its hold runs out and job b rewrites the chatroom.
+	mr.FastForward(rewriteLockTime + 1)
+	b := &rewriteJob{id: "job-b", userID: "bob"}
+	b.finish(t, r)
+
+	// Job a starts over instead of swapping in its stale copy.
+	a.finish(t, r)
+
+	if senders := chatroomSenders(t, r); len(senders) != 1 || senders[chat.DeletedUserID] != 50 {
+		t.Errorf("senders after both jobs = %v, want only %s", senders, chat.DeletedUserID)
+	}
+	if keys := mr.Keys(); len(keys) != 1 || keys[0] != chatroomKey {
+		t.Errorf("keys left = %v, want only %s", keys, chatroomKey)
+	}
+}
+
+func TestRewriteMessagesResumesFromSavedCursor(t *testing.T) {
+	r, _ := newTestChatRepo(t)
+	addChatroomMessages(t, r, "alice", "bob")
+
+	a := &rewriteJob{id: "job-a", userID: "alice"}
+	if err := a.step(t, r); err != nil {
+		t.Fatalf("job a: %v", err)
+	}
+
+	// The second batch is copied but the job stops before saving its
+	// cursor, the next run repeats it.
+	saved := *a
+	if err := a.step(t, r); err != nil {
+		t.Fatalf("job a: %v", err)
+	}
+	*a = saved
+	a.finish(t, r)
+
+	if senders := chatroomSenders(t, r); senders[chat.DeletedUserID] != 25 || senders["bob"] != 25 {
+		t.Errorf("senders = %v, want 25 %s and 25 bob", senders, chat.DeletedUserID)
+	}
+	if a.changed != 25 {
+		t.Errorf("changed = %d, want 25", a.changed)
+	}
+}
+
+func TestLoadHistoryMessagesCursor(t *testing.T) {
+	r, mr := newTestChatRepo(t)
+	ctx := context.Background()
+	db, err := NewClient(ctx, mr.Addr())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s := chat.NewService(r, NewUserRepo(db))
+
+	var ids []string
+	for range 6 {
+		m := &chat.Message{From: "alice", FromName: "alice", Content: "hi"}
+		if err := r.AddChatroomMessage(ctx, m); err != nil {
+			t.Fatalf("AddChatroomMessage: %v", err)
+		}
+		ids = append(ids, m.ID)
+	}
+	if err := r.DeleteMessages(ctx, chat.ChatroomID, []string{ids[3]}); err != nil {
+		t.Fatalf("DeleteMessages: %v", err)
+	}
+
+	// The cursor's message is gone, paging goes on before it.
+	history, err := s.LoadHistoryMessages(ctx, ids[3])
+	if err != nil {
+		t.Fatalf("LoadHistoryMessages(deleted): %v", err)
+	}
+	if len(history) != 3 || history[0].ID != ids[0] || history[2].ID != ids[2] {
+		t.Errorf("LoadHistoryMessages(deleted) = %v, want the three before it", history)
+	}
+
+	// The oldest messages are trimmed, a cursor among them is gone for
+	// good.
+	if err := db.XTrimMaxLen(ctx, chatroomKey, 3).Err(); err != nil {
+		t.Fatalf("XTrimMaxLen: %v", err)
+	}
+	if _, err := s.LoadHistoryMessages(ctx, ids[1]); !errors.Is(err, chat.ErrMessageNotFound) {
+		t.Errorf("LoadHistoryMessages(trimmed) = %v, want %v", err, chat.ErrMessageNotFound)
+	}
+	if history, err := s.LoadHistoryMessages(ctx, ids[4]); err != nil || len(history) != 1 || history[0].ID != ids[2] {
+		t.Errorf("LoadHistoryMessages after trimming = %v, %v, want the oldest one left", history, err)
+	}
+}
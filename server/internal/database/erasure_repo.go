@@ -0,0 +1,177 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const erasurePendingKey = "erasure_pending"
+
+// DeleteUser removes the account and everything only it points to. It can
+// run again after an interruption, the username, its aliases and identity
+// are only released while they still belong to the user.
+func (r *UserRepo) DeleteUser(ctx context.Context, job *user.ErasureJob) error {
+	aliases, err := r.db.SMembers(ctx, userAliasesKey(job.UserID)).Result()
+	if err != nil {
+		return err
+	}
+
+	var owned []string
+	if job.Username != "" {
+		owned = append(owned, usernameKey(job.Username), legacyUsernameKey(job.Username))
+	}
+	for _, alias := range aliases {
+		owned = append(owned, usernameAliasKey(alias))
+	}
+	if job.OIDCIssuer != "" {
+		owned = append(owned, oidcIdentityKey(job.OIDCIssuer, job.OIDCSubject))
+	}
+
+	err = r.db.Watch(ctx, func(tx *redis.Tx) error {
+		var release []string
+		for _, key := range owned {
+			owner, err := tx.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if owner == job.UserID {
+				release = append(release, key)
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.Del(ctx,
+				fmt.Sprintf("user:%s", job.UserID),
+				fmt.Sprintf("avatar:%s", job.UserID),
+				fmt.Sprintf("backup_codes:%s", job.UserID),
+				fmt.Sprintf("user_sessions:%s", job.UserID),
+				fmt.Sprintf("password_reset_sent:%s", job.UserID),
+				userAliasesKey(job.UserID),
+			)
+			p.SRem(ctx, botsKey, job.UserID)
+			if len(release) > 0 {
+				p.Del(ctx, release...)
+			}
+			if job.Username != "" {
+				p.Del(ctx, loginAttemptsKey(user.LoginScopeAccount, user.CanonicalUsername(job.Username)))
+			}
+			return nil
+		})
+
+		return err
+	}, owned...)
+	if err != nil {
+		return err
+	}
+
+	if err := r.deleteRoles(ctx, job.UserID); err != nil {
+		return err
+	}
+	if err := r.deleteAccessTokens(ctx, job.UserID); err != nil {
+		return err
+	}
+
+	return r.DeletePasswordResets(ctx, job.UserID)
+}
+
+func (r *UserRepo) SaveErasureJob(ctx context.Context, job *user.ErasureJob) error {
+	key := erasureKey(job.ID)
+
+	conversations, err := json.Marshal(job.Conversations)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]any{
+		"id":            job.ID,
+		"user_id":       job.UserID,
+		"policy":        string(job.Policy),
+		"stage":         string(job.Stage),
+		"requested_at":  job.RequestedAt.Format(time.RFC3339),
+		"conversations": conversations,
+		"index":         job.Index,
+		"cursor":        job.Cursor,
+		"messages":      job.Messages,
+		"username":      job.Username,
+		"oidc_issuer":   job.OIDCIssuer,
+		"oidc_subject":  job.OIDCSubject,
+	}
+	if !job.CompletedAt.IsZero() {
+		fields["completed_at"] = job.CompletedAt.Format(time.RFC3339)
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, fields)
+		if job.Stage == user.ErasureStageDone {
+			p.SRem(ctx, erasurePendingKey, job.ID)
+		} else {
+			p.SAdd(ctx, erasurePendingKey, job.ID)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) GetErasureJob(ctx context.Context, id string) (*user.ErasureJob, error) {
+	m, err := r.db.HGetAll(ctx, erasureKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(m) == 0 {
+		return nil, user.ErrErasureNotFound
+	}
+
+	job := &user.ErasureJob{
+		ID:          m["id"],
+		UserID:      m["user_id"],
+		Policy:      user.ErasurePolicy(m["policy"]),
+		Stage:       user.ErasureStage(m["stage"]),
+		Cursor:      m["cursor"],
+		Username:    m["username"],
+		OIDCIssuer:  m["oidc_issuer"],
+		OIDCSubject: m["oidc_subject"],
+	}
+	job.RequestedAt, _ = time.Parse(time.RFC3339, m["requested_at"])
+	if m["completed_at"] != "" {
+		job.CompletedAt, _ = time.Parse(time.RFC3339, m["completed_at"])
+	}
+	job.Index, _ = strconv.Atoi(m["index"])
+	job.Messages, _ = strconv.Atoi(m["messages"])
+	if err := json.Unmarshal([]byte(m["conversations"]), &job.Conversations); err != nil {
+		return nil, fmt.Errorf("invalid conversations in erasure job %s, %v", id, err)
+	}
+
+	return job, nil
+}
+
+func (r *UserRepo) PendingErasureJobs(ctx context.Context) ([]string, error) {
+	return r.db.SMembers(ctx, erasurePendingKey).Result()
+}
+
+// ClaimErasureJob makes sure only one instance works on a job at a time.
+func (r *UserRepo) ClaimErasureJob(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	return r.db.SetNX(ctx, erasureLockKey(id), 1, ttl).Result()
+}
+
+func (r *UserRepo) ExtendErasureClaim(ctx context.Context, id string, ttl time.Duration) error {
+	return r.db.Expire(ctx, erasureLockKey(id), ttl).Err()
+}
+
+func (r *UserRepo) ReleaseErasureJob(ctx context.Context, id string) error {
+	return r.db.Del(ctx, erasureLockKey(id)).Err()
+}
+
+func erasureKey(id string) string {
+	return fmt.Sprintf("erasure:%s", id)
+}
+
+func erasureLockKey(id string) string {
+	return fmt.Sprintf("erasure_lock:%s", id)
+}
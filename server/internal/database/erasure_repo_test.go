@@ -0,0 +1,121 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"chatter/server/internal/filter"
+	"chatter/server/internal/user"
+	"context"
+	"testing"
+	"time"
+)
+
+// addModerationRecords files a report and a held message on each author's
+// messages and logs a filter decision for each.
+func addModerationRecords(t *testing.T, r *ChatRepo, authors ...string) {
+	t.Helper()
+	ctx := context.Background()
+
+	for _, author := range authors {
+		for _, held := range []bool{false, true} {
+			report := &chat.Report{
+				ID:           author + "-report",
+				Conversation: chat.ChatroomID,
+				MessageID:    author + "-message",
+				AuthorID:     author,
+				AuthorName:   author,
+				Content:      "spam from " + author,
+				ReporterID:   "carol",
+				Status:       chat.ReportOpen,
+				CreatedAt:    time.Now(),
+			}
+			if held {
+				report.ID, report.MessageID, report.Held, report.ReporterID = author+"-held", "", true, user.SystemModerator
+			}
+			if err := r.AddReport(ctx, report, chat.ReportEntry{Action: chat.ReportActionCreated, ActorID: report.ReporterID}); err != nil {
+				t.Fatalf("AddReport: %v", err)
+			}
+		}
+
+		record := &chat.FilterRecord{
+			UserID:       author,
+			Conversation: chat.ChatroomID,
+			Original:     "darn " + author,
+			Text:         "**** " + author,
+			Decisions:    []filter.Decision{{Filter: "blocklist"}},
+		}
+		if err := r.AddFilterRecord(ctx, record); err != nil {
+			t.Fatalf("AddFilterRecord: %v", err)
+		}
+	}
+}
+
+func TestEraseMessagesModerationRecords(t *testing.T) {
+	for _, policy := range []user.ErasurePolicy{user.ErasureDelete, user.ErasureAnonymize} {
+		t.Run(string(policy), func(t *testing.T) {
+			r, _ := newTestChatRepo(t)
+			ctx := context.Background()
+			addModerationRecords(t, r, "alice", "bob")
+
+			s := chat.NewService(r, nil)
+			job := &user.ErasureJob{ID: "job", UserID: "alice", Policy: policy, Conversations: []string{chat.ChatroomID}}
+			if err := s.EraseMessages(ctx, job, func() error { return nil }); err != nil {
+				t.Fatalf("EraseMessages: %v", err)
+			}
+
+			if reports, err := r.AuthorReports(ctx, "alice"); err != nil || len(reports) != 0 {
+				t.Errorf("AuthorReports(alice) = %v, %v, want none", reports, err)
+			}
+			if records, err := r.UserFilterRecords(ctx, "alice"); err != nil || len(records) != 0 {
+				t.Errorf("UserFilterRecords(alice) = %v, %v, want none", records, err)
+			}
+
+			wantContent := "spam from alice"
+			if policy == user.ErasureDelete {
+				wantContent = ""
+			}
+			for id, status := range map[string]chat.ReportStatus{"alice-report": chat.ReportOpen, "alice-held": chat.ReportResolved} {
+				report, err := r.GetReport(ctx, id)
+				if err != nil {
+					t.Fatalf("GetReport(%s): %v", id, err)
+				}
+				if report.AuthorID != chat.DeletedUserID || report.AuthorName != chat.DeletedUserName || report.Content != wantContent || report.Status != status {
+					t.Errorf("report %s = %+v, want author %s, content %q, status %s", id, report, chat.DeletedUserID, wantContent, status)
+				}
+			}
+
+			if queue, err := r.ListReports(ctx, false, 10); err != nil || len(queue) != 3 {
+				t.Errorf("queue = %v, %v, want bob's two reports and alice's report", queue, err)
+			}
+			if reports, err := r.AuthorReports(ctx, "bob"); err != nil || len(reports) != 2 {
+				t.Errorf("AuthorReports(bob) = %v, %v, want 2", reports, err)
+			}
+			if records, err := r.UserFilterRecords(ctx, "bob"); err != nil || len(records) != 1 {
+				t.Errorf("UserFilterRecords(bob) = %v, %v, want 1", records, err)
+			}
+		})
+	}
+}
+
+func TestExportMessagesModerationRecords(t *testing.T) {
+	r, _ := newTestChatRepo(t)
+	ctx := context.Background()
+	addModerationRecords(t, r, "alice", "bob")
+
+	data, err := chat.NewService(r, nil).ExportMessages(ctx, "alice")
+	if err != nil {
+		t.Fatalf("ExportMessages: %v", err)
+	}
+	export := data.(*chat.UserExport)
+
+	if len(export.Reports) != 2 {
+		t.Fatalf("exported %d reports, want 2", len(export.Reports))
+	}
+	for _, report := range export.Reports {
+		if report.AuthorID != "alice" || report.Content != "spam from alice" || report.ReporterID != "" {
+			t.Errorf("exported report %+v, want alice's content without the reporter", report)
+		}
+	}
+	if len(export.FilterRecords) != 1 || export.FilterRecords[0].Original != "darn alice" {
+		t.Errorf("exported filter records %+v, want alice's one", export.FilterRecords)
+	}
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const eventsChannel = "events"
+
+func publishEvent(ctx context.Context, db *redis.Client, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return db.Publish(ctx, eventsChannel, data).Err()
+}
+
+func subscribeEvents(ctx context.Context, db *redis.Client) <-chan events.Event {
+	ch := make(chan events.Event)
+
+	go func() {
+		defer close(ch)
+
+		sub := db.Subscribe(ctx, eventsChannel)
+		defer sub.Close()
+
+		for msg := range sub.Channel() {
+			var e events.Event
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Printf("database: invalid event, %v", err)
+				continue
+			}
+
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
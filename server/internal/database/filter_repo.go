@@ -0,0 +1,150 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"chatter/server/internal/filter"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	filterLogKey = "filter_log"
+	// filterLogLength is roughly how many records are kept, older ones are
+	// trimmed as new ones come in.
+	filterLogLength = 10000
+	// filterScanBatch is how many records a scan for one user reads at
+	// once.
+	filterScanBatch = 500
+)
+
+func (r *ChatRepo) AddFilterRecord(ctx context.Context, record *chat.FilterRecord) error {
+	decisions, err := json.Marshal(record.Decisions)
+	if err != nil {
+		return err
+	}
+
+	rejected := "0"
+	if record.Rejected {
+		rejected = "1"
+	}
+
+	id, err := r.db.XAdd(ctx, &redis.XAddArgs{
+		Stream: filterLogKey,
+		MaxLen: filterLogLength,
+		Approx: true,
+		Values: map[string]any{
+			"user_id":      record.UserID,
+			"conversation": record.Conversation,
+			"message_id":   record.MessageID,
+			"original":     record.Original,
+			"text":         record.Text,
+			"decisions":    decisions,
+			"rejected":     rejected,
+			"created_at":   record.CreatedAt.Format(time.RFC3339),
+		},
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	record.ID = id
+	return nil
+}
+
+func (r *ChatRepo) GetFilterRecords(ctx context.Context, before string, count int) ([]chat.FilterRecord, error) {
+	end := "+"
+	if before != "" {
+		end = "(" + before
+	}
+
+	entries, err := r.db.XRevRangeN(ctx, filterLogKey, end, "-", int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]chat.FilterRecord, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, *xMessageToFilterRecord(entry))
+	}
+
+	return records, nil
+}
+
+// UserFilterRecords returns every record of the user's messages, oldest
+// first.
+func (r *ChatRepo) UserFilterRecords(ctx context.Context, userID string) ([]chat.FilterRecord, error) {
+	records := []chat.FilterRecord{}
+	err := r.scanFilterLog(ctx, userID, func(entry redis.XMessage) error {
+		records = append(records, *xMessageToFilterRecord(entry))
+		return nil
+	})
+
+	return records, err
+}
+
+// DeleteFilterRecords removes the records of the user's messages and
+// returns how many there were.
+func (r *ChatRepo) DeleteFilterRecords(ctx context.Context, userID string) (int, error) {
+	deleted := 0
+	err := r.scanFilterLog(ctx, userID, func(entry redis.XMessage) error {
+		if err := r.db.XDel(ctx, filterLogKey, entry.ID).Err(); err != nil {
+			return err
+		}
+		deleted++
+		return nil
+	})
+
+	return deleted, err
+}
+
+// scanFilterLog calls fn for every record of the user, in batches from the
+// oldest.
+func (r *ChatRepo) scanFilterLog(ctx context.Context, userID string, fn func(redis.XMessage) error) error {
+	start := "-"
+	for {
+		entries, err := r.db.XRangeN(ctx, filterLogKey, start, "+", filterScanBatch).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if stringValue(entry.Values, "user_id") != userID {
+				continue
+			}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < filterScanBatch {
+			return nil
+		}
+		start = "(" + entries[len(entries)-1].ID
+	}
+}
+
+func xMessageToFilterRecord(entry redis.XMessage) *chat.FilterRecord {
+	record := chat.FilterRecord{
+		ID:           entry.ID,
+		UserID:       stringValue(entry.Values, "user_id"),
+		Conversation: stringValue(entry.Values, "conversation"),
+		MessageID:    stringValue(entry.Values, "message_id"),
+		Original:     stringValue(entry.Values, "original"),
+		Text:         stringValue(entry.Values, "text"),
+		Rejected:     stringValue(entry.Values, "rejected") == "1",
+	}
+	record.CreatedAt, _ = time.Parse(time.RFC3339, stringValue(entry.Values, "created_at"))
+	if err := json.Unmarshal([]byte(stringValue(entry.Values, "decisions")), &record.Decisions); err != nil {
+		record.Decisions = []filter.Decision{}
+	}
+
+	return &record
+}
+
+func stringValue(values map[string]any, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
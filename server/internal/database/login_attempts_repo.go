@@ -0,0 +1,129 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (r *UserRepo) GetLoginAttempts(ctx context.Context, scope user.LoginScope, id string) (*user.LoginAttempts, error) {
+	result, err := r.db.HGetAll(ctx, loginAttemptsKey(scope, id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return redisMapToLoginAttempts(result), nil
+}
+
+// ReserveLoginAttempt counts an attempt before its password is checked and
+// returns the attempts it was counted on. check can refuse the attempt,
+// concurrent attempts are counted one after the other so none of them gets
+// past a limit the others already reached.
+func (r *UserRepo) ReserveLoginAttempt(ctx context.Context, scope user.LoginScope, id string, at time.Time, window time.Duration, check func(*user.LoginAttempts) error) (*user.LoginAttempts, error) {
+	key := loginAttemptsKey(scope, id)
+
+	for {
+		var attempts *user.LoginAttempts
+
+		err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+			result, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			attempts = redisMapToLoginAttempts(result)
+			if err := check(attempts); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.HIncrBy(ctx, key, "failures", 1)
+				p.HSet(ctx, key, "last_failure", at.UnixMilli())
+				p.Expire(ctx, key, window)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return attempts, nil
+	}
+}
+
+// RefundLoginAttempt takes back an attempt reserved at that didn't fail.
+// The last failure goes back to previous unless a later attempt was
+// reserved since.
+func (r *UserRepo) RefundLoginAttempt(ctx context.Context, scope user.LoginScope, id string, at, previous time.Time) error {
+	key := loginAttemptsKey(scope, id)
+
+	for {
+		err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+			result, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if redisMapToLoginAttempts(result).Failures <= 0 {
+				return nil
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.HIncrBy(ctx, key, "failures", -1)
+				if result["last_failure"] == strconv.FormatInt(at.UnixMilli(), 10) {
+					if previous.IsZero() {
+						p.HDel(ctx, key, "last_failure")
+					} else {
+						p.HSet(ctx, key, "last_failure", previous.UnixMilli())
+					}
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+
+		return err
+	}
+}
+
+func (r *UserRepo) LockLogin(ctx context.Context, scope user.LoginScope, id string, until time.Time) error {
+	key := loginAttemptsKey(scope, id)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, "locked_until", until.Unix())
+		p.ExpireAt(ctx, key, until)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) ClearLoginAttempts(ctx context.Context, scope user.LoginScope, id string) error {
+	return r.db.Del(ctx, loginAttemptsKey(scope, id)).Err()
+}
+
+func loginAttemptsKey(scope user.LoginScope, id string) string {
+	return fmt.Sprintf("login_attempts:%s:%s", scope, id)
+}
+
+func redisMapToLoginAttempts(m map[string]string) *user.LoginAttempts {
+	var a user.LoginAttempts
+	a.Failures, _ = strconv.Atoi(m["failures"])
+	if ms, err := strconv.ParseInt(m["last_failure"], 10, 64); err == nil {
+		a.LastFailure = time.UnixMilli(ms)
+	}
+	if sec, err := strconv.ParseInt(m["locked_until"], 10, 64); err == nil {
+		a.LockedUntil = time.Unix(sec, 0)
+	}
+
+	return &a
+}
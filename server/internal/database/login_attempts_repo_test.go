@@ -0,0 +1,96 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errLimit = errors.New("limit reached")
+
+func TestReserveLoginAttemptConcurrently(t *testing.T) {
+	r, _ := newTestUserRepo(t)
+	ctx := context.Background()
+
+	const limit = 5
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		reserved int
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.ReserveLoginAttempt(ctx, user.LoginScopeAccount, "alice", time.Now(), time.Minute, func(a *user.LoginAttempts) error {
+				if a.Failures >= limit {
+					return errLimit
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errLimit) {
+				t.Errorf("ReserveLoginAttempt: %v", err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != limit {
+		t.Errorf("reserved %d attempts, want %d", reserved, limit)
+	}
+	if a, err := r.GetLoginAttempts(ctx, user.LoginScopeAccount, "alice"); err != nil || a.Failures != limit {
+		t.Errorf("GetLoginAttempts = %+v, %v, want %d failures", a, err, limit)
+	}
+}
+
+func TestRefundLoginAttempt(t *testing.T) {
+	r, _ := newTestUserRepo(t)
+	ctx := context.Background()
+	ok := func(*user.LoginAttempts) error { return nil }
+
+	first := time.UnixMilli(time.Now().UnixMilli())
+	if _, err := r.ReserveLoginAttempt(ctx, user.LoginScopeAccount, "alice", first, time.Minute, ok); err != nil {
+		t.Fatalf("ReserveLoginAttempt: %v", err)
+	}
+	second := first.Add(time.Second)
+	if _, err := r.ReserveLoginAttempt(ctx, user.LoginScopeAccount, "alice", second, time.Minute, ok); err != nil {
+		t.Fatalf("ReserveLoginAttempt: %v", err)
+	}
+	third := second.Add(time.Second)
+	if _, err := r.ReserveLoginAttempt(ctx, user.LoginScopeAccount, "alice", third, time.Minute, ok); err != nil {
+		t.Fatalf("ReserveLoginAttempt: %v", err)
+	}
+
+	// The second attempt is refunded after the third was reserved, the
+	// last failure stays the third's.
+	if err := r.RefundLoginAttempt(ctx, user.LoginScopeAccount, "alice", second, first); err != nil {
+		t.Fatalf("RefundLoginAttempt: %v", err)
+	}
+	a, err := r.GetLoginAttempts(ctx, user.LoginScopeAccount, "alice")
+	if err != nil {
+		t.Fatalf("GetLoginAttempts: %v", err)
+	}
+	if a.Failures != 2 || !a.LastFailure.Equal(third) {
+		t.Errorf("after refunding the second = %+v, want 2 failures, last at %v", a, third)
+	}
+
+	// Refunding the latest one puts the last failure back.
+	if err := r.RefundLoginAttempt(ctx, user.LoginScopeAccount, "alice", third, first); err != nil {
+		t.Fatalf("RefundLoginAttempt: %v", err)
+	}
+	if a, err = r.GetLoginAttempts(ctx, user.LoginScopeAccount, "alice"); err != nil {
+		t.Fatalf("GetLoginAttempts: %v", err)
+	}
+	if a.Failures != 1 || !a.LastFailure.Equal(first) {
+		t.Errorf("after refunding the third = %+v, want 1 failure, last at %v", a, first)
+	}
+}
@@ -0,0 +1,259 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sanctionsKey orders the sanctions in effect by expiry, the ones without
+// an end score +inf.
+const sanctionsKey = "sanctions"
+
+// SaveSanction stores the sanction and points the user, and for bans the
+// addresses, at it. A new sanction of the same kind replaces the user's
+// previous one, addresses of the previous one the new one doesn't cover
+// are let go. Everything expires with the sanction.
+func (r *UserRepo) SaveSanction(ctx context.Context, s *user.Sanction) error {
+	key := sanctionKey(s.ID)
+	userKey := activeSanctionKey(s.Kind, "user", s.UserID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		previous, err := tx.Get(ctx, userKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		stale, err := staleSanctionIPKeys(ctx, tx, s, previous)
+		if err != nil {
+			return err
+		}
+
+		fields := map[string]any{
+			"id":           s.ID,
+			"kind":         string(s.Kind),
+			"user_id":      s.UserID,
+			"username":     s.Username,
+			"ips":          strings.Join(s.IPs, ","),
+			"reason":       s.Reason,
+			"moderator_id": s.ModeratorID,
+			"created_at":   s.CreatedAt.Format(time.RFC3339),
+		}
+		score := math.Inf(1)
+		if !s.ExpiresAt.IsZero() {
+			fields["expires_at"] = s.ExpiresAt.Format(time.RFC3339)
+			score = float64(s.ExpiresAt.Unix())
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if previous != "" {
+				p.Del(ctx, sanctionKey(previous))
+				p.ZRem(ctx, sanctionsKey, previous)
+			}
+			for _, ipKey := range stale {
+				p.Del(ctx, ipKey)
+			}
+
+			p.HSet(ctx, key, fields)
+			p.ZAdd(ctx, sanctionsKey, redis.Z{Score: score, Member: s.ID})
+			p.Set(ctx, userKey, s.ID, 0)
+			for _, ip := range s.IPs {
+				p.Set(ctx, activeSanctionKey(s.Kind, "ip", ip), s.ID, 0)
+			}
+
+			if !s.ExpiresAt.IsZero() {
+				p.ExpireAt(ctx, key, s.ExpiresAt)
+				p.ExpireAt(ctx, userKey, s.ExpiresAt)
+				for _, ip := range s.IPs {
+					p.ExpireAt(ctx, activeSanctionKey(s.Kind, "ip", ip), s.ExpiresAt)
+				}
+			}
+			return nil
+		})
+
+		return err
+	}, userKey)
+}
+
+// staleSanctionIPKeys returns the address keys still pointing at the
+// previous sanction that s leaves out, and watches them.
+func staleSanctionIPKeys(ctx context.Context, tx *redis.Tx, s *user.Sanction, previous string) ([]string, error) {
+	if previous == "" {
+		return nil, nil
+	}
+
+	ips, err := tx.HGet(ctx, sanctionKey(previous), "ips").Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var keys []string
+	for _, ip := range strings.Split(ips, ",") {
+		if ip != "" && !slices.Contains(s.IPs, ip) {
+			keys = append(keys, activeSanctionKey(s.Kind, "ip", ip))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if err := tx.Watch(ctx, keys...).Err(); err != nil {
+		return nil, err
+	}
+	ids, err := tx.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for i, id := range ids {
+		if id == previous {
+			stale = append(stale, keys[i])
+		}
+	}
+	return stale, nil
+}
+
+func (r *UserRepo) GetSanction(ctx context.Context, id string) (*user.Sanction, error) {
+	result, err := r.db.HGetAll(ctx, sanctionKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, user.ErrSanctionNotFound
+	}
+
+	return redisMapToSanction(result), nil
+}
+
+// DeleteSanction lifts the sanction, the user and addresses are only let go
+// while they still point at it.
+func (r *UserRepo) DeleteSanction(ctx context.Context, s *user.Sanction) error {
+	keys := []string{activeSanctionKey(s.Kind, "user", s.UserID)}
+	for _, ip := range s.IPs {
+		keys = append(keys, activeSanctionKey(s.Kind, "ip", ip))
+	}
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		ids, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			for i, id := range ids {
+				if id == s.ID {
+					p.Del(ctx, keys[i])
+				}
+			}
+			p.Del(ctx, sanctionKey(s.ID))
+			p.ZRem(ctx, sanctionsKey, s.ID)
+			return nil
+		})
+
+		return err
+	}, keys...)
+}
+
+// ListSanctions returns the sanctions in effect, soonest to end first, and
+// forgets expired ones.
+func (r *UserRepo) ListSanctions(ctx context.Context) ([]user.Sanction, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := r.db.ZRemRangeByScore(ctx, sanctionsKey, "-inf", now).Err(); err != nil {
+		return nil, err
+	}
+
+	ids, err := r.db.ZRange(ctx, sanctionsKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.HGetAll(ctx, sanctionKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sanctions := []user.Sanction{}
+	for _, cmd := range cmds {
+		if m := cmd.Val(); len(m) > 0 {
+			sanctions = append(sanctions, *redisMapToSanction(m))
+		}
+	}
+
+	return sanctions, nil
+}
+
+// ActiveSanction returns the sanction of kind on the user or, when ip is
+// set, on the address. It is nil when there is none.
+func (r *UserRepo) ActiveSanction(ctx context.Context, kind user.SanctionKind, userID, ip string) (*user.Sanction, error) {
+	var keys []string
+	if userID != "" {
+		keys = append(keys, activeSanctionKey(kind, "user", userID))
+	}
+	if ip != "" {
+		keys = append(keys, activeSanctionKey(kind, "ip", ip))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	ids, err := r.db.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		id, ok := id.(string)
+		if !ok {
+			continue
+		}
+
+		s, err := r.GetSanction(ctx, id)
+		if err == user.ErrSanctionNotFound {
+			continue
+		}
+		return s, err
+	}
+
+	return nil, nil
+}
+
+func redisMapToSanction(m map[string]string) *user.Sanction {
+	s := user.Sanction{
+		ID:          m["id"],
+		Kind:        user.SanctionKind(m["kind"]),
+		UserID:      m["user_id"],
+		Username:    m["username"],
+		Reason:      m["reason"],
+		ModeratorID: m["moderator_id"],
+	}
+	if m["ips"] != "" {
+		s.IPs = strings.Split(m["ips"], ",")
+	}
+	s.CreatedAt, _ = time.Parse(time.RFC3339, m["created_at"])
+	s.ExpiresAt, _ = time.Parse(time.RFC3339, m["expires_at"])
+
+	return &s
+}
+
+func sanctionKey(id string) string {
+	return fmt.Sprintf("sanction:%s", id)
+}
+
+// activeSanctionKey points a user or an address at the sanction of kind
+// that applies to it.
+func activeSanctionKey(kind user.SanctionKind, scope, id string) string {
+	return fmt.Sprintf("sanction_active:%s:%s:%s", kind, scope, id)
+}
@@ -0,0 +1,64 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRebanKeepsAddresses(t *testing.T) {
+	r, mr := newTestUserRepo(t)
+	ctx := context.Background()
+	s := user.NewService(r, nil)
+
+	u := &user.User{Username: "mallory"}
+	if err := r.CreateUser(ctx, u); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	session := &user.Session{ID: "s1", UserID: u.ID, IP: "203.0.113.7", CreatedAt: time.Now(), LastSeenAt: time.Now()}
+	if err := r.CreateSession(ctx, session, time.Hour); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	ban := func(byIP bool) *user.Sanction {
+		t.Helper()
+		sanction, err := s.AutoSanction(ctx, user.SanctionRequest{Kind: user.SanctionBan, UserID: u.ID, ByIP: byIP})
+		if err != nil {
+			t.Fatalf("AutoSanction: %v", err)
+		}
+		return sanction
+	}
+	banned := func(ip string) *user.Sanction {
+		t.Helper()
+		sanction, err := r.ActiveSanction(ctx, user.SanctionBan, "", ip)
+		if err != nil {
+			t.Fatalf("ActiveSanction: %v", err)
+		}
+		return sanction
+	}
+
+	first := ban(true)
+	if got := banned("203.0.113.7"); got == nil || got.ID != first.ID {
+		t.Fatalf("address ban after the first ban = %+v, want %s", got, first.ID)
+	}
+
+	// The ban ended the session, the second ban takes the address from
+	// the first one.
+	second := ban(true)
+	if got := banned("203.0.113.7"); got == nil || got.ID != second.ID {
+		t.Errorf("address ban after banning again = %+v, want %s", got, second.ID)
+	}
+	if len(second.IPs) != 1 || second.IPs[0] != "203.0.113.7" {
+		t.Errorf("second ban covers %v, want the first one's address", second.IPs)
+	}
+
+	// A ban of the account alone lets the address go.
+	ban(false)
+	if got := banned("203.0.113.7"); got != nil {
+		t.Errorf("address ban after an account ban = %+v, want none", got)
+	}
+	if mr.Exists("sanction_active:ban:ip:203.0.113.7") {
+		t.Errorf("address key left behind")
+	}
+}
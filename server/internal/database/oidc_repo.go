@@ -0,0 +1,119 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (r *UserRepo) SaveOIDCState(ctx context.Context, hash string, st *user.OIDCState, ttl time.Duration) error {
+	key := fmt.Sprintf("oidc_state:%s", hash)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, map[string]any{
+			"verifier":     st.Verifier,
+			"nonce":        st.Nonce,
+			"link_user_id": st.LinkUserID,
+		})
+		p.Expire(ctx, key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// ConsumeOIDCState returns the state and deletes it, a callback can only be
+// completed once.
+func (r *UserRepo) ConsumeOIDCState(ctx context.Context, hash string) (*user.OIDCState, error) {
+	key := fmt.Sprintf("oidc_state:%s", hash)
+
+	var get *redis.MapStringStringCmd
+	var del *redis.IntCmd
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		get = p.HGetAll(ctx, key)
+		del = p.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m := get.Val()
+	if len(m) == 0 || del.Val() == 0 {
+		return nil, user.ErrInvalidOIDCState
+	}
+
+	return &user.OIDCState{
+		Verifier:   m["verifier"],
+		Nonce:      m["nonce"],
+		LinkUserID: m["link_user_id"],
+	}, nil
+}
+
+func (r *UserRepo) GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*user.User, error) {
+	userID, err := r.db.Get(ctx, oidcIdentityKey(issuer, subject)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, user.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return r.GetUserByID(ctx, userID)
+}
+
+// LinkOIDCIdentity maps the identity to the user. Linking it again to the
+// same user is a no-op, an identity owned by someone else is refused.
+func (r *UserRepo) LinkOIDCIdentity(ctx context.Context, userID, issuer, subject string) error {
+	identityKey := oidcIdentityKey(issuer, subject)
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ctx, identityKey).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if owner != "" && owner != userID {
+			return user.ErrOIDCIdentityLinked
+		}
+
+		previous, err := tx.HMGet(ctx, userKey, "oidc_issuer", "oidc_subject").Result()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			// A user has one linked identity, linking a new one replaces it.
+			if prevIssuer, ok := previous[0].(string); ok {
+				if prevSubject, ok := previous[1].(string); ok {
+					p.Del(ctx, oidcIdentityKey(prevIssuer, prevSubject))
+				}
+			}
+			p.Set(ctx, identityKey, userID, 0)
+			p.HSet(ctx, userKey, map[string]any{
+				"oidc_issuer":  issuer,
+				"oidc_subject": subject,
+			})
+			return nil
+		})
+
+		return err
+	}, identityKey, userKey)
+}
+
+func (r *UserRepo) UnlinkOIDCIdentity(ctx context.Context, u *user.User) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, oidcIdentityKey(u.OIDCIssuer, u.OIDCSubject))
+		p.HDel(ctx, fmt.Sprintf("user:%s", u.ID), "oidc_issuer", "oidc_subject")
+		return nil
+	})
+
+	return err
+}
+
+func oidcIdentityKey(issuer, subject string) string {
+	return fmt.Sprintf("oidc_identity:%s:%s", issuer, subject)
+}
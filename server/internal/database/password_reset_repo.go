@@ -0,0 +1,107 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (r *UserRepo) SetPassword(ctx context.Context, userID, hash string) error {
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, userKey).Result()
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return user.ErrUserNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, userKey, "password", hash)
+			return nil
+		})
+
+		return err
+	}, userKey)
+}
+
+// AllowPasswordResetMail reports whether a reset mail may go out, at most one
+// per interval.
+func (r *UserRepo) AllowPasswordResetMail(ctx context.Context, userID string, interval time.Duration) (bool, error) {
+	return r.db.SetNX(ctx, fmt.Sprintf("password_reset_sent:%s", userID), 1, interval).Result()
+}
+
+// CreatePasswordReset stores the token and invalidates the one sent before,
+// only the latest mail works.
+func (r *UserRepo) CreatePasswordReset(ctx context.Context, hash, userID string, ttl time.Duration) error {
+	userResetKey := passwordResetUserKey(userID)
+
+	previous, err := r.db.Get(ctx, userResetKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		if previous != "" {
+			p.Del(ctx, passwordResetKey(previous))
+		}
+		p.Set(ctx, passwordResetKey(hash), userID, ttl)
+		p.Set(ctx, userResetKey, hash, ttl)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) GetPasswordReset(ctx context.Context, hash string) (string, error) {
+	userID, err := r.db.Get(ctx, passwordResetKey(hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", user.ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// ConsumePasswordReset returns the user the token was issued to and deletes
+// it, a token can only be used once.
+func (r *UserRepo) ConsumePasswordReset(ctx context.Context, hash string) (string, error) {
+	userID, err := r.db.GetDel(ctx, passwordResetKey(hash)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", user.ErrInvalidResetToken
+		}
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func (r *UserRepo) DeletePasswordResets(ctx context.Context, userID string) error {
+	userResetKey := passwordResetUserKey(userID)
+
+	hash, err := r.db.GetDel(ctx, userResetKey).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil
+		}
+		return err
+	}
+
+	return r.db.Del(ctx, passwordResetKey(hash)).Err()
+}
+
+func passwordResetKey(hash string) string {
+	return fmt.Sprintf("password_reset:%s", hash)
+}
+
+func passwordResetUserKey(userID string) string {
+	return fmt.Sprintf("password_reset_user:%s", userID)
+}
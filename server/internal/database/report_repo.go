@@ -0,0 +1,289 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// reportQueueKey orders the open and claimed reports by when they came
+	// in, reportsResolvedKey the resolved ones by when they were closed.
+	reportQueueKey     = "report_queue"
+	reportsResolvedKey = "reports_resolved"
+)
+
+// AddReport stores a new report with the first entry of its trail. A user
+// can report a message only once, held messages have no message yet.
+func (r *ChatRepo) AddReport(ctx context.Context, report *chat.Report, entry chat.ReportEntry) error {
+	data, err := marshalReportEntry(&entry)
+	if err != nil {
+		return err
+	}
+
+	if !report.Held {
+		added, err := r.db.HSetNX(ctx, messageReportsKey(report.Conversation, report.MessageID), report.ReporterID, report.ID).Result()
+		if err != nil {
+			return err
+		}
+		if !added {
+			return chat.ErrReportDuplicate
+		}
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, reportKey(report.ID), reportToMap(report))
+		p.RPush(ctx, reportTrailKey(report.ID), data)
+		p.ZAdd(ctx, reportQueueKey, redis.Z{Score: float64(report.CreatedAt.UnixMilli()), Member: report.ID})
+		return nil
+	})
+
+	return err
+}
+
+// GetReport returns the report with its whole trail.
+func (r *ChatRepo) GetReport(ctx context.Context, id string) (*chat.Report, error) {
+	var fields *redis.MapStringStringCmd
+	var trail *redis.StringSliceCmd
+	_, err := r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		fields = p.HGetAll(ctx, reportKey(id))
+		trail = p.LRange(ctx, reportTrailKey(id), 0, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields.Val()) == 0 {
+		return nil, chat.ErrReportNotFound
+	}
+
+	report := redisMapToReport(fields.Val())
+	report.Trail = make([]chat.ReportEntry, 0, len(trail.Val()))
+	for _, data := range trail.Val() {
+		entry, err := unmarshalReportEntry(data)
+		if err != nil {
+			return nil, fmt.Errorf("database: invalid trail entry on report %s, %v", id, err)
+		}
+		report.Trail = append(report.Trail, *entry)
+	}
+
+	return report, nil
+}
+
+// ListReports returns the queue oldest first, or the latest resolved
+// reports newest first. Trails are left out.
+func (r *ChatRepo) ListReports(ctx context.Context, resolved bool, count int) ([]chat.Report, error) {
+	var ids []string
+	var err error
+	if resolved {
+		ids, err = r.db.ZRevRange(ctx, reportsResolvedKey, 0, int64(count-1)).Result()
+	} else {
+		ids, err = r.db.ZRange(ctx, reportQueueKey, 0, int64(count-1)).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.HGetAll(ctx, reportKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []chat.Report{}
+	for _, cmd := range cmds {
+		if m := cmd.Val(); len(m) > 0 {
+			reports = append(reports, *redisMapToReport(m))
+		}
+	}
+
+	return reports, nil
+}
+
+// UpdateReport lets update change the report and saves it with the entry
+// update returns. Without an entry the report is saved with an unchanged
+// trail, or not at all when update left it as it was. A concurrent change
+// makes the update start over with the new report.
+func (r *ChatRepo) UpdateReport(ctx context.Context, id string, update func(*chat.Report) (*chat.ReportEntry, error)) (*chat.Report, error) {
+	key := reportKey(id)
+
+	for {
+		var report *chat.Report
+
+		err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+			fields, err := tx.HGetAll(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if len(fields) == 0 {
+				return chat.ErrReportNotFound
+			}
+			report = redisMapToReport(fields)
+			before := reportToMap(report)
+
+			entry, err := update(report)
+			if err != nil {
+				return err
+			}
+			if entry == nil && maps.Equal(before, reportToMap(report)) {
+				return nil
+			}
+
+			now := time.Now().UTC()
+			report.UpdatedAt = now
+			var data []byte
+			if entry != nil {
+				entry.CreatedAt = now
+				if data, err = marshalReportEntry(entry); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+				p.HSet(ctx, key, reportToMap(report))
+				if data != nil {
+					p.RPush(ctx, reportTrailKey(id), data)
+				}
+				if report.Status == chat.ReportResolved {
+					p.ZRem(ctx, reportQueueKey, id)
+					p.ZAdd(ctx, reportsResolvedKey, redis.Z{Score: float64(now.UnixMilli()), Member: id})
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return r.GetReport(ctx, report.ID)
+	}
+}
+
+// AuthorReports returns the reports on messages of the author, held ones
+// included. Trails are left out.
+func (r *ChatRepo) AuthorReports(ctx context.Context, authorID string) ([]chat.Report, error) {
+	reports := []chat.Report{}
+
+	iter := r.db.ScanType(ctx, 0, reportKey("*"), 100, "hash").Iterator()
+	for iter.Next(ctx) {
+		fields, err := r.db.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		if fields["author_id"] == authorID {
+			reports = append(reports, *redisMapToReport(fields))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+func reportToMap(r *chat.Report) map[string]any {
+	held := "0"
+	if r.Held {
+		held = "1"
+	}
+
+	return map[string]any{
+		"id":           r.ID,
+		"conversation": r.Conversation,
+		"message_id":   r.MessageID,
+		"author_id":    r.AuthorID,
+		"author_name":  r.AuthorName,
+		"content":      r.Content,
+		"reporter_id":  r.ReporterID,
+		"reason":       r.Reason,
+		"held":         held,
+		"status":       string(r.Status),
+		"claimed_by":   r.ClaimedBy,
+		"resolution":   string(r.Resolution),
+		"sanction_id":  r.SanctionID,
+		"created_at":   r.CreatedAt.Format(time.RFC3339),
+		"updated_at":   r.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+func redisMapToReport(m map[string]string) *chat.Report {
+	r := chat.Report{
+		ID:           m["id"],
+		Conversation: m["conversation"],
+		MessageID:    m["message_id"],
+		AuthorID:     m["author_id"],
+		AuthorName:   m["author_name"],
+		Content:      m["content"],
+		ReporterID:   m["reporter_id"],
+		Reason:       m["reason"],
+		Held:         m["held"] == "1",
+		Status:       chat.ReportStatus(m["status"]),
+		ClaimedBy:    m["claimed_by"],
+		Resolution:   chat.Resolution(m["resolution"]),
+		SanctionID:   m["sanction_id"],
+	}
+	r.CreatedAt, _ = time.Parse(time.RFC3339, m["created_at"])
+	r.UpdatedAt, _ = time.Parse(time.RFC3339, m["updated_at"])
+
+	return &r
+}
+
+// reportEntryRecord is how trail entries are stored, apart from the API's
+// JSON so either can change without the other.
+type reportEntryRecord struct {
+	Action    string    `json:"action"`
+	ActorID   string    `json:"actor_id"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func marshalReportEntry(e *chat.ReportEntry) ([]byte, error) {
+	return json.Marshal(reportEntryRecord{
+		Action:    string(e.Action),
+		ActorID:   e.ActorID,
+		Note:      e.Note,
+		CreatedAt: e.CreatedAt,
+	})
+}
+
+func unmarshalReportEntry(data string) (*chat.ReportEntry, error) {
+	var record reportEntryRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		return nil, err
+	}
+
+	return &chat.ReportEntry{
+		Action:    chat.ReportAction(record.Action),
+		ActorID:   record.ActorID,
+		Note:      record.Note,
+		CreatedAt: record.CreatedAt,
+	}, nil
+}
+
+func reportKey(id string) string {
+	return fmt.Sprintf("report:%s", id)
+}
+
+func reportTrailKey(id string) string {
+	return fmt.Sprintf("report_trail:%s", id)
+}
+
+// messageReportsKey maps the users who reported a message to their
+// reports.
+func messageReportsKey(conversation, messageID string) string {
+	return fmt.Sprintf("message_reports:%s:%s", conversation, messageID)
+}
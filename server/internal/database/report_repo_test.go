@@ -0,0 +1,40 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportTrailStorage(t *testing.T) {
+	r, mr := newTestChatRepo(t)
+	ctx := context.Background()
+
+	report := &chat.Report{ID: "r1", Conversation: chat.ChatroomID, MessageID: "1-0", AuthorID: "alice", ReporterID: "bob", Status: chat.ReportOpen, CreatedAt: time.Now()}
+	if err := r.AddReport(ctx, report, chat.ReportEntry{Action: chat.ReportActionCreated, ActorID: "bob", Note: "spam"}); err != nil {
+		t.Fatalf("AddReport: %v", err)
+	}
+	// An entry written before the API switched to camelCase.
+	mr.RPush(reportTrailKey("r1"), `{"action":"commented","actor_id":"mod","note":"looking","created_at":"2026-01-02T03:04:05Z"}`)
+
+	got, err := r.GetReport(ctx, "r1")
+	if err != nil {
+		t.Fatalf("GetReport: %v", err)
+	}
+	if len(got.Trail) != 2 || got.Trail[0].ActorID != "bob" || got.Trail[1].ActorID != "mod" || got.Trail[1].CreatedAt.IsZero() {
+		t.Fatalf("trail = %+v, want bob's entry and the stored one", got.Trail)
+	}
+
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, key := range []string{`"actorId"`, `"authorId"`, `"createdAt"`} {
+		if !strings.Contains(string(data), key) {
+			t.Errorf("report JSON %s lacks %s", data, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// globalRolesKey indexes users whose global role is not member, so they can
+// be listed without scanning every account.
+const globalRolesKey = "global_roles"
+
+// SetRole stores a global role on the user, or a room role both under the
+// room and under the user. Every change bumps roles_version so tokens with
+// the old roles stop working.
+func (r *UserRepo) SetRole(ctx context.Context, userID, room string, role user.Role) error {
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, userKey).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return user.ErrUserNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			switch {
+			case room == "" && role == user.RoleMember:
+				p.HDel(ctx, userKey, "role")
+				p.HDel(ctx, globalRolesKey, userID)
+			case room == "":
+				p.HSet(ctx, userKey, "role", string(role))
+				p.HSet(ctx, globalRolesKey, userID, string(role))
+			case role == "":
+				p.HDel(ctx, roomRolesKey(room), userID)
+				p.HDel(ctx, userRoomRolesKey(userID), room)
+			default:
+				p.HSet(ctx, roomRolesKey(room), userID, string(role))
+				p.HSet(ctx, userRoomRolesKey(userID), room, string(role))
+			}
+			p.HIncrBy(ctx, userKey, "roles_version", 1)
+			return nil
+		})
+
+		return err
+	}, userKey)
+}
+
+func (r *UserRepo) GetRoomRoles(ctx context.Context, userID string) (map[string]user.Role, error) {
+	result, err := r.db.HGetAll(ctx, userRoomRolesKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return toRoles(result), nil
+}
+
+// ListRoles returns the global roles other than member, or the roles in room
+// when one is given.
+func (r *UserRepo) ListRoles(ctx context.Context, room string) (map[string]user.Role, error) {
+	key := globalRolesKey
+	if room != "" {
+		key = roomRolesKey(room)
+	}
+
+	result, err := r.db.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return toRoles(result), nil
+}
+
+// deleteRoles drops the user from every role index, for DeleteUser.
+func (r *UserRepo) deleteRoles(ctx context.Context, userID string) error {
+	rooms, err := r.db.HKeys(ctx, userRoomRolesKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for _, room := range rooms {
+			p.HDel(ctx, roomRolesKey(room), userID)
+		}
+		p.Del(ctx, userRoomRolesKey(userID))
+		p.HDel(ctx, globalRolesKey, userID)
+		return nil
+	})
+
+	return err
+}
+
+func toRoles(m map[string]string) map[string]user.Role {
+	roles := make(map[string]user.Role, len(m))
+	for k, v := range m {
+		roles[k] = user.Role(v)
+	}
+	return roles
+}
+
+func roomRolesKey(room string) string {
+	return fmt.Sprintf("room_roles:%s", room)
+}
+
+func userRoomRolesKey(userID string) string {
+	return fmt.Sprintf("user_room_roles:%s", userID)
+}
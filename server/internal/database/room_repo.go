@@ -0,0 +1,102 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// GetRoomState returns nil when the room has no modes on.
+func (r *ChatRepo) GetRoomState(ctx context.Context, room string) (*chat.RoomState, error) {
+	result, err := r.db.HGetAll(ctx, roomStateKey(room)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	state := chat.RoomState{
+		Room:      room,
+		ReadOnly:  result["read_only"] == "1",
+		UpdatedBy: result["updated_by"],
+	}
+	state.SlowMode, _ = strconv.Atoi(result["slow_mode"])
+	state.ExpiresAt, _ = time.Parse(time.RFC3339, result["expires_at"])
+	state.UpdatedAt, _ = time.Parse(time.RFC3339, result["updated_at"])
+
+	return &state, nil
+}
+
+// SaveRoomState replaces the room's modes, they go away by themselves at
+// ExpiresAt.
+func (r *ChatRepo) SaveRoomState(ctx context.Context, state *chat.RoomState) error {
+	key := roomStateKey(state.Room)
+	readOnly := "0"
+	if state.ReadOnly {
+		readOnly = "1"
+	}
+
+	fields := map[string]any{
+		"slow_mode":  strconv.Itoa(state.SlowMode),
+		"read_only":  readOnly,
+		"updated_by": state.UpdatedBy,
+		"updated_at": state.UpdatedAt.Format(time.RFC3339),
+	}
+	if !state.ExpiresAt.IsZero() {
+		fields["expires_at"] = state.ExpiresAt.Format(time.RFC3339)
+	}
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key)
+		p.HSet(ctx, key, fields)
+		if !state.ExpiresAt.IsZero() {
+			p.ExpireAt(ctx, key, state.ExpiresAt)
+		}
+		return nil
+	})
+
+	return err
+}
+
+func (r *ChatRepo) DeleteRoomState(ctx context.Context, room string) error {
+	return r.db.Del(ctx, roomStateKey(room)).Err()
+}
+
+// ClaimSlowModeSlot starts the user's wait in the room and returns zero, or
+// how much of a running wait is left.
+func (r *ChatRepo) ClaimSlowModeSlot(ctx context.Context, room, userID string, interval time.Duration) (time.Duration, error) {
+	key := slowModeKey(room, userID)
+
+	claimed, err := r.db.SetNX(ctx, key, "1", interval).Result()
+	if err != nil {
+		return 0, err
+	}
+	if claimed {
+		return 0, nil
+	}
+
+	left, err := r.db.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// The wait ran out between the two calls, or the key lost its expiry.
+	if left <= 0 {
+		return 0, r.db.Set(ctx, key, "1", interval).Err()
+	}
+
+	return left, nil
+}
+
+func roomStateKey(room string) string {
+	return fmt.Sprintf("room_state:%s", room)
+}
+
+func slowModeKey(room, userID string) string {
+	return fmt.Sprintf("slow_mode:%s:%s", room, userID)
+}
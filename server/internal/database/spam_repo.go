@@ -0,0 +1,83 @@
+package database
+
+import (
+	"chatter/server/internal/chat"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const spamCountersKey = "spam_counters"
+
+// RecordRecentMessage adds the message to the sender's recent ones and
+// returns those sent before it within window. Older ones are forgotten.
+func (r *ChatRepo) RecordRecentMessage(ctx context.Context, userID string, m chat.RecentMessage, window time.Duration) ([]chat.RecentMessage, error) {
+	key := spamRecentKey(userID)
+	since := m.SentAt.Add(-window).UnixMilli()
+
+	var recent *redis.StringSliceCmd
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(since, 10))
+		recent = p.ZRange(ctx, key, 0, -1)
+		p.ZAdd(ctx, key, redis.Z{
+			Score:  float64(m.SentAt.UnixMilli()),
+			Member: fmt.Sprintf("%d:%s", m.SentAt.UnixNano(), m.Fingerprint),
+		})
+		p.PExpire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]chat.RecentMessage, 0, len(recent.Val()))
+	for _, member := range recent.Val() {
+		sentAt, fingerprint, ok := strings.Cut(member, ":")
+		if !ok {
+			continue
+		}
+		nanos, err := strconv.ParseInt(sentAt, 10, 64)
+		if err != nil {
+			continue
+		}
+		messages = append(messages, chat.RecentMessage{Fingerprint: fingerprint, SentAt: time.Unix(0, nanos).UTC()})
+	}
+
+	return messages, nil
+}
+
+func (r *ChatRepo) IncrSpamCounters(ctx context.Context, counters []string) error {
+	_, err := r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, counter := range counters {
+			p.HIncrBy(ctx, spamCountersKey, counter, 1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *ChatRepo) GetSpamCounters(ctx context.Context) (map[string]int64, error) {
+	result, err := r.db.HGetAll(ctx, spamCountersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int64, len(result))
+	for name, value := range result {
+		counters[name], _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	return counters, nil
+}
+
+func (r *ChatRepo) ResetSpamCounters(ctx context.Context) error {
+	return r.db.Del(ctx, spamCountersKey).Err()
+}
+
+func spamRecentKey(userID string) string {
+	return fmt.Sprintf("spam_recent:%s", userID)
+}
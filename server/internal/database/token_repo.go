@@ -0,0 +1,216 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (r *UserRepo) CreateSession(ctx context.Context, s *user.Session, ttl time.Duration) error {
+	sessionKey := fmt.Sprintf("session:%s", s.ID)
+	userSessionsKey := fmt.Sprintf("user_sessions:%s", s.UserID)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, sessionKey, map[string]any{
+			"id":           s.ID,
+			"user_id":      s.UserID,
+			"user_agent":   s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt.Format(time.RFC3339),
+			"last_seen_at": s.LastSeenAt.Format(time.RFC3339),
+		})
+		p.Expire(ctx, sessionKey, ttl)
+		p.SAdd(ctx, userSessionsKey, s.ID)
+		return nil
+	})
+
+	return err
+}
+
+// GetSessions returns the user's live sessions and forgets the ones that
+// have expired since.
+func (r *UserRepo) GetSessions(ctx context.Context, userID string) ([]user.Session, error) {
+	userSessionsKey := fmt.Sprintf("user_sessions:%s", userID)
+
+	ids, err := r.db.SMembers(ctx, userSessionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.HGetAll(ctx, fmt.Sprintf("session:%s", id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []user.Session{}
+	var expired []any
+	for i, cmd := range cmds {
+		m := cmd.Val()
+		if len(m) == 0 {
+			expired = append(expired, ids[i])
+			continue
+		}
+		sessions = append(sessions, redisMapToSession(m))
+	}
+
+	if len(expired) > 0 {
+		if err := r.db.SRem(ctx, userSessionsKey, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b user.Session) int {
+		return b.LastSeenAt.Compare(a.LastSeenAt)
+	})
+
+	return sessions, nil
+}
+
+// TouchSession never recreates a session that was revoked in the meantime,
+// a partial hash would otherwise make its tokens valid again.
+func (r *UserRepo) TouchSession(ctx context.Context, sessionID string, lastSeen time.Time, ttl time.Duration) error {
+	sessionKey := fmt.Sprintf("session:%s", sessionID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, sessionKey).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return user.ErrSessionNotFound
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, sessionKey, "last_seen_at", lastSeen.Format(time.RFC3339))
+			p.Expire(ctx, sessionKey, ttl)
+			return nil
+		})
+
+		return err
+	}, sessionKey)
+}
+
+func (r *UserRepo) DeleteSession(ctx context.Context, userID, sessionID string) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, fmt.Sprintf("session:%s", sessionID))
+		p.SRem(ctx, fmt.Sprintf("user_sessions:%s", userID), sessionID)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) StoreRefreshToken(ctx context.Context, hash string, rt *user.RefreshToken, ttl time.Duration) error {
+	key := fmt.Sprintf("refresh_token:%s", hash)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, map[string]any{
+			"user_id":    rt.UserID,
+			"session_id": rt.SessionID,
+			"used":       "0",
+		})
+		p.Expire(ctx, key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// ConsumeRefreshToken marks the token as used and returns it as it was
+// before, so a token that comes back with Used set has been replayed.
+func (r *UserRepo) ConsumeRefreshToken(ctx context.Context, hash string) (*user.RefreshToken, error) {
+	key := fmt.Sprintf("refresh_token:%s", hash)
+
+	var rt user.RefreshToken
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		result, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if len(result) == 0 {
+			return user.ErrInvalidRefreshToken
+		}
+
+		rt = user.RefreshToken{
+			UserID:    result["user_id"],
+			SessionID: result["session_id"],
+			Used:      result["used"] == "1",
+		}
+		if rt.Used {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, "used", "1")
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rt, nil
+}
+
+func (r *UserRepo) RevokeTokenID(ctx context.Context, jti string, ttl time.Duration) error {
+	return r.db.Set(ctx, fmt.Sprintf("revoked_jti:%s", jti), "1", ttl).Err()
+}
+
+func (r *UserRepo) IsTokenRevoked(ctx context.Context, jti, sessionID, userID string, rolesVersion int) (bool, error) {
+	var denied, active *redis.IntCmd
+	var version *redis.StringCmd
+
+	_, err := r.db.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if jti != "" {
+			denied = p.Exists(ctx, fmt.Sprintf("revoked_jti:%s", jti))
+		}
+		if sessionID != "" {
+			active = p.Exists(ctx, fmt.Sprintf("session:%s", sessionID))
+		}
+		if userID != "" {
+			version = p.HGet(ctx, fmt.Sprintf("user:%s", userID), "roles_version")
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	if denied != nil && denied.Val() == 1 {
+		return true, nil
+	}
+	if active != nil && active.Val() == 0 {
+		return true, nil
+	}
+	if version != nil && version.Val() != "" && version.Val() != strconv.Itoa(rolesVersion) {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func redisMapToSession(m map[string]string) user.Session {
+	s := user.Session{
+		ID:        m["id"],
+		UserID:    m["user_id"],
+		UserAgent: m["user_agent"],
+		IP:        m["ip"],
+	}
+	s.CreatedAt, _ = time.Parse(time.RFC3339, m["created_at"])
+	s.LastSeenAt, _ = time.Parse(time.RFC3339, m["last_seen_at"])
+
+	return s
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func (r *UserRepo) SetPendingTOTP(ctx context.Context, userID, secret string) error {
+	return r.db.HSet(ctx, fmt.Sprintf("user:%s", userID), "totp_pending", secret).Err()
+}
+
+func (r *UserRepo) EnableTOTP(ctx context.Context, userID, secret string, step int64, backupCodes []string) error {
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, userKey, map[string]any{
+			"totp_secret":    secret,
+			"totp_last_step": step,
+		})
+		p.HDel(ctx, userKey, "totp_pending")
+		setBackupCodes(ctx, p, userID, backupCodes)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) DisableTOTP(ctx context.Context, userID string) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HDel(ctx, fmt.Sprintf("user:%s", userID), "totp_secret", "totp_pending", "totp_last_step")
+		p.Del(ctx, fmt.Sprintf("backup_codes:%s", userID))
+		return nil
+	})
+
+	return err
+}
+
+// UseTOTPStep records the time step of an accepted code and reports false
+// when that step or a later one was used already.
+func (r *UserRepo) UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error) {
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	fresh := false
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		last, err := tx.HGet(ctx, userKey, "totp_last_step").Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if last != "" {
+			lastStep, _ := strconv.ParseInt(last, 10, 64)
+			if step <= lastStep {
+				return nil
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, userKey, "totp_last_step", step)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fresh = true
+		return nil
+	}, userKey)
+
+	return fresh, err
+}
+
+func (r *UserRepo) SetBackupCodes(ctx context.Context, userID string, hashes []string) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		setBackupCodes(ctx, p, userID, hashes)
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) ConsumeBackupCode(ctx context.Context, userID, hash string) (bool, error) {
+	n, err := r.db.SRem(ctx, fmt.Sprintf("backup_codes:%s", userID), hash).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (r *UserRepo) CountBackupCodes(ctx context.Context, userID string) (int, error) {
+	n, err := r.db.SCard(ctx, fmt.Sprintf("backup_codes:%s", userID)).Result()
+	return int(n), err
+}
+
+func (r *UserRepo) CreateLoginChallenge(ctx context.Context, hash string, lc *user.LoginChallenge, ttl time.Duration) error {
+	key := fmt.Sprintf("login_challenge:%s", hash)
+
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, key, map[string]any{
+			"user_id":    lc.UserID,
+			"user_agent": lc.Client.UserAgent,
+			"ip":         lc.Client.IP,
+			"attempts":   0,
+		})
+		p.Expire(ctx, key, ttl)
+		return nil
+	})
+
+	return err
+}
+
+// AttemptLoginChallenge counts an attempt against the challenge and returns
+// it with the attempts so far, this one included.
+func (r *UserRepo) AttemptLoginChallenge(ctx context.Context, hash string) (*user.LoginChallenge, error) {
+	key := fmt.Sprintf("login_challenge:%s", hash)
+
+	var lc *user.LoginChallenge
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		result, err := tx.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if len(result) == 0 {
+			return user.ErrInvalidChallenge
+		}
+
+		attempts, _ := strconv.Atoi(result["attempts"])
+		lc = &user.LoginChallenge{
+			UserID: result["user_id"],
+			Client: user.ClientInfo{
+				UserAgent: result["user_agent"],
+				IP:        result["ip"],
+			},
+			Attempts: attempts + 1,
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, "attempts", lc.Attempts)
+			return nil
+		})
+
+		return err
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return lc, nil
+}
+
+func (r *UserRepo) DeleteLoginChallenge(ctx context.Context, hash string) (bool, error) {
+	n, err := r.db.Del(ctx, fmt.Sprintf("login_challenge:%s", hash)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func setBackupCodes(ctx context.Context, p redis.Pipeliner, userID string, hashes []string) {
+	key := fmt.Sprintf("backup_codes:%s", userID)
+
+	p.Del(ctx, key)
+	if len(hashes) == 0 {
+		return
+	}
+
+	members := make([]any, len(hashes))
+	for i, h := range hashes {
+		members[i] = h
+	}
+	p.SAdd(ctx, key, members...)
+}
@@ -1,20 +1,19 @@
 package database
 
 import (
+	"chatter/server/internal/events"
 	"chatter/server/internal/user"
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	ErrNotFound              = errors.New("key not found")
-	ErrUsernameAlreadyExists = errors.New("username already exists")
-)
+var ErrNotFound = errors.New("key not found")
 
 type UserRepo struct {
 	db *redis.Client
@@ -24,42 +23,172 @@ func NewUserRepo(db *redis.Client) *UserRepo {
 	return &UserRepo{db}
 }
 
+// CreateUser stores a new account. An account for a single sign-on
+// identity is created with its profile and linked in the same transaction,
+// ErrOIDCIdentityLinked means another account got the identity first.
 func (r *UserRepo) CreateUser(ctx context.Context, u *user.User) error {
 	u.ID = uuid.NewString()
 	u.CreatedAt = time.Now().UTC()
 
 	userKey := fmt.Sprintf("user:%s", u.ID)
-	userNameKey := fmt.Sprintf("username:%s", u.Username)
+	userNameKey := usernameKey(u.Username)
+	legacyKey := legacyUsernameKey(u.Username)
+	aliasKey := usernameAliasKey(u.Username)
+
+	watched := []string{userNameKey, legacyKey, aliasKey}
+	identityKey := ""
+	if u.OIDCIssuer != "" {
+		identityKey = oidcIdentityKey(u.OIDCIssuer, u.OIDCSubject)
+		watched = append(watched, identityKey)
+	}
 
 	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
-		exists, err := tx.Exists(ctx, userNameKey).Result()
+		exists, err := tx.Exists(ctx, userNameKey, legacyKey, aliasKey).Result()
 		if err != nil {
 			return err
 		}
-		if exists == 1 {
-			return ErrUsernameAlreadyExists
+		if exists > 0 {
+			return user.ErrUsernameAlreadyExists
+		}
+		if identityKey != "" {
+			linked, err := tx.Exists(ctx, identityKey).Result()
+			if err != nil {
+				return err
+			}
+			if linked > 0 {
+				return user.ErrOIDCIdentityLinked
+			}
+		}
+
+		fields := map[string]any{
+			"id":         u.ID,
+			"username":   u.Username,
+			"password":   u.Password,
+			"created_at": u.CreatedAt.Format(time.RFC3339),
+		}
+		if u.Bot {
+			fields["bot"] = "1"
+			fields["owner_id"] = u.OwnerID
+		}
+		if u.DisplayName != "" {
+			fields["display_name"] = u.DisplayName
+		}
+		if u.Email != "" {
+			fields["email"] = u.Email
+		}
+		if identityKey != "" {
+			fields["oidc_issuer"] = u.OIDCIssuer
+			fields["oidc_subject"] = u.OIDCSubject
 		}
 
 		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
-			p.HSet(ctx, userKey, map[string]any{
-				"id":         u.ID,
-				"username":   u.Username,
-				"password":   u.Password,
-				"created_at": u.CreatedAt.Format(time.RFC3339),
-			})
+			p.HSet(ctx, userKey, fields)
 			p.Set(ctx, userNameKey, u.ID, 0)
+			if u.Bot {
+				p.SAdd(ctx, botsKey, u.ID)
+			}
+			if identityKey != "" {
+				p.Set(ctx, identityKey, u.ID, 0)
+			}
 			return nil
 		})
 
 		return err
-	}, userNameKey)
+	}, watched...)
 
 	return err
 }
 
+// RenameUser moves the user to a new name and returns the previous one. The
+// previous name becomes an alias for aliasTTL, nobody else can take it in
+// that time.
+func (r *UserRepo) RenameUser(ctx context.Context, userID, username string, aliasTTL time.Duration) (string, error) {
+	userKey := fmt.Sprintf("user:%s", userID)
+	newKey := usernameKey(username)
+	newLegacyKey := legacyUsernameKey(username)
+	newAliasKey := usernameAliasKey(username)
+
+	var previous string
+	err := r.db.Watch(ctx, func(tx *redis.Tx) error {
+		var err error
+		previous, err = tx.HGet(ctx, userKey, "username").Result()
+		if err != nil {
+			if err == redis.Nil {
+				return user.ErrUserNotFound
+			}
+			return err
+		}
+		if previous == username {
+			return user.ErrUsernameUnchanged
+		}
+
+		for _, key := range []string{newKey, newLegacyKey, newAliasKey} {
+			owner, err := tx.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if owner != "" && owner != userID {
+				return user.ErrUsernameAlreadyExists
+			}
+		}
+
+		oldKey := usernameKey(previous)
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, userKey, "username", username)
+			p.Del(ctx, legacyUsernameKey(previous))
+			if oldKey != newKey {
+				p.Del(ctx, oldKey)
+				p.Set(ctx, usernameAliasKey(previous), userID, aliasTTL)
+				// The index lives as long as the newest alias in it.
+				p.SAdd(ctx, userAliasesKey(userID), previous)
+				p.Expire(ctx, userAliasesKey(userID), aliasTTL)
+			}
+			p.Set(ctx, newKey, userID, 0)
+			p.Del(ctx, newAliasKey)
+			return nil
+		})
+
+		return err
+	}, userKey, newKey, newLegacyKey, newAliasKey)
+
+	return previous, err
+}
+
+// ResolveUsername finds the user behind a current name, or behind a previous
+// one that is still an alias.
+func (r *UserRepo) ResolveUsername(ctx context.Context, username string) (string, bool, error) {
+	userID, err := r.lookupUsername(ctx, username)
+	if err == nil {
+		return userID, false, nil
+	}
+	if err != redis.Nil {
+		return "", false, err
+	}
+
+	userID, err = r.db.Get(ctx, usernameAliasKey(username)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", false, user.ErrUserNotFound
+		}
+		return "", false, err
+	}
+
+	return userID, true, nil
+}
+
+// lookupUsername finds the user by canonical name, or by the exact name for
+// accounts not moved to canonical keys yet, the server moves them at startup.
+func (r *UserRepo) lookupUsername(ctx context.Context, username string) (string, error) {
+	userID, err := r.db.Get(ctx, usernameKey(username)).Result()
+	if err != redis.Nil {
+		return userID, err
+	}
+
+	return r.db.Get(ctx, legacyUsernameKey(username)).Result()
+}
+
 func (r *UserRepo) GetUserByUsername(ctx context.Context, username string) (*user.User, error) {
-	usernameKey := fmt.Sprintf("username:%s", username)
-	userID, err := r.db.Get(ctx, usernameKey).Result()
+	userID, err := r.lookupUsername(ctx, username)
 	if err != nil {
 		if err == redis.Nil {
 			return nil, ErrNotFound
@@ -79,11 +208,196 @@ func (r *UserRepo) GetUserByUsername(ctx context.Context, username string) (*use
 	return redisMapToUser(result)
 }
 
+func (r *UserRepo) GetUserByID(ctx context.Context, id string) (*user.User, error) {
+	result, err := r.db.HGetAll(ctx, fmt.Sprintf("user:%s", id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		return nil, user.ErrUserNotFound
+	}
+
+	return redisMapToUser(result)
+}
+
+func (r *UserRepo) UpdateProfile(ctx context.Context, u *user.User) error {
+	return r.db.HSet(ctx, fmt.Sprintf("user:%s", u.ID), map[string]any{
+		"display_name": u.DisplayName,
+		"bio":          u.Bio,
+		"time_zone":    u.TimeZone,
+		"status_text":  u.StatusText,
+		"email":        u.Email,
+	}).Err()
+}
+
+func (r *UserRepo) SetAvatar(ctx context.Context, u *user.User, data []byte) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, fmt.Sprintf("avatar:%s", u.ID), data, 0)
+		p.HSet(ctx, fmt.Sprintf("user:%s", u.ID), map[string]any{
+			"avatar":      u.Avatar,
+			"avatar_type": u.AvatarType,
+		})
+		return nil
+	})
+
+	return err
+}
+
+func (r *UserRepo) GetAvatar(ctx context.Context, id string) ([]byte, error) {
+	data, err := r.db.Get(ctx, fmt.Sprintf("avatar:%s", id)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, user.ErrAvatarNotFound
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (r *UserRepo) DeleteAvatar(ctx context.Context, u *user.User) error {
+	_, err := r.db.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, fmt.Sprintf("avatar:%s", u.ID))
+		p.HDel(ctx, fmt.Sprintf("user:%s", u.ID), "avatar", "avatar_type")
+		return nil
+	})
+
+	return err
+}
+
+// MigrateUsernameKey moves the user from the key their name was stored
+// under before canonical keys to the canonical key of username. The user
+// is renamed when username differs from previous, the new name must be
+// free. Users renamed or deleted in the meantime are left alone.
+func (r *UserRepo) MigrateUsernameKey(ctx context.Context, userID, previous, username string) error {
+	userKey := fmt.Sprintf("user:%s", userID)
+	newKey := usernameKey(username)
+	newLegacyKey := legacyUsernameKey(username)
+	newAliasKey := usernameAliasKey(username)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HGet(ctx, userKey, "username").Result()
+		if err != nil {
+			if err == redis.Nil {
+				return nil
+			}
+			return err
+		}
+		if current != previous {
+			return nil
+		}
+
+		// The oldest account of a canonical name keeps it, whoever holds
+		// the key now.
+		if username != previous {
+			for _, key := range []string{newKey, newLegacyKey, newAliasKey} {
+				owner, err := tx.Get(ctx, key).Result()
+				if err != nil && err != redis.Nil {
+					return err
+				}
+				if owner != "" && owner != userID {
+					return user.ErrUsernameAlreadyExists
+				}
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			if username != previous {
+				p.HSet(ctx, userKey, "username", username)
+			}
+			p.Del(ctx, legacyUsernameKey(previous))
+			p.Set(ctx, newKey, userID, 0)
+			return nil
+		})
+
+		return err
+	}, userKey, newKey, newLegacyKey, newAliasKey)
+}
+
+// HasLegacyUsernames tells whether any name is still indexed as typed.
+func (r *UserRepo) HasLegacyUsernames(ctx context.Context) (bool, error) {
+	iter := r.db.ScanType(ctx, 0, legacyUsernameKey("*"), 1000, "string").Iterator()
+	for iter.Next(ctx) {
+		return true, nil
+	}
+
+	return false, iter.Err()
+}
+
+// ReplacePasswordHash swaps the hash only if it is still oldHash, a password
+// changed in the meantime wins.
+func (r *UserRepo) ReplacePasswordHash(ctx context.Context, userID, oldHash, newHash string) error {
+	userKey := fmt.Sprintf("user:%s", userID)
+
+	return r.db.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HGet(ctx, userKey, "password").Result()
+		if err != nil {
+			if err == redis.Nil {
+				return nil
+			}
+			return err
+		}
+		if current != oldHash {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, userKey, "password", newHash)
+			return nil
+		})
+
+		return err
+	}, userKey)
+}
+
+// ScanUsers calls fn for every account, stopping at the first error.
+func (r *UserRepo) ScanUsers(ctx context.Context, fn func(*user.User) error) error {
+	iter := r.db.ScanType(ctx, 0, "user:*", 100, "hash").Iterator()
+	for iter.Next(ctx) {
+		result, err := r.db.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		if len(result) == 0 {
+			continue
+		}
+
+		u, err := redisMapToUser(result)
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+func (r *UserRepo) PublishEvent(ctx context.Context, e events.Event) error {
+	return publishEvent(ctx, r.db, e)
+}
+
 func redisMapToUser(m map[string]string) (*user.User, error) {
 	var u user.User
 	u.ID = m["id"]
 	u.Username = m["username"]
 	u.Password = m["password"]
+	u.DisplayName = m["display_name"]
+	u.Bio = m["bio"]
+	u.Avatar = m["avatar"]
+	u.AvatarType = m["avatar_type"]
+	u.TimeZone = m["time_zone"]
+	u.StatusText = m["status_text"]
+	u.Email = m["email"]
+	u.TOTPSecret = m["totp_secret"]
+	u.TOTPPending = m["totp_pending"]
+	u.OIDCIssuer = m["oidc_issuer"]
+	u.OIDCSubject = m["oidc_subject"]
+	u.Role = user.Role(m["role"])
+	u.Bot = m["bot"] == "1"
+	u.OwnerID = m["owner_id"]
+	u.RolesVersion, _ = strconv.Atoi(m["roles_version"])
 
 	t, err := time.Parse(time.RFC3339, m["created_at"])
 	if err != nil {
@@ -93,3 +407,26 @@ func redisMapToUser(m map[string]string) (*user.User, error) {
 
 	return &u, nil
 }
+
+// usernameKey indexes users by canonical name, so names differing only in
+// case or lookalike characters share a key. It has its own prefix so it
+// never mixes with the legacy keys.
+func usernameKey(username string) string {
+	return fmt.Sprintf("username_canonical:%s", user.CanonicalUsername(username))
+}
+
+// legacyUsernameKey is where names were indexed as typed, before canonical
+// keys.
+func legacyUsernameKey(username string) string {
+	return fmt.Sprintf("username:%s", username)
+}
+
+// userAliasesKey lists the previous names of a user that may still be
+// aliases.
+func userAliasesKey(userID string) string {
+	return fmt.Sprintf("user_aliases:%s", userID)
+}
+
+func usernameAliasKey(username string) string {
+	return fmt.Sprintf("username_alias:%s", user.CanonicalUsername(username))
+}
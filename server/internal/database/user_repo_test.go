@@ -0,0 +1,150 @@
+package database
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestUserRepo(t *testing.T) (*UserRepo, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	db, err := NewClient(context.Background(), mr.Addr())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewUserRepo(db), mr
+}
+
+// addLegacyUser stores an account the way it was before canonical keys.
+func addLegacyUser(t *testing.T, mr *miniredis.Miniredis, id, username string, created time.Time) {
+	t.Helper()
+
+	mr.HSet("user:"+id, "id", id, "username", username, "created_at", created.Format(time.RFC3339))
+	if err := mr.Set(legacyUsernameKey(username), id); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+}
+
+func TestMigrateLegacyUsernames(t *testing.T) {
+	r, mr := newTestUserRepo(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	addLegacyUser(t, mr, "old-alice", "Alice", now.Add(-3*time.Hour))
+	addLegacyUser(t, mr, "new-alice", "alice", now.Add(-2*time.Hour))
+	addLegacyUser(t, mr, "taken", "ALICE2", now.Add(-time.Hour))
+	addLegacyUser(t, mr, "bob", "bob", now)
+
+	s := user.NewService(r, nil)
+	if err := s.MigrateLegacyUsernames(ctx); err != nil {
+		t.Fatalf("MigrateLegacyUsernames: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		want     string
+	}{
+		{"Alice", "old-alice"},
+		{"alice", "old-alice"},
+		{"alice2", "taken"},
+		{"alice3", "new-alice"},
+		{"Bob", "bob"},
+	}
+	for _, tt := range tests {
+		u, err := r.GetUserByUsername(ctx, tt.username)
+		if err != nil {
+			t.Errorf("GetUserByUsername(%q): %v", tt.username, err)
+			continue
+		}
+		if u.ID != tt.want {
+			t.Errorf("GetUserByUsername(%q) = %s, want %s", tt.username, u.ID, tt.want)
+		}
+	}
+
+	renamed, err := r.GetUserByID(ctx, "new-alice")
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if renamed.Username != "alice3" {
+		t.Errorf("renamed username = %q, want %q", renamed.Username, "alice3")
+	}
+
+	if legacy, err := r.HasLegacyUsernames(ctx); err != nil || legacy {
+		t.Errorf("HasLegacyUsernames = %v, %v, want false", legacy, err)
+	}
+
+	// Running it again changes nothing.
+	if err := s.MigrateLegacyUsernames(ctx); err != nil {
+		t.Fatalf("second MigrateLegacyUsernames: %v", err)
+	}
+	if u, err := r.GetUserByUsername(ctx, "alice3"); err != nil || u.ID != "new-alice" {
+		t.Errorf("GetUserByUsername(alice3) after a second run = %v, %v", u, err)
+	}
+}
+
+func TestCreateUserAfterMigration(t *testing.T) {
+	r, mr := newTestUserRepo(t)
+	ctx := context.Background()
+
+	addLegacyUser(t, mr, "old-alice", "Alice", time.Now())
+	if err := user.NewService(r, nil).MigrateLegacyUsernames(ctx); err != nil {
+		t.Fatalf("MigrateLegacyUsernames: %v", err)
+	}
+
+	for _, username := range []string{"alice", "ALICE", "Аlice"} {
+		if err := r.CreateUser(ctx, &user.User{Username: username}); !errors.Is(err, user.ErrUsernameAlreadyExists) {
+			t.Errorf("CreateUser(%q) = %v, want %v", username, err, user.ErrUsernameAlreadyExists)
+		}
+	}
+}
+
+func TestCreateUserWithIdentityConcurrently(t *testing.T) {
+	r, _ := newTestUserRepo(t)
+	ctx := context.Background()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created []string
+	)
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u := &user.User{Username: fmt.Sprintf("alice%d", i), Email: "alice@example.com", OIDCIssuer: "https://idp.example", OIDCSubject: "alice"}
+			err := r.CreateUser(ctx, u)
+			if err != nil && !errors.Is(err, user.ErrOIDCIdentityLinked) {
+				t.Errorf("CreateUser: %v", err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				created = append(created, u.ID)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(created) != 1 {
+		t.Fatalf("created %d accounts for one identity, want 1", len(created))
+	}
+
+	u, err := r.GetUserByOIDCIdentity(ctx, "https://idp.example", "alice")
+	if err != nil {
+		t.Fatalf("GetUserByOIDCIdentity: %v", err)
+	}
+	if u.ID != created[0] || u.OIDCSubject != "alice" || u.Email != "alice@example.com" {
+		t.Errorf("GetUserByOIDCIdentity = %+v, want the created account with its profile", u)
+	}
+}
@@ -0,0 +1,64 @@
+// Package events deals with notifications shared between services
+package events
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type Type string
+
+const (
+	ReadMarker Type = "read_marker"
+	Typing     Type = "typing"
+
+	UserUpdated    Type = "user_updated"
+	SessionRevoked Type = "session_revoked"
+
+	Moderation     Type = "moderation"
+	ReportCreated  Type = "report_created"
+	MessageDeleted Type = "message_deleted"
+	// ShadowMessage delivers a dropped spam message to its sender only.
+	ShadowMessage Type = "shadow_message"
+	RoomState     Type = "room_state"
+)
+
+// Event is fanned out to every server instance. Events with a UserID are
+// only delivered to that user's connections.
+type Event struct {
+	Type   Type            `json:"type"`
+	UserID string          `json:"userId,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// UserProfile is the public part of a profile pushed with UserUpdated.
+// PreviousUsername is set when the update is a rename.
+type UserProfile struct {
+	ID               string `json:"id"`
+	Username         string `json:"username"`
+	PreviousUsername string `json:"previousUsername,omitempty"`
+	DisplayName      string `json:"displayName,omitempty"`
+	AvatarURL        string `json:"avatarUrl,omitempty"`
+	StatusText       string `json:"statusText,omitempty"`
+}
+
+type RevokedSession struct {
+	SessionID string `json:"sessionId"`
+}
+
+// ModerationAction announces a mute, kick or ban, or with Lifted set the end
+// of one. Until is zero for sanctions without an end.
+type ModerationAction struct {
+	Kind     string    `json:"kind"`
+	Lifted   bool      `json:"lifted,omitempty"`
+	UserID   string    `json:"userId"`
+	Username string    `json:"username"`
+	Reason   string    `json:"reason,omitempty"`
+	Until    time.Time `json:"until,omitzero"`
+}
+
+// DeletedMessage tells clients to drop a message a moderator removed.
+type DeletedMessage struct {
+	Conversation string `json:"conversation"`
+	MessageID    string `json:"messageId"`
+}
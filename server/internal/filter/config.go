@@ -0,0 +1,184 @@
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the filter file, filters run in the order listed:
+//
+//	{"filters": [
+//	  {"type": "invisible"},
+//	  {"type": "normalize", "form": "NFKC"},
+//	  {"type": "blocklist", "rules": [
+//	    {"pattern": "darn", "action": "mask"},
+//	    {"pattern": "free\\s+crypto", "regex": true, "action": "reject"}
+//	  ]},
+//	  {"type": "links", "allow": ["example.com"], "action": "flag"}
+//	]}
+type Config struct {
+	Filters []FilterConfig `json:"filters"`
+}
+
+type FilterConfig struct {
+	Type string `json:"type"`
+	// Form is the normalization form, NFKC or NFC.
+	Form  string       `json:"form,omitempty"`
+	Rules []RuleConfig `json:"rules,omitempty"`
+	// Allow lists the domains links may point to, Action applies to the
+	// others.
+	Allow  []string `json:"allow,omitempty"`
+	Action string   `json:"action,omitempty"`
+}
+
+type RuleConfig struct {
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex,omitempty"`
+	Action  string `json:"action"`
+}
+
+// NewPipelineFromConfig builds the filters in the order the config lists
+// them.
+func NewPipelineFromConfig(cfg *Config) (*Pipeline, error) {
+	var filters []Filter
+
+	for _, fc := range cfg.Filters {
+		var f Filter
+		var err error
+
+		switch fc.Type {
+		case "invisible":
+			f = NewInvisibleFilter()
+		case "normalize":
+			f, err = newNormalizeFilterForm(fc.Form)
+		case "blocklist":
+			rules := make([]BlocklistRule, len(fc.Rules))
+			for i, rc := range fc.Rules {
+				rules[i] = BlocklistRule{Pattern: rc.Pattern, Regex: rc.Regex, Action: Action(rc.Action)}
+			}
+			f, err = NewBlocklistFilter(rules)
+		case "links":
+			f, err = NewLinkFilter(fc.Allow, Action(fc.Action))
+		default:
+			err = fmt.Errorf("filter: unknown filter type %q", fc.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		filters = append(filters, f)
+	}
+
+	return NewPipeline(filters...), nil
+}
+
+// LoadFile reads a filter file into a pipeline.
+func LoadFile(path string) (*Pipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("filter: invalid config %s, %v", path, err)
+	}
+
+	return NewPipelineFromConfig(&cfg)
+}
+
+// Store holds the pipeline loaded from a file and swaps it when the file
+// changes, messages in flight keep the pipeline they started with. Without
+// a file it holds DefaultPipeline.
+type Store struct {
+	path     string
+	pipeline atomic.Pointer[Pipeline]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// NewStore loads the file at path, a missing or broken file is an error
+// here so mistakes show at startup.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	s.pipeline.Store(DefaultPipeline())
+
+	if path == "" {
+		return s, nil
+	}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) Apply(text string) (*Result, error) {
+	return s.pipeline.Load().Apply(text)
+}
+
+// Reload reads the file again if it changed since the last load and
+// reports whether it did.
+func (s *Store) Reload() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+
+	// A broken file is reported once, not on every check until it is fixed.
+	s.modTime = info.ModTime()
+
+	pipeline, err := LoadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+
+	s.pipeline.Store(pipeline)
+
+	return true, nil
+}
+
+// Run checks the file every interval. A broken file is logged and the
+// previous pipeline stays in use.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := s.Reload()
+		if err != nil {
+			log.Printf("filter: failed to reload %s, keeping the current filters, %v", s.path, err)
+			continue
+		}
+		if reloaded {
+			log.Printf("filter: reloaded %s", s.path)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Package filter checks and cleans up messages before they are stored
+package filter
+
+import (
+	"fmt"
+)
+
+// Action is what a filter did with a message.
+type Action string
+
+const (
+	// ActionRewrite changed the text without hiding anything, such as
+	// dropping invisible characters.
+	ActionRewrite Action = "rewrite"
+	// ActionMask hid the matched text.
+	ActionMask Action = "mask"
+	// ActionFlag let the message through for a moderator to look at.
+	ActionFlag Action = "flag"
+	// ActionReject stopped the message.
+	ActionReject Action = "reject"
+)
+
+func parseAction(s string, allowed ...Action) (Action, error) {
+	for _, a := range allowed {
+		if Action(s) == a {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("filter: unknown action %q", s)
+}
+
+// Decision is one filter acting on a message, Rule names what matched.
+type Decision struct {
+	Filter string `json:"filter"`
+	Action Action `json:"action"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+// Filter looks at a message's text and returns it, changed or not, with
+// what it did. A filter that leaves the text alone returns no decisions.
+type Filter interface {
+	Name() string
+	Apply(text string) (string, []Decision)
+}
+
+// RejectedError stops a message, Decision is the filter that did.
+type RejectedError struct {
+	Decision Decision
+}
+
+func (e *RejectedError) Error() string {
+	return "message rejected by the " + e.Decision.Filter + " filter"
+}
+
+// Result is the text after every filter ran and what they did.
+type Result struct {
+	Text      string
+	Decisions []Decision
+}
+
+func (r *Result) Flagged() bool {
+	for _, d := range r.Decisions {
+		if d.Action == ActionFlag {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline runs filters in order, each one sees the text the previous one
+// returned. The first rejection ends it.
+type Pipeline struct {
+	filters []Filter
+}
+
+func NewPipeline(filters ...Filter) *Pipeline {
+	return &Pipeline{filters: filters}
+}
+
+// Apply returns a *RejectedError along with the result so far when a
+// filter rejects the text.
+func (p *Pipeline) Apply(text string) (*Result, error) {
+	result := &Result{Text: text}
+
+	for _, f := range p.filters {
+		var decisions []Decision
+		result.Text, decisions = f.Apply(result.Text)
+		result.Decisions = append(result.Decisions, decisions...)
+
+		for _, d := range decisions {
+			if d.Action == ActionReject {
+				return result, &RejectedError{Decision: d}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// DefaultPipeline is used without a config file, it only cleans up text.
+func DefaultPipeline() *Pipeline {
+	return NewPipeline(NewInvisibleFilter(), NewNormalizeFilter())
+}
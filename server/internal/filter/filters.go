@@ -0,0 +1,326 @@
+package filter
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	zeroWidthNonJoiner = '\u200c'
+	zeroWidthJoiner    = '\u200d'
+	// emojiPresentation asks for the emoji form of a symbol such as ❤.
+	emojiPresentation = '\ufe0f'
+)
+
+// joiningScripts use zero-width joiners and non-joiners inside words, to
+// pick the form of a letter or to keep a conjunct apart.
+var joiningScripts = []*unicode.RangeTable{
+	unicode.Arabic, unicode.Syriac, unicode.Devanagari, unicode.Bengali, unicode.Gurmukhi, unicode.Gujarati,
+	unicode.Oriya, unicode.Tamil, unicode.Telugu, unicode.Kannada, unicode.Malayalam, unicode.Sinhala,
+}
+
+// InvisibleFilter drops control characters and invisible formatting such
+// as zero-width spaces and direction overrides, which hide words from the
+// other filters and garble the chat. Newlines and tabs stay, and so do
+// zero-width joiners inside emoji sequences and joiners and non-joiners
+// between letters of scripts that need them.
+type InvisibleFilter struct{}
+
+func NewInvisibleFilter() *InvisibleFilter {
+	return &InvisibleFilter{}
+}
+
+func (f *InvisibleFilter) Name() string { return "invisible" }
+
+func (f *InvisibleFilter) Apply(text string) (string, []Decision) {
+	var b strings.Builder
+	var previous rune
+	removed := 0
+
+	runes := []rune(text)
+	for i, r := range runes {
+		var next rune
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+
+		invisible := unicode.Is(unicode.Cf, r) || (unicode.IsControl(r) && r != '\n' && r != '\t')
+		if invisible && !keepJoiner(r, previous, next) {
+			removed++
+			continue
+		}
+		b.WriteRune(r)
+		previous = r
+	}
+
+	if removed == 0 {
+		return text, nil
+	}
+
+	return b.String(), []Decision{{Filter: f.Name(), Action: ActionRewrite, Rule: fmt.Sprintf("%d removed", removed)}}
+}
+
+// keepJoiner tells whether r is a joiner that means something between
+// previous and next: a zero-width joiner gluing emoji into one, such as
+// 👩🏽‍💻 or ❤️‍🔥, or either joiner inside a word of a joining script.
+func keepJoiner(r, previous, next rune) bool {
+	if r != zeroWidthJoiner && r != zeroWidthNonJoiner {
+		return false
+	}
+	if r == zeroWidthJoiner && isEmojiPart(previous) && unicode.Is(unicode.So, next) {
+		return true
+	}
+	return isJoiningLetter(previous) && isJoiningLetter(next)
+}
+
+// isEmojiPart is a symbol or what may follow one in an emoji, a skin tone
+// or the emoji presentation selector.
+func isEmojiPart(r rune) bool {
+	return unicode.Is(unicode.So, r) || r == emojiPresentation || (r >= 0x1f3fb && r <= 0x1f3ff)
+}
+
+func isJoiningLetter(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsMark(r)) && unicode.IsOneOf(joiningScripts, r)
+}
+
+// NormalizeFilter brings text into a Unicode normal form. NFKC also folds
+// lookalikes such as fullwidth or mathematical letters into plain ones, so
+// the blocklist sees the word that is displayed.
+type NormalizeFilter struct {
+	form norm.Form
+	name string
+}
+
+func NewNormalizeFilter() *NormalizeFilter {
+	return &NormalizeFilter{form: norm.NFKC, name: "NFKC"}
+}
+
+func newNormalizeFilterForm(form string) (*NormalizeFilter, error) {
+	switch strings.ToUpper(form) {
+	case "", "NFKC":
+		return NewNormalizeFilter(), nil
+	case "NFC":
+		return &NormalizeFilter{form: norm.NFC, name: "NFC"}, nil
+	}
+	return nil, fmt.Errorf("filter: unknown normalization form %q", form)
+}
+
+func (f *NormalizeFilter) Name() string { return "normalize" }
+
+func (f *NormalizeFilter) Apply(text string) (string, []Decision) {
+	normalized := f.form.String(text)
+	if normalized == text {
+		return text, nil
+	}
+
+	return normalized, []Decision{{Filter: f.Name(), Action: ActionRewrite, Rule: f.name}}
+}
+
+// BlocklistRule matches a word, or a regular expression when Regex is set.
+// Words match case-insensitively and only as whole words, in any script.
+type BlocklistRule struct {
+	Pattern string
+	Regex   bool
+	Action  Action
+
+	re *regexp.Regexp
+	// wordStart and wordEnd ask for a word boundary before and after a
+	// match, on the sides where the word begins or ends with a letter or
+	// digit of a script that separates words.
+	wordStart, wordEnd bool
+}
+
+// find returns where the rule matches text.
+func (r *BlocklistRule) find(text string) [][]int {
+	matches := r.re.FindAllStringIndex(text, -1)
+	if !r.wordStart && !r.wordEnd {
+		return matches
+	}
+
+	whole := matches[:0]
+	for _, m := range matches {
+		before, _ := utf8.DecodeLastRuneInString(text[:m[0]])
+		after, _ := utf8.DecodeRuneInString(text[m[1]:])
+		if r.wordStart && isWordRune(before) || r.wordEnd && isWordRune(after) {
+			continue
+		}
+		whole = append(whole, m)
+	}
+	return whole
+}
+
+// isWordRune is what RE2's ASCII-only \b counts as a word character,
+// extended to every script.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
+}
+
+// unspacedScripts are written without spaces between words, a word in
+// them can't be told apart from its neighbours.
+var unspacedScripts = []*unicode.RangeTable{
+	unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Thai, unicode.Lao, unicode.Khmer, unicode.Myanmar,
+}
+
+// needsBoundary tells whether a word ending in r only matches as a whole
+// word on that side.
+func needsBoundary(r rune) bool {
+	return isWordRune(r) && !unicode.IsOneOf(unspacedScripts, r)
+}
+
+// BlocklistFilter masks, flags or rejects text matching its rules. Every
+// matching rule is reported, a rejecting one ends the check.
+type BlocklistFilter struct {
+	rules []BlocklistRule
+}
+
+func NewBlocklistFilter(rules []BlocklistRule) (*BlocklistFilter, error) {
+	f := &BlocklistFilter{rules: make([]BlocklistRule, len(rules))}
+
+	for i, rule := range rules {
+		if _, err := parseAction(string(rule.Action), ActionMask, ActionFlag, ActionReject); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rule.Pattern) == "" {
+			return nil, fmt.Errorf("filter: empty blocklist pattern")
+		}
+
+		pattern := rule.Pattern
+		if !rule.Regex {
+			first, _ := utf8.DecodeRuneInString(pattern)
+			last, _ := utf8.DecodeLastRuneInString(pattern)
+			rule.wordStart, rule.wordEnd = needsBoundary(first), needsBoundary(last)
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid blocklist pattern %q, %v", rule.Pattern, err)
+		}
+		// A pattern that matches nothing at all matches every message.
+		if re.MatchString("") {
+			return nil, fmt.Errorf("filter: blocklist pattern %q matches empty text", rule.Pattern)
+		}
+
+		rule.re = re
+		f.rules[i] = rule
+	}
+
+	return f, nil
+}
+
+func (f *BlocklistFilter) Name() string { return "blocklist" }
+
+func (f *BlocklistFilter) Apply(text string) (string, []Decision) {
+	var decisions []Decision
+
+	for _, rule := range f.rules {
+		matches := rule.find(text)
+		if len(matches) == 0 {
+			continue
+		}
+
+		decisions = append(decisions, Decision{Filter: f.Name(), Action: rule.Action, Rule: rule.Pattern})
+		switch rule.Action {
+		case ActionReject:
+			return text, decisions
+		case ActionMask:
+			text = maskMatches(text, matches)
+		}
+	}
+
+	return text, decisions
+}
+
+func maskMatches(text string, matches [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(text[last:m[0]])
+		b.WriteString(mask(text[m[0]:m[1]]))
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+
+	return b.String()
+}
+
+func mask(s string) string {
+	return strings.Repeat("*", utf8.RuneCountInString(s))
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+const maskedLink = "[link removed]"
+
+// CountLinks returns how many links the text has, as LinkFilter finds them.
+func CountLinks(text string) int {
+	return len(linkPattern.FindAllStringIndex(text, -1))
+}
+
+// LinkFilter lets links to allowed domains and their subdomains through
+// and masks, flags or rejects the others.
+type LinkFilter struct {
+	allow  []string
+	action Action
+}
+
+func NewLinkFilter(allow []string, action Action) (*LinkFilter, error) {
+	if _, err := parseAction(string(action), ActionMask, ActionFlag, ActionReject); err != nil {
+		return nil, err
+	}
+
+	f := &LinkFilter{action: action}
+	for _, domain := range allow {
+		f.allow = append(f.allow, strings.ToLower(strings.TrimPrefix(domain, ".")))
+	}
+
+	return f, nil
+}
+
+func (f *LinkFilter) Name() string { return "links" }
+
+func (f *LinkFilter) Apply(text string) (string, []Decision) {
+	var decisions []Decision
+
+	text = linkPattern.ReplaceAllStringFunc(text, func(link string) string {
+		host := linkHost(link)
+		if f.allowed(host) {
+			return link
+		}
+
+		decisions = append(decisions, Decision{Filter: f.Name(), Action: f.action, Rule: host})
+		if f.action == ActionMask {
+			return maskedLink
+		}
+		return link
+	})
+
+	return text, decisions
+}
+
+func (f *LinkFilter) allowed(host string) bool {
+	for _, domain := range f.allow {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
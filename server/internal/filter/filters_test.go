@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlocklistFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    BlocklistRule
+		text    string
+		want    string
+		matched bool
+	}{
+		{"whole word", BlocklistRule{Pattern: "bad"}, "a bad day", "a *** day", true},
+		{"case insensitive", BlocklistRule{Pattern: "bad"}, "BAD news", "*** news", true},
+		{"every match", BlocklistRule{Pattern: "bad"}, "bad bad badge", "*** *** badge", true},
+		{"prefix of a word", BlocklistRule{Pattern: "bad"}, "badge", "badge", false},
+		{"suffix of a word", BlocklistRule{Pattern: "bad"}, "sinbad", "sinbad", false},
+		{"underscore joins words", BlocklistRule{Pattern: "bad"}, "x_bad", "x_bad", false},
+		{"digit joins words", BlocklistRule{Pattern: "bad"}, "bad2", "bad2", false},
+		{"punctuation separates words", BlocklistRule{Pattern: "bad"}, "(bad)!", "(***)!", true},
+		{"cyrillic word", BlocklistRule{Pattern: "дурак"}, "ты дурак!", "ты *****!", true},
+		{"cyrillic inside a word", BlocklistRule{Pattern: "дурак"}, "дураки", "дураки", false},
+		{"cyrillic case", BlocklistRule{Pattern: "дурак"}, "ДУРАК", "*****", true},
+		{"accented neighbour", BlocklistRule{Pattern: "bad"}, "ébad", "ébad", false},
+		{"han without spaces", BlocklistRule{Pattern: "笨蛋"}, "你是笨蛋吗", "你是**吗", true},
+		{"thai without spaces", BlocklistRule{Pattern: "โง่"}, "คุณโง่มาก", "คุณ***มาก", true},
+		{"ends in a symbol", BlocklistRule{Pattern: "c++"}, "I like c++.", "I like ***.", true},
+		{"ends in a symbol inside a word", BlocklistRule{Pattern: "c++"}, "abc++", "abc++", false},
+		{"pattern is quoted", BlocklistRule{Pattern: "a.b"}, "axb", "axb", false},
+		{"regex", BlocklistRule{Pattern: `free\s+crypto`, Regex: true}, "get FREE  crypto now", "get ************ now", true},
+		{"regex matches inside words", BlocklistRule{Pattern: "bad", Regex: true}, "badge", "***ge", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Action = ActionMask
+			f, err := NewBlocklistFilter([]BlocklistRule{tt.rule})
+			if err != nil {
+				t.Fatalf("NewBlocklistFilter: %v", err)
+			}
+
+			got, decisions := f.Apply(tt.text)
+			if got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+			if (len(decisions) > 0) != tt.matched {
+				t.Errorf("Apply(%q) decisions = %v, want matched %v", tt.text, decisions, tt.matched)
+			}
+		})
+	}
+}
+
+func TestBlocklistFilterActions(t *testing.T) {
+	rules := []BlocklistRule{
+		{Pattern: "darn", Action: ActionMask},
+		{Pattern: "meh", Action: ActionFlag},
+		{Pattern: "scam", Action: ActionReject},
+		{Pattern: "never", Action: ActionMask},
+	}
+	f, err := NewBlocklistFilter(rules)
+	if err != nil {
+		t.Fatalf("NewBlocklistFilter: %v", err)
+	}
+
+	tests := []struct {
+		text      string
+		want      string
+		decisions []Decision
+	}{
+		{"all fine", "all fine", nil},
+		{"darn meh", "**** meh", []Decision{
+			{Filter: "blocklist", Action: ActionMask, Rule: "darn"},
+			{Filter: "blocklist", Action: ActionFlag, Rule: "meh"},
+		}},
+		{"darn scam never", "**** scam never", []Decision{
+			{Filter: "blocklist", Action: ActionMask, Rule: "darn"},
+			{Filter: "blocklist", Action: ActionReject, Rule: "scam"},
+		}},
+	}
+
+	for _, tt := range tests {
+		got, decisions := f.Apply(tt.text)
+		if got != tt.want {
+			t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+		if !reflect.DeepEqual(decisions, tt.decisions) {
+			t.Errorf("Apply(%q) decisions = %v, want %v", tt.text, decisions, tt.decisions)
+		}
+	}
+}
+
+func TestNewBlocklistFilterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule BlocklistRule
+	}{
+		{"unknown action", BlocklistRule{Pattern: "bad", Action: "delete"}},
+		{"rewrite action", BlocklistRule{Pattern: "bad", Action: ActionRewrite}},
+		{"invalid regex", BlocklistRule{Pattern: "(bad", Regex: true, Action: ActionMask}},
+		{"empty word", BlocklistRule{Pattern: "", Action: ActionMask}},
+		{"blank word", BlocklistRule{Pattern: "  ", Action: ActionMask}},
+		{"empty regex", BlocklistRule{Pattern: "", Regex: true, Action: ActionMask}},
+		{"regex matching empty text", BlocklistRule{Pattern: "a*", Regex: true, Action: ActionReject}},
+		{"optional regex", BlocklistRule{Pattern: "(bad)?", Regex: true, Action: ActionReject}},
+		{"anchor only", BlocklistRule{Pattern: "^", Regex: true, Action: ActionFlag}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewBlocklistFilter([]BlocklistRule{tt.rule}); err == nil {
+			t.Errorf("%s: NewBlocklistFilter succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestInvisibleFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+		rule string
+	}{
+		{"plain text", "hello there", "hello there", ""},
+		{"zero-width space", "b\u200bad", "bad", "1 removed"},
+		{"non-joiner in latin", "b\u200cad", "bad", "1 removed"},
+		{"non-joiner in persian", "می\u200cخواهم", "می\u200cخواهم", ""},
+		{"non-joiner after a virama", "क्\u200cष", "क्\u200cष", ""},
+		{"non-joiner at the end of a persian word", "می\u200c ", "می ", "1 removed"},
+		{"soft hyphen", "b\u00adad", "bad", "1 removed"},
+		{"direction override", "\u202egnp.exe", "gnp.exe", "1 removed"},
+		{"byte order mark", "\ufeffhi", "hi", "1 removed"},
+		{"control characters", "a\x00b\x1bc", "abc", "2 removed"},
+		{"newlines and tabs stay", "a\nb\tc", "a\nb\tc", ""},
+		{"joiner in emoji", "👩\u200d💻", "👩\u200d💻", ""},
+		{"joiner after a skin tone", "👩🏽\u200d💻", "👩🏽\u200d💻", ""},
+		{"joiner after a presentation selector", "❤\ufe0f\u200d🔥", "❤\ufe0f\u200d🔥", ""},
+		{"rainbow flag", "🏳\ufe0f\u200d🌈", "🏳\ufe0f\u200d🌈", ""},
+		{"joiner after emoji before a letter", "👩\u200dbad", "👩bad", "1 removed"},
+		{"joiner between letters", "b\u200dad", "bad", "1 removed"},
+		{"joiner in malayalam", "ന്\u200d", "ന്", "1 removed"},
+		{"joiner between malayalam letters", "ന്\u200dക", "ന്\u200dക", ""},
+	}
+
+	f := NewInvisibleFilter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, decisions := f.Apply(tt.text)
+			if got != tt.want {
+				t.Errorf("Apply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+
+			var rule string
+			if len(decisions) > 0 {
+				rule = decisions[0].Rule
+			}
+			if rule != tt.rule {
+				t.Errorf("Apply(%q) rule = %q, want %q", tt.text, rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestPipelineHidesNothingFromBlocklist(t *testing.T) {
+	blocklist, err := NewBlocklistFilter([]BlocklistRule{{Pattern: "bad", Action: ActionReject}})
+	if err != nil {
+		t.Fatalf("NewBlocklistFilter: %v", err)
+	}
+	p := NewPipeline(NewInvisibleFilter(), NewNormalizeFilter(), blocklist)
+
+	for _, text := range []string{"b\u200bad", "ｂａｄ", "𝐛𝐚𝐝", "B\u00adAD"} {
+		if _, err := p.Apply(text); err == nil {
+			t.Errorf("Apply(%q) passed, want it rejected", text)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Package keys deals with the keyset used to sign and verify tokens
+package keys
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LegacyKeyID = "legacy"
+
+	// propagationDelay keeps a new key out of signing until every server
+	// instance has reloaded the keyset and can verify it.
+	propagationDelay = 2 * time.Minute
+	// retention is how long a replaced key stays around for verification,
+	// it must outlive the longest access token signed with it.
+	retention = time.Hour
+
+	reloadInterval = time.Minute
+)
+
+var ErrNoKeys = errors.New("no signing keys found")
+
+type Key struct {
+	ID         string
+	Algorithm  string
+	CreatedAt  time.Time
+	PrivateKey crypto.Signer
+	PublicKey  crypto.PublicKey
+}
+
+// Set holds every key that is still trusted. Keys live in dir as PEM files
+// named after their key ID, which starts with the creation time. New keys
+// are generated with alg, existing keys keep the algorithm of their type.
+type Set struct {
+	dir          string
+	alg          string
+	legacyPriv   string
+	legacyPublic string
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+func Load(dir, alg, legacyPrivatePath, legacyPublicPath string) (*Set, error) {
+	if err := ValidateAlgorithm(alg); err != nil {
+		return nil, err
+	}
+
+	s := &Set{
+		dir:          dir,
+		alg:          alg,
+		legacyPriv:   legacyPrivatePath,
+		legacyPublic: legacyPublicPath,
+	}
+
+	// An empty keyset is not an error here so the admin command can create
+	// the first key, the server refuses to start without one.
+	if err := s.Reload(); err != nil && !errors.Is(err, ErrNoKeys) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload rereads the keys from disk. An empty directory leaves the current
+// keys in place.
+func (s *Set) Reload() error {
+	keys, err := readDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if legacy, err := s.loadLegacy(); err == nil {
+		keys = append(keys, legacy)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+
+	slices.SortFunc(keys, func(a, b *Key) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SigningKey returns the newest key that every instance had time to pick
+// up, or the newest key when none is old enough.
+func (s *Set) SigningKey() *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cutoff := time.Now().Add(-propagationDelay)
+	for _, k := range s.keys {
+		if k.PrivateKey != nil && !k.CreatedAt.After(cutoff) {
+			return k
+		}
+	}
+
+	for _, k := range s.keys {
+		if k.PrivateKey != nil {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// Lookup finds a verification key. Tokens issued before key IDs were
+// introduced have none and are checked against the legacy key.
+func (s *Set) Lookup(kid string) (*Key, bool) {
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *Set) Keys() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.keys)
+}
+
+// Rotate writes a new key and deletes keys that were replaced long enough
+// ago that no token signed with them is still valid.
+func (s *Set) Rotate() (*Key, error) {
+	k, err := Generate(s.dir, s.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (s *Set) prune() error {
+	keys := s.Keys()
+
+	for i := 1; i < len(keys); i++ {
+		replacedAt := keys[i-1].CreatedAt.Add(propagationDelay)
+		if time.Since(replacedAt) < retention || keys[i].ID == LegacyKeyID {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, keys[i].ID+".pem")); err != nil {
+			return err
+		}
+		log.Printf("keys: removed retired key %s", keys[i].ID)
+	}
+
+	return s.Reload()
+}
+
+// Run reloads the keyset so rotations by other instances or the admin
+// command are picked up, and rotates once the signing key is older than
+// rotateEvery. A zero rotateEvery leaves rotation to the admin command.
+func (s *Set) Run(ctx context.Context, rotateEvery time.Duration) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Printf("keys: failed to reload keyset, %v", err)
+			continue
+		}
+
+		if rotateEvery <= 0 {
+			continue
+		}
+
+		newest := s.Keys()[0]
+		if time.Since(newest.CreatedAt) < rotateEvery {
+			continue
+		}
+
+		k, err := s.Rotate()
+		if err != nil {
+			log.Printf("keys: failed to rotate keys, %v", err)
+			continue
+		}
+		log.Printf("keys: rotated signing key, new key %s", k.ID)
+	}
+}
+
+func readDir(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var keys []*Key
+	for _, entry := range entries {
+		kid, ok := strings.CutSuffix(entry.Name(), ".pem")
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		createdStr, _, _ := strings.Cut(kid, "-")
+		created, err := strconv.ParseInt(createdStr, 10, 64)
+		if err != nil {
+			log.Printf("keys: skipping %s, key id must start with a unix time", entry.Name())
+			continue
+		}
+
+		privateKey, alg, err := loadPrivateKey(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("keys: error loading key, %v", err)
+		}
+
+		keys = append(keys, &Key{
+			ID:         kid,
+			Algorithm:  alg,
+			CreatedAt:  time.Unix(created, 0).UTC(),
+			PrivateKey: privateKey,
+			PublicKey:  privateKey.Public(),
+		})
+	}
+
+	return keys, nil
+}
+
+// loadLegacy reads the single key pair used before key rotation, it keeps
+// signing until a newer key exists and verifies tokens without a kid.
+func (s *Set) loadLegacy() (*Key, error) {
+	publicKey, err := loadPublicKey(s.legacyPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, alg, err := loadPrivateKey(s.legacyPriv)
+	if err != nil {
+		return nil, err
+	}
+
+	if !privateKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(publicKey) {
+		return nil, fmt.Errorf("keys: %s does not match %s", s.legacyPublic, s.legacyPriv)
+	}
+
+	return &Key{
+		ID:         LegacyKeyID,
+		Algorithm:  alg,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}, nil
+}
@@ -0,0 +1,192 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm, use RS256, ES256 or EdDSA")
+	ErrUnsupportedKey       = errors.New("unsupported key type, use RSA, ECDSA P-256 or Ed25519")
+	ErrNoPEMBlock           = errors.New("no PEM block found")
+)
+
+func ValidateAlgorithm(alg string) error {
+	switch alg {
+	case RS256, ES256, EdDSA:
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
+
+// Generate creates a key for alg in dir and returns it.
+func Generate(dir, alg string) (*Key, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch alg {
+	case RS256:
+		privateKey, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case ES256:
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, privateKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	k := &Key{
+		ID:         fmt.Sprintf("%d-%s", now.Unix(), hex.EncodeToString(suffix)),
+		Algorithm:  alg,
+		CreatedAt:  now.Truncate(time.Second),
+		PrivateKey: privateKey,
+		PublicKey:  privateKey.Public(),
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, k.ID+".pem"), data, 0o600); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// EncodePublicKey returns the PKIX PEM form of a public key, for services
+// that want a static key instead of the JWKS endpoint.
+func EncodePublicKey(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key, alg, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+
+	return key, alg, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", ErrNoPEMBlock
+	}
+
+	var parsed any
+	var err error
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, "", fmt.Errorf("unexpected PEM block %q, want a private key", block.Type)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed %s, %v", block.Type, err)
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, "", ErrUnsupportedKey
+	}
+
+	alg, err := algorithmFor(signer.Public())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return signer, alg, nil
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: %v", path, ErrNoPEMBlock)
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: unexpected PEM block %q, want a public key", path, block.Type)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: malformed public key, %v", path, err)
+	}
+
+	if _, err := algorithmFor(key); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return key, nil
+}
+
+func algorithmFor(publicKey crypto.PublicKey) (string, error) {
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return ES256, nil
+		}
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	}
+
+	return "", ErrUnsupportedKey
+}
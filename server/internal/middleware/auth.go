@@ -2,22 +2,35 @@
 package middleware
 
 import (
+	"chatter/server/internal/keys"
 	"chatter/server/internal/user"
 	"context"
-	"crypto/rsa"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-type contextKey string
+const UserKey = user.ClaimsKey
 
-const UserKey contextKey = "user"
+type RevocationChecker interface {
+	IsRevoked(ctx context.Context, claims *user.CustomClaims) (bool, error)
+}
+
+// Authenticator checks JWTs for revocation and turns personal access
+// tokens into claims, user.Service implements it.
+type Authenticator interface {
+	RevocationChecker
+	AuthenticateAccessToken(ctx context.Context, token, ip string) (*user.CustomClaims, error)
+}
 
-func Auth(publicKey *rsa.PublicKey) func(http.Handler) http.Handler {
+// Auth accepts a JWT or a personal access token, the latter told apart by
+// user.AccessTokenPrefix.
+func Auth(keySet *keys.Set, authenticator Authenticator) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var tokenStr string
@@ -31,13 +44,36 @@ func Auth(publicKey *rsa.PublicKey) func(http.Handler) http.Handler {
 				return
 			}
 
-			claims, err := parseJWT(tokenStr, publicKey)
+			if strings.HasPrefix(tokenStr, user.AccessTokenPrefix) {
+				claims, err := authenticator.AuthenticateAccessToken(r.Context(), tokenStr, remoteIP(r))
+				if err != nil {
+					writeAccessTokenError(w, err)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), UserKey, claims)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			claims, err := parseJWT(tokenStr, keySet)
 			if err != nil {
 				log.Printf("middleware: %v", err)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
+			revoked, err := authenticator.IsRevoked(r.Context(), claims)
+			if err != nil {
+				log.Printf("middleware: failed to check token revocation, %v", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "Unauthorized: token revoked", http.StatusUnauthorized)
+				return
+			}
+
 			ctx := context.WithValue(r.Context(), UserKey, claims)
 
 			next.ServeHTTP(w, r.WithContext(ctx))
@@ -45,6 +81,27 @@ func Auth(publicKey *rsa.PublicKey) func(http.Handler) http.Handler {
 	}
 }
 
+func writeAccessTokenError(w http.ResponseWriter, err error) {
+	var sanctioned *user.SanctionError
+	switch {
+	case errors.Is(err, user.ErrInvalidAccessToken):
+		http.Error(w, "Unauthorized: invalid access token", http.StatusUnauthorized)
+	case errors.As(err, &sanctioned):
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("middleware: failed to check access token, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 func extractTokenFromHeader(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
@@ -58,13 +115,20 @@ func extractTokenFromHeader(r *http.Request) string {
 	return parts[1]
 }
 
-func parseJWT(tokenStr string, publicKey *rsa.PublicKey) (*user.CustomClaims, error) {
+func parseJWT(tokenStr string, keySet *keys.Set) (*user.CustomClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &user.CustomClaims{}, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keySet.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("middleware: unknown signing key, %q", kid)
+		}
+
+		// The key decides the algorithm, never the token header.
+		if t.Method.Alg() != key.Algorithm {
 			return nil, fmt.Errorf("middleware: unexpected signing method, %v", t.Header["alg"])
 		}
 
-		return publicKey, nil
+		return key.PublicKey, nil
 	})
 
 	if err != nil || !token.Valid {
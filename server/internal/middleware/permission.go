@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"chatter/server/internal/user"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// RequirePermission lets the request through when the token's role has p.
+// Routes with a {room} parameter are checked against the role in that room,
+// others against the global role. It goes after Auth.
+func RequirePermission(p user.Permission) func(http.Handler) http.Handler {
+	return requirePermission(p, func(r *http.Request) string {
+		return chi.URLParam(r, "room")
+	})
+}
+
+// RequireRoomPermission is RequirePermission for routes that act on a
+// fixed room.
+func RequireRoomPermission(room string, p user.Permission) func(http.Handler) http.Handler {
+	return requirePermission(p, func(*http.Request) string {
+		return room
+	})
+}
+
+func requirePermission(p user.Permission, room func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := user.ClaimsFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.Can(p, room(r)) {
+				http.Error(w, "Forbidden: missing permission "+string(p), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
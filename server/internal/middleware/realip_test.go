@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct client", "203.0.113.7:4000", nil, "203.0.113.7:4000"},
+		{"untrusted peer can't forward", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7:4000"},
+		{"trusted proxy", "10.0.0.2:4000", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"spoofed hops left of the client", "10.0.0.2:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1:0"},
+		{"chain of trusted proxies", "10.0.0.2:4000", []string{"198.51.100.1, 10.0.0.3", "10.0.0.4"}, "198.51.100.1:0"},
+		{"ipv6 proxy", "[::1]:4000", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"mapped ipv4", "10.0.0.2:4000", []string{"::ffff:198.51.100.1"}, "198.51.100.1:0"},
+		{"only trusted hops", "10.0.0.2:4000", []string{"10.0.0.3"}, "10.0.0.2:4000"},
+		{"no header", "10.0.0.2:4000", nil, "10.0.0.2:4000"},
+		{"malformed hop", "10.0.0.2:4000", []string{"198.51.100.1, bogus"}, "10.0.0.2:4000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
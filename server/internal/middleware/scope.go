@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"chatter/server/internal/user"
+	"net/http"
+)
+
+// RequireScope lets a personal access token through only when it was
+// given s. Logged in users have every scope. It goes after Auth.
+func RequireScope(s user.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := user.ClaimsFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.HasScope(s) {
+				http.Error(w, "Forbidden: missing scope "+string(s), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NoAccessTokens turns away personal access tokens, for routes that only a
+// logged in user may use such as account settings. It goes after Auth.
+func NoAccessTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := user.ClaimsFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if claims.IsAccessToken() {
+			http.Error(w, "Forbidden: not available to access tokens", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"chatter/server/internal/user"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var (
+	sessionClaims = &user.CustomClaims{UserID: "u1", SessionID: "s1"}
+	historyToken  = &user.CustomClaims{UserID: "u1", AccessTokenID: "t1", Scopes: []user.Scope{user.ScopeReadHistory}}
+	sendToken     = &user.CustomClaims{UserID: "u1", AccessTokenID: "t2", Scopes: []user.Scope{user.ScopeReadHistory, user.ScopeSendMessages}}
+	noScopeToken  = &user.CustomClaims{UserID: "u1", AccessTokenID: "t3"}
+)
+
+// serve runs h behind middleware with claims in the request context, nil
+// claims leave the request unauthenticated.
+func serve(middleware func(http.Handler) http.Handler, claims *user.CustomClaims) int {
+	h := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if claims != nil {
+		r = r.WithContext(context.WithValue(r.Context(), user.ClaimsKey, claims))
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scope  user.Scope
+		claims *user.CustomClaims
+		want   int
+	}{
+		{"unauthenticated", user.ScopeReadHistory, nil, http.StatusUnauthorized},
+		{"session has every scope", user.ScopeManageRooms, sessionClaims, http.StatusNoContent},
+		{"token with the scope", user.ScopeReadHistory, historyToken, http.StatusNoContent},
+		{"token without the scope", user.ScopeSendMessages, historyToken, http.StatusForbidden},
+		{"token with several scopes", user.ScopeSendMessages, sendToken, http.StatusNoContent},
+		{"token with several scopes but not this one", user.ScopeManageRooms, sendToken, http.StatusForbidden},
+		{"token without scopes", user.ScopeReadHistory, noScopeToken, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(RequireScope(tt.scope), tt.claims); got != tt.want {
+				t.Errorf("RequireScope(%s) = %d, want %d", tt.scope, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoAccessTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims *user.CustomClaims
+		want   int
+	}{
+		{"unauthenticated", nil, http.StatusUnauthorized},
+		{"session", sessionClaims, http.StatusNoContent},
+		{"token", sendToken, http.StatusForbidden},
+		{"token without scopes", noScopeToken, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serve(NoAccessTokens, tt.claims); got != tt.want {
+				t.Errorf("NoAccessTokens = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
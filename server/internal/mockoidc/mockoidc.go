@@ -0,0 +1,215 @@
+// Package mockoidc is a minimal OpenID Connect provider for testing single
+// sign-on. It accepts any client and logs in whoever types a name.
+package mockoidc
+
+import (
+	"chatter/server/internal/keys"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const codeExpirationTime = time.Minute
+
+type grant struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	username      string
+	expiresAt     time.Time
+}
+
+// Provider serves discovery, the authorization and token endpoints and
+// its keys.
+type Provider struct {
+	issuer string
+	keys   *keys.Set
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// New signs ID tokens with the signing key of keySet, issuer is the URL
+// the provider is reachable at.
+func New(issuer string, keySet *keys.Set) *Provider {
+	return &Provider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		keys:   keySet,
+		grants: make(map[string]grant),
+	}
+}
+
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// Handler routes the provider's endpoints.
+func (p *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /authorize", p.handleAuthorize)
+	mux.HandleFunc("POST /token", p.handleToken)
+	mux.HandleFunc("GET /jwks", p.keys.ServeJWKS)
+
+	return mux
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!doctype html>
+<title>Mock OIDC login</title>
+<form method="get" action="/authorize">
+  {{range $k, $v := .}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+  {{end}}<label>Username <input name="username" autofocus></label>
+  <button>Log in</button>
+</form>
+`))
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{keys.RS256},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// handleAuthorize shows a login form, or with a username (from the form or
+// login_hint) redirects straight back with a code.
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	redirectURI := q.Get("redirect_uri")
+	if q.Get("response_type") != "code" || q.Get("client_id") == "" || redirectURI == "" {
+		http.Error(w, "response_type=code, client_id and redirect_uri are required", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	username := q.Get("username")
+	if username == "" {
+		username = q.Get("login_hint")
+	}
+	if username == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		loginPage.Execute(w, q)
+		return
+	}
+
+	code := randomString()
+	p.mu.Lock()
+	p.grants[code] = grant{
+		clientID:      q.Get("client_id"),
+		redirectURI:   redirectURI,
+		codeChallenge: q.Get("code_challenge"),
+		nonce:         q.Get("nonce"),
+		username:      username,
+		expiresAt:     time.Now().Add(codeExpirationTime),
+	}
+	p.mu.Unlock()
+
+	params := url.Values{}
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	http.Redirect(w, r, redirectURI+"?"+params.Encode(), http.StatusFound)
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	clientID, _, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+	}
+
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	g, ok := p.grants[code]
+	delete(p.grants, code)
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(g.expiresAt) || g.clientID != clientID || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(g.codeChallenge)) != 1 {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	key := p.keys.SigningKey()
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), jwt.MapClaims{
+		"iss":                p.issuer,
+		"sub":                "mock-" + g.username,
+		"aud":                g.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+		"name":               g.username,
+		"email":              g.username + "@example.com",
+		"email_verified":     true,
+	})
+	token.Header["kid"] = key.ID
+
+	idToken, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		log.Printf("Error signing id token, %v", err)
+		tokenError(w, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,20 @@
+// Package notify deals with reaching users outside the chat, such as
+// password reset mails
+package notify
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNoRecipient = errors.New("message has no recipient")
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Notifier interface {
+	Send(ctx context.Context, m Message) error
+}
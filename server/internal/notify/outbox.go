@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+// Outbox writes every message as a .eml file instead of sending it, for
+// development and tests.
+type Outbox struct {
+	dir string
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("notify: failed to create outbox, %v", err)
+	}
+
+	return &Outbox{dir: dir}, nil
+}
+
+func (o *Outbox) Send(ctx context.Context, m Message) error {
+	if m.To == "" {
+		return ErrNoRecipient
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), unsafeFileChars.ReplaceAllString(m.To, "_"))
+	data := formatMail("chatter <noreply@localhost>", m)
+
+	if err := os.WriteFile(filepath.Join(o.dir, name), data, 0o600); err != nil {
+		return fmt.Errorf("notify: failed to write %s, %v", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AccessTokenPrefix tells personal access tokens apart from JWTs.
+	AccessTokenPrefix = "chp_"
+
+	maxAccessTokens          = 20
+	maxAccessTokenNameLength = 64
+	// accessTokenTouchInterval spares a write on every request, the last use
+	// of a token is only this exact.
+	accessTokenTouchInterval = time.Minute
+)
+
+// Scope is what a personal access token may be used for. Logged in users
+// have every scope.
+type Scope string
+
+const (
+	ScopeReadHistory  Scope = "history:read"
+	ScopeSendMessages Scope = "messages:send"
+	ScopeManageRooms  Scope = "rooms:manage"
+)
+
+var (
+	ErrInvalidAccessToken  = errors.New("invalid access token")
+	ErrAccessTokenNotFound = errors.New("access token not found")
+	ErrAccessTokenName     = errors.New("token name must be 1 to 64 characters")
+	ErrInvalidScope        = errors.New("scopes must be one or more of history:read, messages:send and rooms:manage")
+	ErrAccessTokenExpiry   = errors.New("token lifetime can't be negative")
+	ErrTooManyAccessTokens = errors.New("too many access tokens, revoke one first")
+)
+
+func ParseScope(s string) (Scope, error) {
+	switch Scope(s) {
+	case ScopeReadHistory, ScopeSendMessages, ScopeManageRooms:
+		return Scope(s), nil
+	}
+	return "", ErrInvalidScope
+}
+
+// AccessToken is the stored side of a personal access token, the token
+// itself is only kept as a hash. Hint is its last characters, to tell
+// tokens apart in a list.
+type AccessToken struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []Scope   `json:"scopes"`
+	Hint       string    `json:"hint"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+	LastUsedIP string    `json:"last_used_ip,omitempty"`
+}
+
+// NewAccessToken is a token just created, the only time Token is shown.
+type NewAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
+
+// AccessTokenRequest creates a token, Duration zero for one that lasts
+// until revoked.
+type AccessTokenRequest struct {
+	Name     string
+	Scopes   []Scope
+	Duration time.Duration
+}
+
+// IsAccessToken tells whether the claims come from a personal access token
+// rather than a login.
+func (c *CustomClaims) IsAccessToken() bool {
+	return c.AccessTokenID != ""
+}
+
+func (c *CustomClaims) HasScope(s Scope) bool {
+	return !c.IsAccessToken() || slices.Contains(c.Scopes, s)
+}
+
+// CreateAccessToken gives the logged in user a token for their scripts.
+func (s *Service) CreateAccessToken(ctx context.Context, claims *CustomClaims, req AccessTokenRequest) (*NewAccessToken, error) {
+	return s.createAccessToken(ctx, claims.UserID, claims.UserID, req)
+}
+
+func (s *Service) ListAccessTokens(ctx context.Context, userID string) ([]AccessToken, error) {
+	tokens, err := s.repo.ListAccessTokens(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to list access tokens, %v", err)
+	}
+	return tokens, nil
+}
+
+// RevokeAccessToken deletes one of the user's tokens and drops the
+// WebSockets opened with it.
+func (s *Service) RevokeAccessToken(ctx context.Context, userID, id string) error {
+	if err := s.repo.DeleteAccessToken(ctx, userID, id); err != nil {
+		if errors.Is(err, ErrAccessTokenNotFound) {
+			return err
+		}
+		return fmt.Errorf("user: failed to revoke access token, %v", err)
+	}
+
+	s.publishSessionRevoked(ctx, userID, id)
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionTokenRevoke,
+		TargetID: userID,
+		Details:  map[string]string{"token_id": id},
+	})
+
+	return nil
+}
+
+func (s *Service) createAccessToken(ctx context.Context, userID, createdBy string, req AccessTokenRequest) (*NewAccessToken, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > maxAccessTokenNameLength {
+		return nil, ErrAccessTokenName
+	}
+	if len(req.Scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+	for _, scope := range req.Scopes {
+		if _, err := ParseScope(string(scope)); err != nil {
+			return nil, err
+		}
+	}
+	if req.Duration < 0 {
+		return nil, ErrAccessTokenExpiry
+	}
+
+	existing, err := s.ListAccessTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= maxAccessTokens {
+		return nil, ErrTooManyAccessTokens
+	}
+
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("user: error generating access token: %v", err)
+	}
+	token := AccessTokenPrefix + secret
+
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	now := time.Now().UTC()
+	t := AccessToken{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Name:      req.Name,
+		Scopes:    slices.Compact(scopes),
+		Hint:      token[len(token)-4:],
+		CreatedBy: createdBy,
+		CreatedAt: now,
+	}
+	if req.Duration > 0 {
+		t.ExpiresAt = now.Add(req.Duration)
+	}
+
+	if err := s.repo.CreateAccessToken(ctx, &t, hashToken(token)); err != nil {
+		return nil, fmt.Errorf("user: failed to store access token, %v", err)
+	}
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionTokenCreate,
+		ActorID:  createdBy,
+		TargetID: userID,
+		Details: map[string]string{
+			"token_id": t.ID,
+			"name":     t.Name,
+			"scopes":   joinScopes(t.Scopes),
+			"duration": req.Duration.String(),
+		},
+	})
+
+	return &NewAccessToken{AccessToken: t, Token: token}, nil
+}
+
+// AuthenticateAccessToken turns a personal access token into claims
+// carrying its scopes, with the roles the user has now. The token ID
+// stands in for the session, revoking the token ends its WebSockets.
+func (s *Service) AuthenticateAccessToken(ctx context.Context, token, ip string) (*CustomClaims, error) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	t, err := s.repo.GetAccessTokenByHash(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, ErrAccessTokenNotFound) {
+			return nil, ErrInvalidAccessToken
+		}
+		return nil, fmt.Errorf("user: failed to load access token, %v", err)
+	}
+
+	now := time.Now().UTC()
+	if !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt) {
+		return nil, ErrInvalidAccessToken
+	}
+
+	u, err := s.repo.GetUserByID(ctx, t.UserID)
+	if err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+	if err := s.checkBan(ctx, u.ID, ip); err != nil {
+		return nil, err
+	}
+
+	roomRoles, err := s.repo.GetRoomRoles(ctx, u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to load room roles, %v", err)
+	}
+
+	if now.Sub(t.LastUsedAt) >= accessTokenTouchInterval {
+		if err := s.repo.TouchAccessToken(ctx, t.ID, now, ip); err != nil && !errors.Is(err, ErrAccessTokenNotFound) {
+			log.Printf("user: failed to record access token use, %v", err)
+		}
+	}
+
+	return &CustomClaims{
+		UserID:        u.ID,
+		Username:      u.Username,
+		SessionID:     t.ID,
+		Role:          u.Role,
+		RoomRoles:     roomRoles,
+		RolesVersion:  u.RolesVersion,
+		AccessTokenID: t.ID,
+		Scopes:        t.Scopes,
+	}, nil
+}
+
+func joinScopes(scopes []Scope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,225 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// accessTokenRequest takes how long the token lasts as "720h", empty for
+// one that lasts until revoked.
+type accessTokenRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"`
+}
+
+type accessTokensResponse struct {
+	Tokens []AccessToken `json:"tokens"`
+}
+
+type botRequest struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+type botsResponse struct {
+	Bots []User `json:"bots"`
+}
+
+func (h *Handler) handleListAccessTokens(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	tokens, err := h.service.ListAccessTokens(r.Context(), claims.UserID)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(accessTokensResponse{Tokens: tokens})
+}
+
+func (h *Handler) handleCreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	req, ok := decodeAccessTokenRequest(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := h.service.CreateAccessToken(r.Context(), claims, req)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (h *Handler) handleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.service.RevokeAccessToken(r.Context(), claims.UserID, chi.URLParam(r, "id")); err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleListBots(w http.ResponseWriter, r *http.Request) {
+	bots, err := h.service.ListBots(r.Context())
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(botsResponse{Bots: bots})
+}
+
+func (h *Handler) handleCreateBot(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req botRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	bot, err := h.service.CreateBot(r.Context(), claims, req.Username, req.DisplayName)
+	if err != nil {
+		switch {
+		case isValidationError(err):
+			writeValidationErrors(w, err)
+		case errors.Is(err, ErrDisplayNameLength):
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrUsernameAlreadyExists):
+			writeJSONError(w, http.StatusConflict, err.Error())
+		default:
+			log.Printf("internal server error creating bot, %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bot)
+}
+
+func (h *Handler) handleListBotTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := h.service.ListBotTokens(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(accessTokensResponse{Tokens: tokens})
+}
+
+func (h *Handler) handleCreateBotToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	req, ok := decodeAccessTokenRequest(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := h.service.CreateBotToken(r.Context(), claims, chi.URLParam(r, "id"), req)
+	if err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (h *Handler) handleRevokeBotToken(w http.ResponseWriter, r *http.Request) {
+	if err := h.service.RevokeBotToken(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "tokenID")); err != nil {
+		writeAccessTokenError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeAccessTokenRequest answers the request itself when the body is
+// malformed.
+func decodeAccessTokenRequest(w http.ResponseWriter, r *http.Request) (AccessTokenRequest, bool) {
+	var req accessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return AccessTokenRequest{}, false
+	}
+
+	var duration time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.ExpiresIn); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid duration")
+			return AccessTokenRequest{}, false
+		}
+	}
+
+	scopes := make([]Scope, len(req.Scopes))
+	for i, s := range req.Scopes {
+		scopes[i] = Scope(s)
+	}
+
+	return AccessTokenRequest{Name: req.Name, Scopes: scopes, Duration: duration}, true
+}
+
+func writeAccessTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrAccessTokenName),
+		errors.Is(err, ErrInvalidScope),
+		errors.Is(err, ErrAccessTokenExpiry):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrTooManyAccessTokens):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrAccessTokenNotFound),
+		errors.Is(err, ErrNotBot),
+		errors.Is(err, ErrUserNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("internal server error managing access tokens, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+	}
+}
@@ -0,0 +1,249 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+type rolesResponse struct {
+	Roles []RoleAssignment `json:"roles"`
+}
+
+// sanctionRequest takes the duration as "30m" or "24h", empty for one that
+// lasts until lifted.
+type sanctionRequest struct {
+	UserID   string `json:"user_id"`
+	Kind     string `json:"kind"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+	IP       bool   `json:"ip"`
+}
+
+type sanctionsResponse struct {
+	Sanctions []Sanction `json:"sanctions"`
+}
+
+// SanctionResponse is the body of a request a sanction blocks.
+type SanctionResponse struct {
+	Message string    `json:"message"`
+	Reason  string    `json:"reason,omitempty"`
+	Until   time.Time `json:"until,omitzero"`
+}
+
+// AdminRoutes serves role management, moderation and bots. require builds the
+// permission check, middleware.RequirePermission in the server, the routes
+// expect to be mounted behind auth.
+func (h *Handler) AdminRoutes(require func(Permission) func(http.Handler) http.Handler) chi.Router {
+	r := chi.NewRouter()
+
+	r.Group(func(r chi.Router) {
+		r.Use(require(PermManageRoles))
+
+		r.Get("/roles", h.handleListRoles)
+		r.Put("/users/{id}/role", h.handleSetRole)
+		r.Delete("/users/{id}/role", h.handleRemoveRole)
+		r.Get("/rooms/{room}/roles", h.handleListRoles)
+		r.Put("/rooms/{room}/users/{id}/role", h.handleSetRole)
+		r.Delete("/rooms/{room}/users/{id}/role", h.handleRemoveRole)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(require(PermModerate))
+
+		r.Get("/sanctions", h.handleListSanctions)
+		r.Post("/sanctions", h.handleSanction)
+		r.Delete("/sanctions/{id}", h.handleLiftSanction)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(require(PermManageBots))
+
+		r.Get("/bots", h.handleListBots)
+		r.Post("/bots", h.handleCreateBot)
+		r.Get("/bots/{id}/tokens", h.handleListBotTokens)
+		r.Post("/bots/{id}/tokens", h.handleCreateBotToken)
+		r.Delete("/bots/{id}/tokens/{tokenID}", h.handleRevokeBotToken)
+	})
+
+	return r
+}
+
+func (h *Handler) handleListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.service.ListRoles(r.Context(), chi.URLParam(r, "room"))
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rolesResponse{Roles: roles})
+}
+
+func (h *Handler) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req roleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	role, err := ParseRole(req.Role)
+	if err == nil {
+		err = h.service.SetRole(r.Context(), claims, chi.URLParam(r, "id"), chi.URLParam(r, "room"), role)
+	}
+	if err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRemoveRole makes the user a member again, or drops their role in
+// the room so their global role applies there.
+func (h *Handler) handleRemoveRole(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	room := chi.URLParam(r, "room")
+	var role Role
+	if room == "" {
+		role = RoleMember
+	}
+
+	if err := h.service.SetRole(r.Context(), claims, chi.URLParam(r, "id"), room, role); err != nil {
+		writeRoleError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleListSanctions(w http.ResponseWriter, r *http.Request) {
+	sanctions, err := h.service.ListSanctions(r.Context(), r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeSanctionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sanctionsResponse{Sanctions: sanctions})
+}
+
+func (h *Handler) handleSanction(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req sanctionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.Duration); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid duration")
+			return
+		}
+	}
+
+	sanction, err := h.service.Sanction(r.Context(), claims, SanctionRequest{
+		Kind:     SanctionKind(req.Kind),
+		UserID:   req.UserID,
+		Reason:   req.Reason,
+		Duration: duration,
+		ByIP:     req.IP,
+	})
+	if err != nil {
+		writeSanctionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sanction)
+}
+
+func (h *Handler) handleLiftSanction(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.service.LiftSanction(r.Context(), claims, chi.URLParam(r, "id")); err != nil {
+		writeSanctionError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WriteSanctioned tells a sanctioned user why and until when, for logins
+// and anything else a sanction blocks.
+func WriteSanctioned(w http.ResponseWriter, err *SanctionError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(SanctionResponse{
+		Message: err.Error(),
+		Reason:  err.Sanction.Reason,
+		Until:   err.Sanction.ExpiresAt,
+	})
+}
+
+func writeSanctionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidSanction),
+		errors.Is(err, ErrSanctionReason),
+		errors.Is(err, ErrSanctionDuration),
+		errors.Is(err, ErrSanctionIPBan):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrSanctionForbidden), errors.Is(err, ErrSanctionSelf):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrSanctionNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("internal server error during moderation, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+	}
+}
+
+func writeRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidRole), errors.Is(err, ErrInvalidRoom):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrRoleForbidden), errors.Is(err, ErrRoleSelf):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrUserNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("internal server error managing roles, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+	}
+}
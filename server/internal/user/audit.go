@@ -0,0 +1,86 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+)
+
+// Login methods, as recorded with auth.login.
+const (
+	loginMethodPassword = "password"
+	loginMethodTOTP     = "totp"
+	loginMethodOIDC     = "oidc"
+)
+
+// AuditLog records security and moderation events, audit.Log implements
+// it.
+type AuditLog interface {
+	Record(ctx context.Context, e audit.Entry)
+}
+
+func (s *Service) SetAuditLog(l AuditLog) {
+	s.audit = l
+}
+
+// record fills in the logged in user as the actor when none is given.
+// Nothing is recorded without an audit log.
+func (s *Service) record(ctx context.Context, e audit.Entry) {
+	if s.audit == nil {
+		return
+	}
+	if e.ActorID == "" {
+		if claims, ok := ClaimsFromContext(ctx); ok {
+			e.ActorID = claims.UserID
+		}
+	}
+
+	s.audit.Record(ctx, e)
+}
+
+// recordResult records the outcome of an action, with the error when it
+// failed.
+func (s *Service) recordResult(ctx context.Context, e audit.Entry, err error) {
+	e.Outcome = auditOutcome(err)
+	if err != nil {
+		if e.Details == nil {
+			e.Details = map[string]string{}
+		}
+		e.Details["error"] = err.Error()
+	}
+
+	s.record(ctx, e)
+}
+
+// recordLogin records a login attempt against the account. userID is empty
+// when the name matched no user. Only a successful login names the user as
+// the actor, a failed one may well be someone else.
+func (s *Service) recordLogin(ctx context.Context, userID, username, method string, err error) {
+	details := map[string]string{"method": method}
+	if username != "" {
+		details["username"] = username
+	}
+
+	e := audit.Entry{Action: audit.ActionLogin, TargetID: userID, Details: details}
+	if err == nil {
+		e.ActorID = userID
+	}
+	s.recordResult(ctx, e, err)
+}
+
+// auditOutcome tells requests turned away by a lockout, a sanction or a
+// missing permission apart from those that failed.
+func auditOutcome(err error) audit.Outcome {
+	var throttled *LoginThrottledError
+	var sanctioned *SanctionError
+	switch {
+	case err == nil:
+		return audit.Success
+	case errors.As(err, &throttled), errors.As(err, &sanctioned),
+		errors.Is(err, ErrRoleForbidden), errors.Is(err, ErrRoleSelf),
+		errors.Is(err, ErrSanctionForbidden), errors.Is(err, ErrSanctionSelf):
+		return audit.Denied
+	default:
+		return audit.Failure
+	}
+}
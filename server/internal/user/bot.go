@@ -0,0 +1,97 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrNotBot = errors.New("user is not a bot")
+
+// CreateBot makes an account for a script, such as one posting deploy
+// notifications. It can't log in, it acts through the tokens created for
+// it with CreateBotToken.
+func (s *Service) CreateBot(ctx context.Context, actor *CustomClaims, username, displayName string) (*User, error) {
+	username = NormalizeUsername(username)
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+	displayName = strings.TrimSpace(displayName)
+	if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+		return nil, ErrDisplayNameLength
+	}
+
+	u := User{
+		Username:    username,
+		DisplayName: displayName,
+		Bot:         true,
+		OwnerID:     actor.UserID,
+	}
+	if err := s.repo.CreateUser(ctx, &u); err != nil {
+		if errors.Is(err, ErrUsernameAlreadyExists) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("user: failed to create bot, %v", err)
+	}
+	if u.DisplayName != "" {
+		if err := s.repo.UpdateProfile(ctx, &u); err != nil {
+			return nil, fmt.Errorf("user: failed to update profile, %v", err)
+		}
+	}
+
+	log.Printf("user: bot %s created by %s", u.Username, actor.UserID)
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionBotCreate,
+		ActorID:  actor.UserID,
+		TargetID: u.ID,
+		Details:  map[string]string{"username": u.Username},
+	})
+
+	return &u, nil
+}
+
+func (s *Service) ListBots(ctx context.Context) ([]User, error) {
+	bots, err := s.repo.ListBots(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to list bots, %v", err)
+	}
+	return bots, nil
+}
+
+// CreateBotToken gives a bot a token, the actor is recorded as its
+// creator.
+func (s *Service) CreateBotToken(ctx context.Context, actor *CustomClaims, botID string, req AccessTokenRequest) (*NewAccessToken, error) {
+	if err := s.checkBot(ctx, botID); err != nil {
+		return nil, err
+	}
+	return s.createAccessToken(ctx, botID, actor.UserID, req)
+}
+
+func (s *Service) ListBotTokens(ctx context.Context, botID string) ([]AccessToken, error) {
+	if err := s.checkBot(ctx, botID); err != nil {
+		return nil, err
+	}
+	return s.ListAccessTokens(ctx, botID)
+}
+
+func (s *Service) RevokeBotToken(ctx context.Context, botID, id string) error {
+	if err := s.checkBot(ctx, botID); err != nil {
+		return err
+	}
+	return s.RevokeAccessToken(ctx, botID, id)
+}
+
+func (s *Service) checkBot(ctx context.Context, id string) error {
+	u, err := s.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !u.Bot {
+		return ErrNotBot
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	erasureInterval = time.Minute
+	// erasureLockTime is how long a job is claimed by one instance, the
+	// claim is renewed at every checkpoint.
+	erasureLockTime = 5 * time.Minute
+)
+
+// ErasurePolicy decides what happens to the messages of a deleted account.
+type ErasurePolicy string
+
+const (
+	// ErasureAnonymize keeps the messages but removes who wrote them.
+	ErasureAnonymize ErasurePolicy = "anonymize"
+	// ErasureDelete removes the messages.
+	ErasureDelete ErasurePolicy = "delete"
+)
+
+type ErasureStage string
+
+const (
+	ErasureStageAccount  ErasureStage = "account"
+	ErasureStageMessages ErasureStage = "messages"
+	ErasureStageDone     ErasureStage = "done"
+)
+
+var (
+	ErrInvalidErasurePolicy = errors.New("erasure policy must be anonymize or delete")
+	ErrErasureNotFound      = errors.New("deletion receipt not found")
+	ErrErasureLocked        = errors.New("erasure job is running elsewhere")
+)
+
+// ErasureJob is the progress of an account deletion, stored so it can pick
+// up where it stopped. Once done it is the deletion receipt. Username and
+// the single sign-on identity are only kept until the account stage has
+// removed everything they point to. The receipt is public to whoever has
+// its ID, so it doesn't show whose account it was or who they talked to.
+type ErasureJob struct {
+	ID          string        `json:"id"`
+	UserID      string        `json:"-"`
+	Policy      ErasurePolicy `json:"policy"`
+	Stage       ErasureStage  `json:"stage"`
+	RequestedAt time.Time     `json:"requested_at"`
+	CompletedAt time.Time     `json:"completed_at,omitzero"`
+
+	// Conversations are erased in order, Cursor is the last message ID
+	// handled in Conversations[Index].
+	Conversations []string `json:"-"`
+	Index         int      `json:"-"`
+	Cursor        string   `json:"-"`
+	Messages      int      `json:"messages"`
+
+	Username    string `json:"-"`
+	OIDCIssuer  string `json:"-"`
+	OIDCSubject string `json:"-"`
+}
+
+// MessageStore is the chat side of deleting and exporting an account, the
+// chat service implements it.
+type MessageStore interface {
+	// UserConversations lists every conversation the user wrote in.
+	UserConversations(ctx context.Context, userID string) ([]string, error)
+	// EraseMessages works through job.Conversations from job.Index and
+	// job.Cursor, calling checkpoint after every batch.
+	EraseMessages(ctx context.Context, job *ErasureJob, checkpoint func() error) error
+	// ExportMessages returns what the chat stores about the user.
+	ExportMessages(ctx context.Context, userID string) (any, error)
+}
+
+func ParseErasurePolicy(s string) (ErasurePolicy, error) {
+	switch p := ErasurePolicy(s); p {
+	case ErasureAnonymize, ErasureDelete:
+		return p, nil
+	}
+	return "", ErrInvalidErasurePolicy
+}
+
+// SetMessageStore connects account deletion and export with the chat, the
+// policy applies to deletions requested from now on.
+func (s *Service) SetMessageStore(m MessageStore, policy ErasurePolicy) {
+	s.messages = m
+	s.erasurePolicy = policy
+	s.erasureWake = make(chan struct{}, 1)
+}
+
+// DeleteAccount checks the password, signs the user out everywhere and
+// removes the account right away. The messages are erased in the
+// background, the returned job is the receipt to follow it with.
+func (s *Service) DeleteAccount(ctx context.Context, claims *CustomClaims, password string) (*ErasureJob, error) {
+	u, err := s.GetUser(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Password != "" {
+		ok, _, err := s.checkPassword(u.Password, password)
+		if err != nil {
+			return nil, fmt.Errorf("user: failed to check password, %v", err)
+		}
+		if !ok {
+			s.record(ctx, audit.Entry{
+				Action:   audit.ActionAccountDelete,
+				TargetID: u.ID,
+				Outcome:  audit.Failure,
+				Details:  map[string]string{"error": ErrInvalidCredentials.Error()},
+			})
+			return nil, ErrInvalidCredentials
+		}
+	}
+
+	job := &ErasureJob{
+		ID:          uuid.NewString(),
+		UserID:      u.ID,
+		Policy:      s.erasurePolicy,
+		Stage:       ErasureStageAccount,
+		RequestedAt: time.Now().UTC(),
+		Username:    u.Username,
+		OIDCIssuer:  u.OIDCIssuer,
+		OIDCSubject: u.OIDCSubject,
+	}
+	if job.Policy == "" {
+		job.Policy = ErasureAnonymize
+	}
+
+	if err := s.repo.SaveErasureJob(ctx, job); err != nil {
+		return nil, fmt.Errorf("user: failed to save erasure job, %v", err)
+	}
+
+	if err := s.RevokeToken(ctx, claims); err != nil {
+		log.Printf("user: failed to revoke token of deleted account, %v", err)
+	}
+	if err := s.eraseAccount(ctx, job); err != nil {
+		return nil, err
+	}
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionAccountDelete,
+		ActorID:  u.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"username": u.Username, "job_id": job.ID, "policy": string(job.Policy)},
+	})
+
+	if s.erasureWake != nil {
+		select {
+		case s.erasureWake <- struct{}{}:
+		default:
+		}
+	}
+
+	return job, nil
+}
+
+func (s *Service) GetErasureJob(ctx context.Context, id string) (*ErasureJob, error) {
+	return s.repo.GetErasureJob(ctx, id)
+}
+
+// RunErasures works through unfinished deletions, at start, after every new
+// one and every erasureInterval. Jobs interrupted by a restart continue
+// from their last checkpoint.
+func (s *Service) RunErasures(ctx context.Context) {
+	if s.messages == nil {
+		return
+	}
+
+	ticker := time.NewTicker(erasureInterval)
+	defer ticker.Stop()
+
+	for {
+		ids, err := s.repo.PendingErasureJobs(ctx)
+		if err != nil {
+			log.Printf("user: failed to list erasure jobs, %v", err)
+		}
+
+		for _, id := range ids {
+			if err := s.runErasure(ctx, id); err != nil && !errors.Is(err, ErrErasureLocked) {
+				log.Printf("user: erasure %s stopped, %v", id, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.erasureWake:
+		}
+	}
+}
+
+func (s *Service) runErasure(ctx context.Context, id string) error {
+	claimed, err := s.repo.ClaimErasureJob(ctx, id, erasureLockTime)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrErasureLocked
+	}
+	defer s.repo.ReleaseErasureJob(context.Background(), id)
+
+	job, err := s.repo.GetErasureJob(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if job.Stage == ErasureStageAccount {
+		if err := s.eraseAccount(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	if job.Stage == ErasureStageMessages {
+		checkpoint := func() error {
+			if err := s.repo.ExtendErasureClaim(ctx, id, erasureLockTime); err != nil {
+				return err
+			}
+			return s.repo.SaveErasureJob(ctx, job)
+		}
+		if err := s.messages.EraseMessages(ctx, job, checkpoint); err != nil {
+			return err
+		}
+
+		job.Stage = ErasureStageDone
+		job.CompletedAt = time.Now().UTC()
+		if err := s.repo.SaveErasureJob(ctx, job); err != nil {
+			return err
+		}
+		log.Printf("user: erasure %s done, %d messages %sd", job.ID, job.Messages, job.Policy)
+	}
+
+	return nil
+}
+
+// eraseAccount ends the sessions and removes the account. Every step can be
+// repeated, so an interrupted job runs it again from the start.
+func (s *Service) eraseAccount(ctx context.Context, job *ErasureJob) error {
+	if _, err := s.RevokeOtherSessions(ctx, job.UserID, ""); err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteUser(ctx, job); err != nil {
+		return fmt.Errorf("user: failed to delete account, %v", err)
+	}
+
+	if s.messages != nil {
+		conversations, err := s.messages.UserConversations(ctx, job.UserID)
+		if err != nil {
+			return fmt.Errorf("user: failed to list conversations, %v", err)
+		}
+		job.Conversations = conversations
+	}
+
+	job.Stage = ErasureStageMessages
+	job.Username = ""
+	job.OIDCIssuer = ""
+	job.OIDCSubject = ""
+	if s.messages == nil {
+		job.Stage = ErasureStageDone
+		job.CompletedAt = time.Now().UTC()
+	}
+
+	if err := s.repo.SaveErasureJob(ctx, job); err != nil {
+		return fmt.Errorf("user: failed to save erasure job, %v", err)
+	}
+
+	return nil
+}
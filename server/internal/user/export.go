@@ -0,0 +1,62 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type SingleSignOnLink struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// DataExport is everything stored about a user, for "download my data".
+// Secrets such as the password hash and TOTP secret are left out, their
+// existence is shown instead.
+type DataExport struct {
+	ExportedAt   time.Time         `json:"exported_at"`
+	Profile      *Profile          `json:"profile"`
+	HasPassword  bool              `json:"has_password"`
+	TwoFactor    *TwoFactorStatus  `json:"two_factor"`
+	SingleSignOn *SingleSignOnLink `json:"single_sign_on,omitempty"`
+	Sessions     []Session         `json:"sessions"`
+	Chat         any               `json:"chat,omitempty"`
+}
+
+func (s *Service) ExportData(ctx context.Context, userID string) (*DataExport, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	twoFactor, err := s.TwoFactorStatus(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := s.GetSessions(ctx, userID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	export := &DataExport{
+		ExportedAt:  time.Now().UTC(),
+		Profile:     u.OwnProfile(),
+		HasPassword: u.Password != "",
+		TwoFactor:   twoFactor,
+		Sessions:    sessions,
+	}
+	if u.OIDCIssuer != "" {
+		export.SingleSignOn = &SingleSignOnLink{Issuer: u.OIDCIssuer, Subject: u.OIDCSubject}
+	}
+
+	if s.messages != nil {
+		export.Chat, err = s.messages.ExportMessages(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("user: failed to export messages, %v", err)
+		}
+	}
+
+	return export, nil
+}
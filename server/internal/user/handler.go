@@ -3,8 +3,16 @@ package user
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
@@ -18,23 +26,113 @@ type request struct {
 	Password string `json:"password"`
 }
 
-type loginResponse struct {
-	Token string `json:"token"`
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type twoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type passwordResetRequest struct {
+	Username string `json:"username"`
+}
+
+type confirmPasswordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type renameRequest struct {
+	Username string `json:"username"`
+}
+
+type codeRequest struct {
+	Code string `json:"code"`
+}
+
+type backupCodesResponse struct {
+	BackupCodes []string `json:"backup_codes"`
+}
+
+type oidcLinkResponse struct {
+	URL string `json:"url"`
+}
+
+type sessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type revokeSessionsResponse struct {
+	Revoked int `json:"revoked"`
 }
 
 type errorResponse struct {
-	Message string `json:"message"`
+	Message string   `json:"message"`
+	Errors  []string `json:"errors,omitempty"`
 }
 
 func NewHandler(service *Service) *Handler {
 	return &Handler{service: service}
 }
 
-func (h *Handler) Routes() chi.Router {
+func (h *Handler) Routes(auth func(http.Handler) http.Handler) chi.Router {
 	r := chi.NewRouter()
 
 	r.Post("/login", h.handleLogin)
+	r.Post("/login/2fa", h.handleLoginTwoFactor)
 	r.Post("/register", h.handleRegister)
+	r.Post("/refresh", h.handleRefresh)
+	r.Post("/password/reset", h.handleRequestPasswordReset)
+	r.Post("/password/reset/confirm", h.handleConfirmPasswordReset)
+	r.Get("/oidc/login", h.handleOIDCLogin)
+	r.Get("/oidc/callback", h.handleOIDCCallback)
+	r.Get("/{id}/avatar", h.handleGetAvatar)
+	r.Get("/deletions/{id}", h.handleGetDeletionReceipt)
+
+	r.Group(func(r chi.Router) {
+		r.Use(auth)
+
+		r.Post("/logout", h.handleLogout)
+		r.Get("/sessions", h.handleGetSessions)
+		r.Delete("/sessions", h.handleRevokeSessions)
+		r.Delete("/sessions/{id}", h.handleRevokeSession)
+
+		r.Get("/tokens", h.handleListAccessTokens)
+		r.Post("/tokens", h.handleCreateAccessToken)
+		r.Delete("/tokens/{id}", h.handleRevokeAccessToken)
+
+		r.Post("/password", h.handleChangePassword)
+
+		r.Post("/oidc/link", h.handleOIDCLink)
+		r.Delete("/oidc/link", h.handleOIDCUnlink)
+
+		r.Get("/2fa", h.handleTwoFactorStatus)
+		r.Post("/2fa/enroll", h.handleEnrollTOTP)
+		r.Post("/2fa/confirm", h.handleConfirmTOTP)
+		r.Post("/2fa/disable", h.handleDisableTOTP)
+		r.Post("/2fa/backup-codes", h.handleRegenerateBackupCodes)
+
+		r.Get("/me", h.handleGetMe)
+		r.Patch("/me", h.handleUpdateMe)
+		r.Delete("/me", h.handleDeleteMe)
+		r.Get("/me/export", h.handleExportMe)
+		r.Put("/me/avatar", h.handleSetAvatar)
+		r.Delete("/me/avatar", h.handleDeleteAvatar)
+		r.Put("/me/username", h.handleChangeUsername)
+		r.Get("/by-name/{username}", h.handleGetUserByName)
+		r.Get("/{id}", h.handleGetUser)
+	})
 
 	return r
 }
@@ -48,12 +146,17 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := h.service.Login(r.Context(), req.Username, req.Password)
+	result, err := h.service.Login(r.Context(), req.Username, req.Password, clientInfo(r))
 	if err != nil {
+		var throttled *LoginThrottledError
+		var sanctioned *SanctionError
 		switch {
-		case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrInvalidCredentials):
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+		case errors.As(err, &throttled):
+			writeThrottled(w, throttled)
+		case errors.As(err, &sanctioned):
+			WriteSanctioned(w, sanctioned)
+		case errors.Is(err, ErrInvalidCredentials):
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
 		default:
 			log.Printf("internal server error during login, %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -63,7 +166,81 @@ func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(loginResponse{Token: token})
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handler) handleLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req twoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.service.VerifyLoginChallenge(r.Context(), req.Challenge, req.Code)
+	if err != nil {
+		var throttled *LoginThrottledError
+		var sanctioned *SanctionError
+		switch {
+		case errors.As(err, &throttled):
+			writeThrottled(w, throttled)
+		case errors.As(err, &sanctioned):
+			WriteSanctioned(w, sanctioned)
+		case errors.Is(err, ErrInvalidChallenge), errors.Is(err, ErrInvalidTwoFactor):
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+		default:
+			log.Printf("internal server error during two-factor login, %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *Handler) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.service.Refresh(r.Context(), req.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidRefreshToken), errors.Is(err, ErrRefreshTokenReused):
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+		default:
+			log.Printf("internal server error during refresh, %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *Handler) handleLogout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.service.Logout(r.Context(), claims); err != nil {
+		log.Printf("internal server error during logout, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -78,16 +255,8 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	err := h.service.Register(r.Context(), req.Username, req.Password)
 	if err != nil {
 		switch {
-		case errors.Is(err, ErrUsernameLength),
-			errors.Is(err, ErrUsernameStart),
-			errors.Is(err, ErrUsernameContains),
-			errors.Is(err, ErrPasswordLength),
-			errors.Is(err, ErrPasswordDigit),
-			errors.Is(err, ErrPasswordLowercase),
-			errors.Is(err, ErrPasswordUppercase),
-			errors.Is(err, ErrPasswordSpecial):
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(errorResponse{Message: err.Error()})
+		case isValidationError(err):
+			writeValidationErrors(w, err)
 
 		case errors.Is(err, ErrUsernameAlreadyExists):
 			w.WriteHeader(http.StatusConflict)
@@ -102,3 +271,732 @@ func (h *Handler) handleRegister(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 }
+
+func (h *Handler) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	u, err := h.service.GetUser(r.Context(), claims.UserID)
+	writeProfile(w, u, true, err)
+}
+
+func (h *Handler) handleUpdateMe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	u, err := h.service.UpdateProfile(r.Context(), claims.UserID, req)
+	var throttled *LoginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		writeThrottled(w, throttled)
+	case errors.Is(err, ErrInvalidCredentials):
+		writeJSONError(w, http.StatusForbidden, "Current password is incorrect")
+	default:
+		writeProfile(w, u, true, err)
+	}
+}
+
+func (h *Handler) handleSetAvatar(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	// Leave room for the multipart envelope, the image size itself is
+	// checked by the service.
+	r.Body = http.MaxBytesReader(w, r.Body, MaxAvatarSize+64<<10)
+
+	var src io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		src = file
+	}
+
+	data, err := io.ReadAll(io.LimitReader(src, MaxAvatarSize+1))
+	if err != nil {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, ErrAvatarTooLarge.Error())
+		return
+	}
+
+	u, err := h.service.SetAvatar(r.Context(), claims.UserID, data)
+	writeProfile(w, u, true, err)
+}
+
+func (h *Handler) handleDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	u, err := h.service.DeleteAvatar(r.Context(), claims.UserID)
+	writeProfile(w, u, true, err)
+}
+
+func (h *Handler) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	u, err := h.service.GetUser(r.Context(), chi.URLParam(r, "id"))
+	writeProfile(w, u, false, err)
+}
+
+// handleDeleteMe answers 202, the account is gone but its messages are
+// still being erased. The receipt can be followed at /deletions/{id}.
+func (h *Handler) handleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req deleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.service.DeleteAccount(r.Context(), claims, req.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			writeJSONError(w, http.StatusForbidden, "Password is incorrect")
+		case errors.Is(err, ErrUserNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+		default:
+			log.Printf("internal server error deleting account, %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/user/deletions/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *Handler) handleGetDeletionReceipt(w http.ResponseWriter, r *http.Request) {
+	job, err := h.service.GetErasureJob(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, ErrErasureNotFound) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("internal server error loading deletion receipt, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *Handler) handleExportMe(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	export, err := h.service.ExportData(r.Context(), claims.UserID)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("internal server error exporting data, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	filename := fmt.Sprintf("chatter-%s-%s.json", export.Profile.Username, export.ExportedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(export)
+}
+
+func (h *Handler) handleChangeUsername(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req renameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.service.ChangeUsername(r.Context(), claims, req.Username)
+	if err != nil {
+		switch {
+		case isValidationError(err):
+			writeValidationErrors(w, err)
+		case errors.Is(err, ErrUsernameUnchanged):
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrUsernameAlreadyExists):
+			writeJSONError(w, http.StatusConflict, err.Error())
+		case errors.Is(err, ErrUserNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+		default:
+			log.Printf("internal server error during rename, %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleGetUserByName redirects a previous username to the current one
+// while the alias lasts.
+func (h *Handler) handleGetUserByName(w http.ResponseWriter, r *http.Request) {
+	u, aliased, err := h.service.GetUserByUsername(r.Context(), chi.URLParam(r, "username"))
+	if err == nil && aliased {
+		http.Redirect(w, r, url.PathEscape(u.Username), http.StatusTemporaryRedirect)
+		return
+	}
+
+	writeProfile(w, u, false, err)
+}
+
+func (h *Handler) handleGetAvatar(w http.ResponseWriter, r *http.Request) {
+	contentType, data, err := h.service.GetAvatar(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrAvatarNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("internal server error while loading avatar, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (h *Handler) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	sessions, err := h.service.GetSessions(r.Context(), claims.UserID, claims.SessionID)
+	if err != nil {
+		log.Printf("internal server error while listing sessions, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sessionsResponse{Sessions: sessions})
+}
+
+// handleRevokeSessions ends every other session, or all of them including
+// the current one with ?all=true.
+func (h *Handler) handleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	keep := claims.SessionID
+	if r.URL.Query().Get("all") == "true" {
+		keep = ""
+	}
+
+	revoked, err := h.service.RevokeOtherSessions(r.Context(), claims.UserID, keep)
+	if err != nil {
+		log.Printf("internal server error while revoking sessions, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(revokeSessionsResponse{Revoked: revoked})
+}
+
+func (h *Handler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.service.RevokeSession(r.Context(), claims.UserID, chi.URLParam(r, "id")); err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		log.Printf("internal server error while revoking session, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := h.service.StartOIDCLogin(r.Context(), "")
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handleOIDCLink answers with the provider URL instead of redirecting, the
+// app has to send the access token and navigates there itself.
+func (h *Handler) handleOIDCLink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	authURL, err := h.service.StartOIDCLogin(r.Context(), claims.UserID)
+	if err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(oidcLinkResponse{URL: authURL})
+}
+
+func (h *Handler) handleOIDCUnlink(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := h.service.UnlinkOIDC(r.Context(), claims.UserID); err != nil {
+		writeOIDCError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var result *OIDCResult
+	err := ErrOIDCDenied
+	if query.Get("error") == "" {
+		result, err = h.service.CompleteOIDCLogin(r.Context(), query.Get("state"), query.Get("code"), clientInfo(r))
+	}
+
+	appURL := h.service.oidcAppURL()
+	if appURL == "" {
+		if err != nil {
+			writeOIDCError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if result.Linked {
+			json.NewEncoder(w).Encode(map[string]bool{"linked": true})
+			return
+		}
+		json.NewEncoder(w).Encode(result.Tokens)
+		return
+	}
+
+	// The fragment never reaches a server, so the tokens don't end up in
+	// access logs on the way back to the app.
+	fragment := url.Values{}
+	switch {
+	case err != nil:
+		status, message := oidcErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("internal server error during oidc callback, %v", err)
+		}
+		fragment.Set("error", message)
+	case result.Linked:
+		fragment.Set("linked", "true")
+	default:
+		fragment.Set("token", result.Tokens.Token)
+		fragment.Set("refresh_token", result.Tokens.RefreshToken)
+		fragment.Set("expires_in", strconv.Itoa(result.Tokens.ExpiresIn))
+	}
+
+	http.Redirect(w, r, appURL+"#"+fragment.Encode(), http.StatusFound)
+}
+
+func (h *Handler) handleTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	status, err := h.service.TwoFactorStatus(r.Context(), claims.UserID)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (h *Handler) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	enrollment, err := h.service.EnrollTOTP(r.Context(), claims.UserID)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func (h *Handler) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.service.ConfirmTOTP(r.Context(), claims.UserID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(backupCodesResponse{BackupCodes: codes})
+}
+
+func (h *Handler) handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.DisableTOTP(r.Context(), claims.UserID, req.Code); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) handleRegenerateBackupCodes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := h.service.RegenerateBackupCodes(r.Context(), claims.UserID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(backupCodesResponse{BackupCodes: codes})
+}
+
+func (h *Handler) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var req changePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	err := h.service.ChangePassword(r.Context(), claims, req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		var throttled *LoginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			writeThrottled(w, throttled)
+		case isValidationError(err):
+			writeValidationErrors(w, err)
+		case errors.Is(err, ErrInvalidCredentials):
+			writeJSONError(w, http.StatusForbidden, "Current password is incorrect")
+		case errors.Is(err, ErrUserNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+		default:
+			log.Printf("internal server error changing password, %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRequestPasswordReset answers 202 whether or not the account exists.
+func (h *Handler) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req passwordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.RequestPasswordReset(r.Context(), req.Username); err != nil {
+		if errors.Is(err, ErrResetUnavailable) {
+			writeJSONError(w, http.StatusNotImplemented, err.Error())
+			return
+		}
+		log.Printf("internal server error requesting password reset, %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *Handler) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req confirmPasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.service.ResetPassword(r.Context(), req.Token, req.Password); err != nil {
+		switch {
+		case isValidationError(err):
+			writeValidationErrors(w, err)
+		case errors.Is(err, ErrInvalidResetToken):
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		default:
+			log.Printf("internal server error resetting password, %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func clientInfo(r *http.Request) ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return ClientInfo{UserAgent: r.UserAgent(), IP: ip}
+}
+
+// writeProfile includes private fields when own is set, for the user's
+// own profile.
+func writeProfile(w http.ResponseWriter, u *User, own bool, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDisplayNameLength),
+			errors.Is(err, ErrBioLength),
+			errors.Is(err, ErrStatusTextLength),
+			errors.Is(err, ErrInvalidTimeZone),
+			errors.Is(err, ErrInvalidEmail),
+			errors.Is(err, ErrAvatarType):
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, ErrAvatarTooLarge):
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+		case errors.Is(err, ErrUserNotFound):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+		default:
+			log.Printf("internal server error during profile request, %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	profile := u.Profile()
+	if own {
+		profile = u.OwnProfile()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profile)
+}
+
+func writeOIDCError(w http.ResponseWriter, err error) {
+	status, message := oidcErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("internal server error during oidc request, %v", err)
+		http.Error(w, message, status)
+		return
+	}
+
+	writeJSONError(w, status, message)
+}
+
+func oidcErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrOIDCDisabled), errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, ErrInvalidIDToken):
+		// The details come from the provider and only go to the log.
+		log.Printf("oidc login rejected, %v", err)
+		return http.StatusUnauthorized, ErrInvalidIDToken.Error()
+	case errors.Is(err, ErrInvalidOIDCState), errors.Is(err, ErrOIDCDenied):
+		return http.StatusUnauthorized, err.Error()
+	case errors.Is(err, ErrOIDCIdentityLinked),
+		errors.Is(err, ErrOIDCNotLinked),
+		errors.Is(err, ErrOIDCOnlyLogin):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, ErrBanned):
+		return http.StatusForbidden, err.Error()
+	}
+
+	return http.StatusInternalServerError, "Internal server error"
+}
+
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidTwoFactor):
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrTwoFactorEnabled),
+		errors.Is(err, ErrTwoFactorNotEnabled),
+		errors.Is(err, ErrTwoFactorNotPending):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrUserNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	default:
+		log.Printf("internal server error during two-factor request, %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func isValidationError(err error) bool {
+	for _, rule := range []error{
+		ErrUsernameLength,
+		ErrUsernameStart,
+		ErrUsernameContains,
+		ErrUsernameMixedScript,
+		ErrUsernameReserved,
+		ErrPasswordLength,
+		ErrPasswordTooLong,
+		ErrPasswordDigit,
+		ErrPasswordLowercase,
+		ErrPasswordUppercase,
+		ErrPasswordSpecial,
+		ErrPasswordContainsUsername,
+		ErrPasswordBreached,
+	} {
+		if errors.Is(err, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeValidationErrors lists every failed rule, the message keeps the first
+// one for clients that only show a single line.
+func writeValidationErrors(w http.ResponseWriter, err error) {
+	var messages []string
+	var flatten func(error)
+	flatten = func(err error) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				flatten(e)
+			}
+			return
+		}
+		messages = append(messages, err.Error())
+	}
+	flatten(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(errorResponse{Message: messages[0], Errors: messages})
+}
+
+func writeThrottled(w http.ResponseWriter, err *LoginThrottledError) {
+	seconds := int(err.RetryAfter.Round(time.Second).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	writeJSONError(w, http.StatusTooManyRequests, err.Error())
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Message: message})
+}
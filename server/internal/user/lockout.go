@@ -0,0 +1,231 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// loginFailureWindow is how long failures are remembered after the
+	// last one.
+	loginFailureWindow = 15 * time.Minute
+
+	// freeLoginFailures are allowed before every further attempt has to
+	// wait, starting at a second and doubling up to maxLoginDelay.
+	freeLoginFailures = 3
+	maxLoginDelay     = 30 * time.Second
+
+	maxAccountFailures = 10
+	// maxIPFailures is higher than the per account limit, many users can
+	// share an address behind a NAT.
+	maxIPFailures   = 100
+	lockoutDuration = 15 * time.Minute
+)
+
+type LoginScope string
+
+const (
+	LoginScopeAccount LoginScope = "account"
+	LoginScopeIP      LoginScope = "ip"
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many failed login attempts, try again later")
+	ErrAccountLocked   = errors.New("login is temporarily locked after too many failed attempts")
+)
+
+// LoginThrottledError rejects a login before the password is checked.
+type LoginThrottledError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string { return e.Err.Error() }
+func (e *LoginThrottledError) Unwrap() error { return e.Err }
+
+type LoginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// UnlockLogin clears the failures and lockout of an account or address.
+func (s *Service) UnlockLogin(ctx context.Context, scope LoginScope, id string) error {
+	if err := s.repo.ClearLoginAttempts(ctx, scope, loginID(scope, id)); err != nil {
+		return fmt.Errorf("user: failed to unlock login, %v", err)
+	}
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionLoginUnlock,
+		TargetID: loginID(scope, id),
+		Details:  map[string]string{"scope": string(scope)},
+	})
+	return nil
+}
+
+func (s *Service) GetLoginAttempts(ctx context.Context, scope LoginScope, id string) (*LoginAttempts, error) {
+	attempts, err := s.repo.GetLoginAttempts(ctx, scope, loginID(scope, id))
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to load login attempts, %v", err)
+	}
+
+	return attempts, nil
+}
+
+// loginAttempt is counted as a failure from the moment it is reserved
+// until it turns out not to be one.
+type loginAttempt struct {
+	username string
+	ip       string
+	at       time.Time
+	// account and address are the attempts the reservation was counted on.
+	account *LoginAttempts
+	address *LoginAttempts
+}
+
+// reserveLoginAttempt runs before the password check. Unknown usernames are
+// counted like real ones, so a lockout doesn't tell whether an account
+// exists.
+func (s *Service) reserveLoginAttempt(ctx context.Context, username, ip string) (*loginAttempt, error) {
+	a := &loginAttempt{username: CanonicalUsername(username), ip: ip, at: time.Now()}
+
+	account, err := s.repo.ReserveLoginAttempt(ctx, LoginScopeAccount, a.username, a.at, loginFailureWindow, func(attempts *LoginAttempts) error {
+		if err := throttle(attempts, a.at); err != nil {
+			return err
+		}
+		// Attempts still being checked can reach the limit before the
+		// lockout is set.
+		if attempts.Failures >= maxAccountFailures {
+			return &LoginThrottledError{Err: ErrTooManyAttempts, RetryAfter: time.Second}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, reservationError(err)
+	}
+	a.account = account
+
+	if ip == "" {
+		return a, nil
+	}
+
+	address, err := s.repo.ReserveLoginAttempt(ctx, LoginScopeIP, ip, a.at, loginFailureWindow, func(attempts *LoginAttempts) error {
+		if a.at.Before(attempts.LockedUntil) {
+			return &LoginThrottledError{Err: ErrTooManyAttempts, RetryAfter: attempts.LockedUntil.Sub(a.at)}
+		}
+		if attempts.Failures >= maxIPFailures {
+			return &LoginThrottledError{Err: ErrTooManyAttempts, RetryAfter: time.Second}
+		}
+		return nil
+	})
+	if err != nil {
+		s.refund(ctx, LoginScopeAccount, a.username, a.at, a.account)
+		return nil, reservationError(err)
+	}
+	a.address = address
+
+	return a, nil
+}
+
+// loginFailed locks the account or address when the attempt was the one to
+// reach the limit.
+func (s *Service) loginFailed(ctx context.Context, a *loginAttempt) {
+	if failures := a.account.Failures + 1; failures == maxAccountFailures {
+		log.Printf("user: login for %q locked after %d failures", a.username, failures)
+		if err := s.repo.LockLogin(ctx, LoginScopeAccount, a.username, a.at.Add(lockoutDuration)); err != nil {
+			log.Printf("user: failed to lock login, %v", err)
+		}
+	}
+
+	if a.address == nil {
+		return
+	}
+	if failures := a.address.Failures + 1; failures == maxIPFailures {
+		log.Printf("user: logins from %s locked after %d failures", a.ip, failures)
+		if err := s.repo.LockLogin(ctx, LoginScopeIP, a.ip, a.at.Add(lockoutDuration)); err != nil {
+			log.Printf("user: failed to lock login, %v", err)
+		}
+	}
+}
+
+// refundLoginAttempt takes back an attempt that didn't fail, a right
+// password or an error on our side.
+func (s *Service) refundLoginAttempt(ctx context.Context, a *loginAttempt) {
+	s.refund(ctx, LoginScopeAccount, a.username, a.at, a.account)
+	if a.address != nil {
+		s.refund(ctx, LoginScopeIP, a.ip, a.at, a.address)
+	}
+}
+
+// loginSucceeded refunds the address and forgets the account's failures.
+func (s *Service) loginSucceeded(ctx context.Context, a *loginAttempt) {
+	if a.address != nil {
+		s.refund(ctx, LoginScopeIP, a.ip, a.at, a.address)
+	}
+	s.resetLoginFailures(ctx, a.username)
+}
+
+func (s *Service) refund(ctx context.Context, scope LoginScope, id string, at time.Time, previous *LoginAttempts) {
+	// The refund is owed even when the request was cancelled.
+	ctx = context.WithoutCancel(ctx)
+	if err := s.repo.RefundLoginAttempt(ctx, scope, id, at, previous.LastFailure); err != nil {
+		log.Printf("user: failed to refund login attempt, %v", err)
+	}
+}
+
+func reservationError(err error) error {
+	var throttled *LoginThrottledError
+	if errors.As(err, &throttled) {
+		return err
+	}
+	return fmt.Errorf("user: failed to reserve login attempt, %v", err)
+}
+
+// resetLoginFailures forgets the account's failures after a successful
+// login. The address keeps its count, one good password shouldn't clear
+// the way for guessing at other accounts.
+func (s *Service) resetLoginFailures(ctx context.Context, username string) {
+	if err := s.repo.ClearLoginAttempts(ctx, LoginScopeAccount, CanonicalUsername(username)); err != nil {
+		log.Printf("user: failed to reset login failures, %v", err)
+	}
+}
+
+// loginID counts accounts under their canonical name, "Alice" and "alice"
+// share one limit.
+func loginID(scope LoginScope, id string) string {
+	if scope == LoginScopeAccount {
+		return CanonicalUsername(id)
+	}
+	return id
+}
+
+func throttle(a *LoginAttempts, now time.Time) error {
+	if now.Before(a.LockedUntil) {
+		return &LoginThrottledError{Err: ErrAccountLocked, RetryAfter: a.LockedUntil.Sub(now)}
+	}
+
+	if a.Failures < freeLoginFailures {
+		return nil
+	}
+
+	delay := min(time.Second<<min(a.Failures-freeLoginFailures, 6), maxLoginDelay)
+	if wait := a.LastFailure.Add(delay).Sub(now); wait > 0 {
+		return &LoginThrottledError{Err: ErrTooManyAttempts, RetryAfter: wait}
+	}
+
+	return nil
+}
+
+// equalizeTiming spends as long as a real password check, so unknown users
+// can't be told apart by response time.
+func (s *Service) equalizeTiming(password string) {
+	s.dummyHashOnce.Do(func() {
+		s.dummyHash, _ = s.hashPassword("dummy password")
+	})
+
+	s.checkPassword(s.dummyHash, password)
+}
@@ -0,0 +1,355 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxSanctionReasonLength = 500
+
+	// SystemModerator stands in for the moderator of sanctions the server
+	// applies by itself.
+	SystemModerator = "system"
+)
+
+// SanctionKind is what a moderator did to a user.
+type SanctionKind string
+
+const (
+	// SanctionMute keeps the user from sending messages.
+	SanctionMute SanctionKind = "mute"
+	// SanctionKick drops the user's connections, with a duration they can't
+	// reconnect until it is over.
+	SanctionKick SanctionKind = "kick"
+	// SanctionBan keeps the user from logging in and connecting, and ends
+	// their sessions.
+	SanctionBan SanctionKind = "ban"
+)
+
+var (
+	ErrInvalidSanction   = errors.New("sanction must be mute, kick or ban")
+	ErrSanctionReason    = errors.New("reason must be at most 500 characters")
+	ErrSanctionDuration  = errors.New("duration must not be negative")
+	ErrSanctionIPBan     = errors.New("only bans can apply to addresses")
+	ErrSanctionSelf      = errors.New("can't sanction yourself")
+	ErrSanctionForbidden = errors.New("not allowed to sanction this user")
+	ErrSanctionNotFound  = errors.New("sanction not found")
+	ErrBanned            = errors.New("account is banned")
+	ErrMuted             = errors.New("you are muted")
+	ErrKicked            = errors.New("you were kicked, try again later")
+)
+
+var sanctionErrors = map[SanctionKind]error{
+	SanctionMute: ErrMuted,
+	SanctionKick: ErrKicked,
+	SanctionBan:  ErrBanned,
+}
+
+// Sanction is a mute, kick or ban. ExpiresAt is zero for one that lasts
+// until it is lifted. IPs are the addresses a ban covers besides the
+// account.
+type Sanction struct {
+	ID          string       `json:"id"`
+	Kind        SanctionKind `json:"kind"`
+	UserID      string       `json:"user_id"`
+	Username    string       `json:"username"`
+	IPs         []string     `json:"ips,omitempty"`
+	Reason      string       `json:"reason"`
+	ModeratorID string       `json:"moderator_id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	ExpiresAt   time.Time    `json:"expires_at,omitzero"`
+}
+
+// SanctionError rejects what a sanction forbids, Sanction tells why and
+// until when.
+type SanctionError struct {
+	Sanction *Sanction
+}
+
+func (e *SanctionError) Error() string { return sanctionErrors[e.Sanction.Kind].Error() }
+func (e *SanctionError) Unwrap() error { return sanctionErrors[e.Sanction.Kind] }
+
+type SanctionRequest struct {
+	Kind     SanctionKind
+	UserID   string
+	Reason   string
+	Duration time.Duration
+	// ByIP extends a ban to the addresses of the user's live sessions.
+	ByIP bool
+}
+
+// Sanction mutes, kicks or bans a user. Moderators can only act on users
+// they outrank. A kick without a duration isn't stored, it only drops the
+// connections.
+func (s *Service) Sanction(ctx context.Context, actor *CustomClaims, req SanctionRequest) (*Sanction, error) {
+	sanction, err := s.sanction(ctx, actor, req)
+	if errors.Is(err, ErrSanctionForbidden) || errors.Is(err, ErrSanctionSelf) {
+		s.recordResult(ctx, audit.Entry{
+			Action:   audit.ActionSanction,
+			ActorID:  actor.UserID,
+			TargetID: req.UserID,
+			Details:  map[string]string{"kind": string(req.Kind)},
+		}, err)
+	}
+	return sanction, err
+}
+
+func (s *Service) sanction(ctx context.Context, actor *CustomClaims, req SanctionRequest) (*Sanction, error) {
+	if err := validateSanction(req); err != nil {
+		return nil, err
+	}
+	if actor.UserID == req.UserID {
+		return nil, ErrSanctionSelf
+	}
+
+	target, err := s.repo.GetUserByID(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.Can(PermModerate, "") || !actor.Role.orMember().Outranks(target.Role) {
+		return nil, ErrSanctionForbidden
+	}
+
+	return s.applySanction(ctx, actor.UserID, target, req)
+}
+
+// AutoSanction applies a sanction the server decided on by itself, such as
+// a spam mute. Staff are left alone, the sanction is recorded as
+// SystemModerator's.
+func (s *Service) AutoSanction(ctx context.Context, req SanctionRequest) (*Sanction, error) {
+	if err := validateSanction(req); err != nil {
+		return nil, err
+	}
+
+	target, err := s.repo.GetUserByID(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !RoleModerator.Outranks(target.Role) {
+		return nil, ErrSanctionForbidden
+	}
+
+	return s.applySanction(ctx, SystemModerator, target, req)
+}
+
+func validateSanction(req SanctionRequest) error {
+	switch req.Kind {
+	case SanctionMute, SanctionKick, SanctionBan:
+	default:
+		return ErrInvalidSanction
+	}
+	if utf8.RuneCountInString(req.Reason) > maxSanctionReasonLength {
+		return ErrSanctionReason
+	}
+	if req.Duration < 0 {
+		return ErrSanctionDuration
+	}
+	if req.ByIP && req.Kind != SanctionBan {
+		return ErrSanctionIPBan
+	}
+	return nil
+}
+
+func (s *Service) applySanction(ctx context.Context, moderatorID string, target *User, req SanctionRequest) (*Sanction, error) {
+	now := time.Now().UTC()
+	sanction := &Sanction{
+		ID:          uuid.NewString(),
+		Kind:        req.Kind,
+		UserID:      target.ID,
+		Username:    target.Username,
+		Reason:      req.Reason,
+		ModeratorID: moderatorID,
+		CreatedAt:   now,
+	}
+	if req.Duration > 0 {
+		sanction.ExpiresAt = now.Add(req.Duration)
+	}
+
+	if req.ByIP {
+		sessions, err := s.repo.GetSessions(ctx, target.ID)
+		if err != nil {
+			return nil, fmt.Errorf("user: failed to load sessions, %v", err)
+		}
+		ips := make([]string, 0, len(sessions))
+		for _, session := range sessions {
+			ips = append(ips, session.IP)
+		}
+
+		// A ban replacing an earlier one keeps its addresses, a banned
+		// user has no sessions left to take them from.
+		previous, err := s.repo.ActiveSanction(ctx, SanctionBan, target.ID, "")
+		if err != nil {
+			return nil, fmt.Errorf("user: failed to check bans, %v", err)
+		}
+		if previous != nil {
+			ips = append(ips, previous.IPs...)
+		}
+
+		seen := make(map[string]bool)
+		for _, ip := range ips {
+			if ip != "" && !seen[ip] {
+				seen[ip] = true
+				sanction.IPs = append(sanction.IPs, ip)
+			}
+		}
+	}
+
+	if req.Kind != SanctionKick || req.Duration > 0 {
+		if err := s.repo.SaveSanction(ctx, sanction); err != nil {
+			return nil, fmt.Errorf("user: failed to save sanction, %v", err)
+		}
+	}
+
+	if req.Kind == SanctionBan {
+		if _, err := s.RevokeOtherSessions(ctx, target.ID, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("user: %s %s by %s for %v, %q", target.ID, req.Kind, moderatorID, req.Duration, req.Reason)
+	s.publishModeration(ctx, sanction, false)
+
+	details := map[string]string{
+		"sanction_id": sanction.ID,
+		"kind":        string(sanction.Kind),
+		"reason":      sanction.Reason,
+		"duration":    req.Duration.String(),
+	}
+	if len(sanction.IPs) > 0 {
+		details["ips"] = strings.Join(sanction.IPs, ",")
+	}
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionSanction,
+		ActorID:  moderatorID,
+		TargetID: target.ID,
+		Details:  details,
+	})
+
+	return sanction, nil
+}
+
+// LiftSanction ends a mute, kick or ban before it expires.
+func (s *Service) LiftSanction(ctx context.Context, actor *CustomClaims, id string) error {
+	if !actor.Can(PermModerate, "") {
+		s.recordResult(ctx, audit.Entry{
+			Action:  audit.ActionSanctionLift,
+			ActorID: actor.UserID,
+			Details: map[string]string{"sanction_id": id},
+		}, ErrSanctionForbidden)
+		return ErrSanctionForbidden
+	}
+
+	sanction, err := s.repo.GetSanction(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkLiftRank(ctx, actor, sanction); err != nil {
+		s.recordResult(ctx, audit.Entry{
+			Action:   audit.ActionSanctionLift,
+			ActorID:  actor.UserID,
+			TargetID: sanction.UserID,
+			Details:  map[string]string{"sanction_id": sanction.ID, "kind": string(sanction.Kind)},
+		}, err)
+		return err
+	}
+
+	if err := s.repo.DeleteSanction(ctx, sanction); err != nil {
+		return fmt.Errorf("user: failed to lift sanction, %v", err)
+	}
+
+	log.Printf("user: %s of %s lifted by %s", sanction.Kind, sanction.UserID, actor.UserID)
+	s.publishModeration(ctx, sanction, true)
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionSanctionLift,
+		ActorID:  actor.UserID,
+		TargetID: sanction.UserID,
+		Details:  map[string]string{"sanction_id": sanction.ID, "kind": string(sanction.Kind)},
+	})
+
+	return nil
+}
+
+// checkLiftRank applies the rank rule of Sanction to lifting, a moderator
+// can't lift what someone above them placed. Sanctions of the server and of
+// deleted accounts are anyone's to lift.
+func (s *Service) checkLiftRank(ctx context.Context, actor *CustomClaims, sanction *Sanction) error {
+	if sanction.ModeratorID == actor.UserID || sanction.ModeratorID == SystemModerator {
+		return nil
+	}
+
+	moderator, err := s.repo.GetUserByID(ctx, sanction.ModeratorID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("user: failed to get moderator, %v", err)
+	}
+
+	if moderator.Role.Outranks(actor.Role) {
+		return ErrSanctionForbidden
+	}
+	return nil
+}
+
+// ListSanctions returns the sanctions in effect, only the user's when
+// userID is set.
+func (s *Service) ListSanctions(ctx context.Context, userID string) ([]Sanction, error) {
+	sanctions, err := s.repo.ListSanctions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to list sanctions, %v", err)
+	}
+
+	if userID == "" {
+		return sanctions, nil
+	}
+
+	filtered := []Sanction{}
+	for _, sanction := range sanctions {
+		if sanction.UserID == userID {
+			filtered = append(filtered, sanction)
+		}
+	}
+
+	return filtered, nil
+}
+
+// checkBan rejects a login of a banned account or from a banned address.
+func (s *Service) checkBan(ctx context.Context, userID, ip string) error {
+	sanction, err := s.repo.ActiveSanction(ctx, SanctionBan, userID, ip)
+	if err != nil {
+		return fmt.Errorf("user: failed to check bans, %v", err)
+	}
+	if sanction != nil {
+		return &SanctionError{Sanction: sanction}
+	}
+
+	return nil
+}
+
+func (s *Service) publishModeration(ctx context.Context, sanction *Sanction, lifted bool) {
+	data, _ := json.Marshal(events.ModerationAction{
+		Kind:     string(sanction.Kind),
+		Lifted:   lifted,
+		UserID:   sanction.UserID,
+		Username: sanction.Username,
+		Reason:   sanction.Reason,
+		Until:    sanction.ExpiresAt,
+	})
+
+	if err := s.repo.PublishEvent(ctx, events.Event{Type: events.Moderation, Data: data}); err != nil {
+		log.Printf("user: failed to publish moderation, %v", err)
+	}
+}
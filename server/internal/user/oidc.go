@@ -0,0 +1,511 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/keys"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateExpirationTime = 10 * time.Minute
+	// jwksRefreshInterval limits how often an unknown kid makes us refetch
+	// the provider's keys.
+	jwksRefreshInterval = time.Minute
+	oidcHTTPTimeout     = 10 * time.Second
+)
+
+var (
+	ErrOIDCDisabled       = errors.New("single sign-on is not configured")
+	ErrInvalidOIDCState   = errors.New("invalid or expired login state")
+	ErrInvalidIDToken     = errors.New("invalid id token")
+	ErrOIDCDenied         = errors.New("login was cancelled at the identity provider")
+	ErrOIDCIdentityLinked = errors.New("this identity is linked to another account")
+	ErrOIDCNotLinked      = errors.New("no identity is linked to this account")
+	ErrOIDCOnlyLogin      = errors.New("set a password before unlinking the only way to log in")
+)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// UsernameClaim picks the claim new users are named after, the subject
+	// is used when the provider doesn't send it.
+	UsernameClaim string
+	// AppURL is where the browser goes after the callback, with the tokens
+	// in the fragment. Without it the callback answers with JSON.
+	AppURL string
+}
+
+// OIDCState is what we remember between sending the browser to the provider
+// and the callback. LinkUserID is set when a logged in user links an
+// identity instead of logging in.
+type OIDCState struct {
+	Verifier   string
+	Nonce      string
+	LinkUserID string
+}
+
+// OIDCIdentity is the verified result of an ID token.
+type OIDCIdentity struct {
+	Issuer   string
+	Subject  string
+	Username string
+	Name     string
+	// Email is only set when the provider verified it.
+	Email string
+}
+
+// OIDCResult is either a login or a linked identity.
+type OIDCResult struct {
+	Tokens *Tokens
+	Linked bool
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider talks to one OpenID Connect provider. Discovery happens on
+// first use, so the server starts even when the provider is down.
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+
+	return &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: oidcHTTPTimeout},
+	}
+}
+
+// SetOIDCProvider turns on single sign-on.
+func (s *Service) SetOIDCProvider(p *OIDCProvider) {
+	s.oidc = p
+}
+
+func (s *Service) oidcAppURL() string {
+	if s.oidc == nil {
+		return ""
+	}
+	return s.oidc.config.AppURL
+}
+
+// StartOIDCLogin returns the provider URL to send the browser to. Passing a
+// user ID links the identity to that user instead of logging in.
+func (s *Service) StartOIDCLogin(ctx context.Context, linkUserID string) (string, error) {
+	if s.oidc == nil {
+		return "", ErrOIDCDisabled
+	}
+
+	meta, err := s.oidc.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := generateOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("user: error generating oidc state: %v", err)
+	}
+	nonce, err := generateOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("user: error generating oidc nonce: %v", err)
+	}
+	verifier, err := generateOpaqueToken()
+	if err != nil {
+		return "", fmt.Errorf("user: error generating pkce verifier: %v", err)
+	}
+
+	st := OIDCState{Verifier: verifier, Nonce: nonce, LinkUserID: linkUserID}
+	if err := s.repo.SaveOIDCState(ctx, hashToken(state), &st, oidcStateExpirationTime); err != nil {
+		return "", fmt.Errorf("user: failed to store oidc state, %v", err)
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", s.oidc.config.ClientID)
+	params.Set("redirect_uri", s.oidc.config.RedirectURL)
+	params.Set("scope", strings.Join(s.oidc.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return meta.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// CompleteOIDCLogin handles the callback. Known identities log in, unknown
+// ones get a new account unless the flow was started to link one. The
+// provider is trusted with the second factor, local 2FA is not asked for.
+func (s *Service) CompleteOIDCLogin(ctx context.Context, state, code string, client ClientInfo) (*OIDCResult, error) {
+	result, err := s.completeOIDCLogin(ctx, state, code, client)
+	if err != nil {
+		s.recordLogin(ctx, "", "", loginMethodOIDC, err)
+	}
+	return result, err
+}
+
+func (s *Service) completeOIDCLogin(ctx context.Context, state, code string, client ClientInfo) (*OIDCResult, error) {
+	if s.oidc == nil {
+		return nil, ErrOIDCDisabled
+	}
+
+	st, err := s.repo.ConsumeOIDCState(ctx, hashToken(state))
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := s.oidc.exchange(ctx, code, st)
+	if err != nil {
+		return nil, err
+	}
+
+	if st.LinkUserID != "" {
+		if err := s.repo.LinkOIDCIdentity(ctx, st.LinkUserID, identity.Issuer, identity.Subject); err != nil {
+			if errors.Is(err, ErrOIDCIdentityLinked) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("user: failed to link identity, %v", err)
+		}
+		return &OIDCResult{Linked: true}, nil
+	}
+
+	u, err := s.repo.GetUserByOIDCIdentity(ctx, identity.Issuer, identity.Subject)
+	if errors.Is(err, ErrUserNotFound) {
+		u, err = s.provisionOIDCUser(ctx, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.startSession(ctx, u, client, loginMethodOIDC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCResult{Tokens: tokens}, nil
+}
+
+// UnlinkOIDC removes the linked identity, as long as the user can still log
+// in with a password afterwards.
+func (s *Service) UnlinkOIDC(ctx context.Context, userID string) error {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.OIDCSubject == "" {
+		return ErrOIDCNotLinked
+	}
+	if u.Password == "" {
+		return ErrOIDCOnlyLogin
+	}
+
+	if err := s.repo.UnlinkOIDCIdentity(ctx, u); err != nil {
+		return fmt.Errorf("user: failed to unlink identity, %v", err)
+	}
+
+	return nil
+}
+
+// provisionOIDCUser creates an account without a password for an identity
+// seen for the first time, named after the configured claim. The account is
+// created and linked at once, when a concurrent callback for the same
+// identity wins, its account is used.
+func (s *Service) provisionOIDCUser(ctx context.Context, identity *OIDCIdentity) (*User, error) {
+	base := oidcUsername(identity.Username, identity.Subject)
+
+	for i := 0; i < 100; i++ {
+		candidate := usernameCandidate(base, i)
+		if isReservedUsername(candidate) {
+			continue
+		}
+		_, _, err := s.repo.ResolveUsername(ctx, candidate)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return nil, fmt.Errorf("user: failed to resolve username, %v", err)
+		}
+
+		u := User{
+			Username:    candidate,
+			DisplayName: truncate(identity.Name, maxDisplayNameLength),
+			Email:       identity.Email,
+			OIDCIssuer:  identity.Issuer,
+			OIDCSubject: identity.Subject,
+		}
+		err = s.repo.CreateUser(ctx, &u)
+		if errors.Is(err, ErrUsernameAlreadyExists) {
+			// Taken since it was resolved.
+			continue
+		}
+		if errors.Is(err, ErrOIDCIdentityLinked) {
+			return s.repo.GetUserByOIDCIdentity(ctx, identity.Issuer, identity.Subject)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("user: failed to create user, %v", err)
+		}
+
+		s.record(ctx, audit.Entry{
+			Action:   audit.ActionRegister,
+			ActorID:  u.ID,
+			TargetID: u.ID,
+			Details:  map[string]string{"username": u.Username, "method": loginMethodOIDC, "issuer": identity.Issuer},
+		})
+
+		return &u, nil
+	}
+
+	return nil, fmt.Errorf("user: no free username for %s", base)
+}
+
+func oidcUsername(claim, subject string) string {
+	name, _, _ := strings.Cut(claim, "@")
+	name = usernameInvalidChars.ReplaceAllString(name, "_")
+	name = strings.Trim(name, "_")
+
+	switch {
+	case name == "":
+		name = "user_" + usernameInvalidChars.ReplaceAllString(subject, "")
+	case errors.Is(validateUsername(name), ErrUsernameStart):
+		name = "u" + name
+	}
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	for len(name) < 4 {
+		name += "_"
+	}
+
+	return name
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var meta oidcMetadata
+	if err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, fmt.Errorf("user: oidc discovery failed, %v", err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("user: oidc discovery returned issuer %q, expected %q", meta.Issuer, p.config.Issuer)
+	}
+
+	p.metadata = &meta
+	return p.metadata, nil
+}
+
+// exchange trades the code for tokens and verifies the ID token.
+func (p *OIDCProvider) exchange(ctx context.Context, code string, st *OIDCState) (*OIDCIdentity, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", st.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("user: oidc token request failed, %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint returned %d, %s", ErrInvalidIDToken, resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil || tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrInvalidIDToken)
+	}
+
+	return p.verify(ctx, tokenResp.IDToken, st.Nonce)
+}
+
+func (p *OIDCProvider) verify(ctx context.Context, idToken, nonce string) (*OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{keys.RS256, keys.ES256, keys.EdDSA}),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	// With several audiences the token must name us as the party it was
+	// issued to.
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.config.ClientID {
+			return nil, fmt.Errorf("%w: azp mismatch", ErrInvalidIDToken)
+		}
+	}
+
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+
+	identity := &OIDCIdentity{Issuer: p.config.Issuer, Subject: subject}
+	identity.Username, _ = claims[p.config.UsernameClaim].(string)
+	identity.Name, _ = claims["name"].(string)
+	if verified, _ := claims["email_verified"].(bool); verified {
+		email, _ := claims["email"].(string)
+		identity.Email, _ = normalizeEmail(email)
+	}
+
+	return identity, nil
+}
+
+// key finds a provider key by kid, refetching the JWKS when the provider
+// rotated to a key we haven't seen yet.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (any, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	var jwks keys.JWKS
+	if err := p.getJSON(ctx, meta.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys, %v", err)
+	}
+
+	p.keys = make(map[string]any, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		p.keys[jwk.Kid] = pub
+	}
+	p.keysFetched = time.Now()
+
+	if k, ok := p.lookup(kid); ok {
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// lookup accepts a token without kid when the provider has a single key.
+func (p *OIDCProvider) lookup(kid string) (any, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,400 @@
+package user
+
+import (
+	"chatter/server/internal/keys"
+	"chatter/server/internal/mockoidc"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeOIDCRepo keeps login states, accounts, linked identities and the
+// sessions started, the rest of Repository is left unimplemented.
+type fakeOIDCRepo struct {
+	Repository
+	states   map[string]OIDCState
+	linked   map[string]string
+	users    map[string]*User
+	sessions []string
+	// beforeCreate runs before an account is created, like a concurrent
+	// request would.
+	beforeCreate func()
+}
+
+func (r *fakeOIDCRepo) SaveOIDCState(ctx context.Context, hash string, st *OIDCState, ttl time.Duration) error {
+	r.states[hash] = *st
+	return nil
+}
+
+func (r *fakeOIDCRepo) ConsumeOIDCState(ctx context.Context, hash string) (*OIDCState, error) {
+	st, ok := r.states[hash]
+	if !ok {
+		return nil, ErrInvalidOIDCState
+	}
+	delete(r.states, hash)
+	return &st, nil
+}
+
+func (r *fakeOIDCRepo) LinkOIDCIdentity(ctx context.Context, userID, issuer, subject string) error {
+	r.linked[userID] = issuer + " " + subject
+	return nil
+}
+
+func (r *fakeOIDCRepo) GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	for userID, identity := range r.linked {
+		if identity == issuer+" "+subject {
+			return r.users[userID], nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (r *fakeOIDCRepo) ResolveUsername(ctx context.Context, username string) (string, bool, error) {
+	for _, u := range r.users {
+		if CanonicalUsername(u.Username) == CanonicalUsername(username) {
+			return u.ID, false, nil
+		}
+	}
+	return "", false, ErrUserNotFound
+}
+
+func (r *fakeOIDCRepo) CreateUser(ctx context.Context, u *User) error {
+	if r.beforeCreate != nil {
+		r.beforeCreate()
+		r.beforeCreate = nil
+	}
+
+	if _, _, err := r.ResolveUsername(ctx, u.Username); err == nil {
+		return ErrUsernameAlreadyExists
+	}
+	if _, err := r.GetUserByOIDCIdentity(ctx, u.OIDCIssuer, u.OIDCSubject); err == nil {
+		return ErrOIDCIdentityLinked
+	}
+
+	u.ID = fmt.Sprintf("u%d", len(r.users)+1)
+	r.users[u.ID] = u
+	if u.OIDCIssuer != "" {
+		r.linked[u.ID] = u.OIDCIssuer + " " + u.OIDCSubject
+	}
+	return nil
+}
+
+func (r *fakeOIDCRepo) ActiveSanction(ctx context.Context, kind SanctionKind, userID, ip string) (*Sanction, error) {
+	return nil, nil
+}
+
+func (r *fakeOIDCRepo) CreateSession(ctx context.Context, session *Session, ttl time.Duration) error {
+	r.sessions = append(r.sessions, session.UserID)
+	return nil
+}
+
+func (r *fakeOIDCRepo) GetRoomRoles(ctx context.Context, userID string) (map[string]Role, error) {
+	return nil, nil
+}
+
+func (r *fakeOIDCRepo) StoreRefreshToken(ctx context.Context, hash string, rt *RefreshToken, ttl time.Duration) error {
+	return nil
+}
+
+// newMockOIDC starts the mock provider and a service using it.
+func newMockOIDC(t *testing.T) (*Service, *fakeOIDCRepo, string) {
+	t.Helper()
+
+	keySet, err := keys.Load(t.TempDir(), keys.RS256, "", "")
+	if err != nil {
+		t.Fatalf("keys.Load: %v", err)
+	}
+	if _, err := keySet.Rotate(); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	var provider http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	provider = mockoidc.New(srv.URL, keySet).Handler()
+
+	repo := &fakeOIDCRepo{states: make(map[string]OIDCState), linked: make(map[string]string), users: make(map[string]*User)}
+	s := NewService(repo, keySet)
+	s.SetOIDCProvider(NewOIDCProvider(OIDCConfig{
+		Issuer:       srv.URL,
+		ClientID:     "chatter",
+		ClientSecret: "secret",
+		RedirectURL:  "http://chatter.test/callback",
+	}))
+
+	return s, repo, srv.URL
+}
+
+// authorize logs in at the provider and returns the state and code of
+// the callback.
+func authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	return callback.Query().Get("state"), callback.Query().Get("code")
+}
+
+func TestOIDCLink(t *testing.T) {
+	tests := []struct {
+		name string
+		// authorize changes the parameters sent to the provider.
+		authorize func(q url.Values)
+		// state changes what was remembered for the callback.
+		state func(st *OIDCState)
+		// callback changes the state the callback comes back with.
+		callback func(state string) string
+		want     error
+	}{
+		{name: "links the identity"},
+		{
+			name:     "unknown state",
+			callback: func(string) string { return "forged" },
+			want:     ErrInvalidOIDCState,
+		},
+		{
+			name:  "wrong pkce verifier",
+			state: func(st *OIDCState) { st.Verifier = "other" },
+			want:  ErrInvalidIDToken,
+		},
+		{
+			name:  "wrong nonce",
+			state: func(st *OIDCState) { st.Nonce = "other" },
+			want:  ErrInvalidIDToken,
+		},
+		{
+			name:      "code of another client",
+			authorize: func(q url.Values) { q.Set("client_id", "other") },
+			want:      ErrInvalidIDToken,
+		},
+		{
+			name:      "code for another redirect",
+			authorize: func(q url.Values) { q.Set("redirect_uri", "http://evil.test/callback") },
+			want:      ErrInvalidIDToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo, issuer := newMockOIDC(t)
+			ctx := context.Background()
+
+			authURL, err := s.StartOIDCLogin(ctx, "u1")
+			if err != nil {
+				t.Fatalf("StartOIDCLogin: %v", err)
+			}
+
+			u, err := url.Parse(authURL)
+			if err != nil {
+				t.Fatalf("auth url: %v", err)
+			}
+			q := u.Query()
+			q.Set("login_hint", "alice")
+			if tt.authorize != nil {
+				tt.authorize(q)
+			}
+			u.RawQuery = q.Encode()
+
+			if tt.state != nil {
+				for hash, st := range repo.states {
+					tt.state(&st)
+					repo.states[hash] = st
+				}
+			}
+
+			state, code := authorize(t, u.String())
+			if tt.callback != nil {
+				state = tt.callback(state)
+			}
+
+			result, err := s.CompleteOIDCLogin(ctx, state, code, ClientInfo{})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("CompleteOIDCLogin = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				if len(repo.linked) != 0 {
+					t.Errorf("linked %v after a failed login", repo.linked)
+				}
+				return
+			}
+
+			if !result.Linked {
+				t.Errorf("CompleteOIDCLogin = %+v, want linked", result)
+			}
+			if got, want := repo.linked["u1"], issuer+" mock-alice"; got != want {
+				t.Errorf("linked identity = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestOIDCProvisioning(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup runs before the callback, issuer is the mock provider's.
+		setup func(repo *fakeOIDCRepo, issuer string)
+		// user is the account logged in, created says whether the callback
+		// created it.
+		user     string
+		username string
+		created  bool
+		accounts int
+	}{
+		{name: "creates and links an account", user: "u1", username: "alice", created: true, accounts: 1},
+		{
+			name: "logs in the linked account",
+			setup: func(repo *fakeOIDCRepo, issuer string) {
+				repo.users["u1"] = &User{ID: "u1", Username: "alice_smith"}
+				repo.linked["u1"] = issuer + " mock-alice"
+			},
+			user: "u1", username: "alice_smith", accounts: 1,
+		},
+		{
+			name: "username taken",
+			setup: func(repo *fakeOIDCRepo, issuer string) {
+				repo.users["u1"] = &User{ID: "u1", Username: "Alice"}
+			},
+			user: "u2", username: "alice2", created: true, accounts: 2,
+		},
+		{
+			name: "username taken during the callback",
+			setup: func(repo *fakeOIDCRepo, issuer string) {
+				repo.beforeCreate = func() {
+					repo.users["u1"] = &User{ID: "u1", Username: "alice"}
+				}
+			},
+			user: "u2", username: "alice2", created: true, accounts: 2,
+		},
+		{
+			name: "identity linked by a concurrent callback",
+			setup: func(repo *fakeOIDCRepo, issuer string) {
+				repo.beforeCreate = func() {
+					repo.users["u1"] = &User{ID: "u1", Username: "alice"}
+					repo.linked["u1"] = issuer + " mock-alice"
+				}
+			},
+			user: "u1", username: "alice", accounts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo, issuer := newMockOIDC(t)
+			ctx := context.Background()
+			if tt.setup != nil {
+				tt.setup(repo, issuer)
+			}
+
+			authURL, err := s.StartOIDCLogin(ctx, "")
+			if err != nil {
+				t.Fatalf("StartOIDCLogin: %v", err)
+			}
+			state, code := authorize(t, authURL+"&login_hint=alice")
+
+			result, err := s.CompleteOIDCLogin(ctx, state, code, ClientInfo{})
+			if err != nil {
+				t.Fatalf("CompleteOIDCLogin: %v", err)
+			}
+			if result.Tokens == nil || result.Linked {
+				t.Errorf("CompleteOIDCLogin = %+v, want tokens", result)
+			}
+			if len(repo.sessions) != 1 || repo.sessions[0] != tt.user {
+				t.Errorf("sessions started for %v, want %s", repo.sessions, tt.user)
+			}
+
+			u := repo.users[tt.user]
+			if u == nil || u.Username != tt.username {
+				t.Fatalf("user %s = %+v, want username %s", tt.user, u, tt.username)
+			}
+			if got, want := repo.linked[tt.user], issuer+" mock-alice"; got != want {
+				t.Errorf("linked identity = %q, want %q", got, want)
+			}
+
+			if len(repo.users) != tt.accounts {
+				t.Errorf("%d accounts, want %d", len(repo.users), tt.accounts)
+			}
+			if tt.created && (u.DisplayName != "alice" || u.Email != "alice@example.com" || u.Password != "") {
+				t.Errorf("created %+v, want the profile from the provider and no password", u)
+			}
+		})
+	}
+}
+
+func TestOIDCStateIsSingleUse(t *testing.T) {
+	s, _, _ := newMockOIDC(t)
+	ctx := context.Background()
+
+	authURL, err := s.StartOIDCLogin(ctx, "u1")
+	if err != nil {
+		t.Fatalf("StartOIDCLogin: %v", err)
+	}
+	state, code := authorize(t, authURL+"&login_hint=alice")
+
+	if _, err := s.CompleteOIDCLogin(ctx, state, code, ClientInfo{}); err != nil {
+		t.Fatalf("CompleteOIDCLogin: %v", err)
+	}
+	if _, err := s.CompleteOIDCLogin(ctx, state, code, ClientInfo{}); !errors.Is(err, ErrInvalidOIDCState) {
+		t.Errorf("second CompleteOIDCLogin = %v, want %v", err, ErrInvalidOIDCState)
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	s := NewService(&fakeOIDCRepo{}, nil)
+
+	if _, err := s.StartOIDCLogin(context.Background(), ""); !errors.Is(err, ErrOIDCDisabled) {
+		t.Errorf("StartOIDCLogin = %v, want %v", err, ErrOIDCDisabled)
+	}
+	if _, err := s.CompleteOIDCLogin(context.Background(), "state", "code", ClientInfo{}); !errors.Is(err, ErrOIDCDisabled) {
+		t.Errorf("CompleteOIDCLogin = %v, want %v", err, ErrOIDCDisabled)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	tests := []struct {
+		claim   string
+		subject string
+		want    string
+	}{
+		{"alice", "1", "alice"},
+		{"alice@example.com", "1", "alice"},
+		{"alice.smith", "1", "alice_smith"},
+		{"--alice--", "1", "alice"},
+		{"42alice", "1", "u42alice"},
+		{"_bob", "1", "bob_"},
+		{"al", "1", "al__"},
+		{"averyveryverylongusername", "1", "averyveryverylonguse"},
+		{"", "abc-123", "user_abc123"},
+		{"ünïcode", "1", "n_code"},
+	}
+
+	for _, tt := range tests {
+		got := oidcUsername(tt.claim, tt.subject)
+		if got != tt.want {
+			t.Errorf("oidcUsername(%q, %q) = %q, want %q", tt.claim, tt.subject, got, tt.want)
+		}
+		if err := validateUsername(got); err != nil {
+			t.Errorf("oidcUsername(%q, %q) = %q, which is invalid, %v", tt.claim, tt.subject, got, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Argon2Params are the Argon2id costs for new hashes. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommendation of RFC 9106 with
+// less parallelism, which suits small servers.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type HashReport struct {
+	Total    int
+	Current  int
+	Outdated int // argon2id with older parameters
+	Bcrypt   int
+	NoHash   int // single sign-on accounts
+	Unknown  int
+}
+
+// SetArgon2Params changes the costs of new hashes, existing ones are
+// upgraded as their users log in.
+func (s *Service) SetArgon2Params(params Argon2Params) {
+	s.argon2 = params
+}
+
+// HashReport counts accounts by how their password is stored.
+func (s *Service) HashReport(ctx context.Context) (*HashReport, error) {
+	var report HashReport
+
+	err := s.repo.ScanUsers(ctx, func(u *User) error {
+		report.Total++
+
+		if u.Password == "" {
+			report.NoHash++
+			return nil
+		}
+
+		h, err := parseHash(u.Password)
+		switch {
+		case err != nil:
+			report.Unknown++
+		case h.alg == HashBcrypt:
+			report.Bcrypt++
+		case h.params == s.argon2:
+			report.Current++
+		default:
+			report.Outdated++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to scan users, %v", err)
+	}
+
+	return &report, nil
+}
+
+func (s *Service) hashPassword(password string) (string, error) {
+	p := s.argon2
+
+	salt := make([]byte, p.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// checkPassword verifies either hash format and reports whether the hash
+// should be replaced with one using the current parameters.
+func (s *Service) checkPassword(hash, password string) (bool, bool, error) {
+	h, err := parseHash(hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	if h.alg == HashBcrypt {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		return err == nil, true, err
+	}
+
+	p := h.params
+	key := argon2.IDKey([]byte(password), h.salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return false, false, nil
+	}
+
+	return true, p != s.argon2, nil
+}
+
+// rehashPassword upgrades the stored hash after a successful login. It is
+// best effort, the login goes through either way.
+func (s *Service) rehashPassword(ctx context.Context, u *User, password string) {
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		log.Printf("user: failed to rehash password, %v", err)
+		return
+	}
+
+	if err := s.repo.ReplacePasswordHash(ctx, u.ID, u.Password, hash); err != nil {
+		log.Printf("user: failed to store rehashed password, %v", err)
+	}
+}
+
+type parsedHash struct {
+	alg    string
+	params Argon2Params
+	salt   []byte
+	key    []byte
+}
+
+// parseHash reads the algorithm and, for argon2id, the parameters of a
+// stored hash in PHC format.
+func parseHash(hash string) (*parsedHash, error) {
+	if strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") {
+		return &parsedHash{alg: HashBcrypt}, nil
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrUnknownHash
+	}
+
+	h := parsedHash{alg: HashArgon2id}
+	p := &h.params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return nil, ErrUnknownHash
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, ErrUnknownHash
+	}
+	if p.Iterations == 0 || p.Parallelism == 0 || len(h.key) == 0 {
+		return nil, ErrUnknownHash
+	}
+	p.SaltLength = uint32(len(h.salt))
+	p.KeyLength = uint32(len(h.key))
+
+	return &h, nil
+}
@@ -0,0 +1,219 @@
+package user
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// breachedFalsePositiveRate is what the Bloom filter is sized for, about
+// one good password in a thousand gets rejected as breached.
+const breachedFalsePositiveRate = 0.001
+
+var (
+	ErrPasswordTooLong          = errors.New("password is too long")
+	ErrPasswordContainsUsername = errors.New("password must not contain the username")
+	ErrPasswordBreached         = errors.New("password appears in a list of breached passwords, choose another one")
+)
+
+var (
+	upperPattern   = regexp.MustCompile(`[A-Z]`)
+	lowerPattern   = regexp.MustCompile(`[a-z]`)
+	digitPattern   = regexp.MustCompile(`[0-9]`)
+	specialPattern = regexp.MustCompile(`[\W_]`)
+)
+
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireUpper     bool
+	RequireLower     bool
+	RequireDigit     bool
+	RequireSpecial   bool
+	DisallowUsername bool
+	Breached         *BreachedList
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:        8,
+	MaxLength:        128,
+	RequireUpper:     true,
+	RequireLower:     true,
+	RequireDigit:     true,
+	RequireSpecial:   true,
+	DisallowUsername: true,
+}
+
+// ruleError carries the message with the configured numbers while still
+// matching the rule's sentinel with errors.Is.
+type ruleError struct {
+	rule error
+	msg  string
+}
+
+func (e *ruleError) Error() string { return e.msg }
+func (e *ruleError) Unwrap() error { return e.rule }
+
+func (s *Service) SetPasswordPolicy(policy PasswordPolicy) {
+	s.policy = policy
+}
+
+// Validate checks every rule and joins all failures, so the user can fix
+// them in one go.
+func (p PasswordPolicy) Validate(username, password string) error {
+	var errs []error
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		errs = append(errs, &ruleError{ErrPasswordLength, fmt.Sprintf("password must be at least %d characters long", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		errs = append(errs, &ruleError{ErrPasswordTooLong, fmt.Sprintf("password must be at most %d characters long", p.MaxLength)})
+	}
+
+	if p.RequireUpper && !upperPattern.MatchString(password) {
+		errs = append(errs, ErrPasswordUppercase)
+	}
+	if p.RequireLower && !lowerPattern.MatchString(password) {
+		errs = append(errs, ErrPasswordLowercase)
+	}
+	if p.RequireDigit && !digitPattern.MatchString(password) {
+		errs = append(errs, ErrPasswordDigit)
+	}
+	if p.RequireSpecial && !specialPattern.MatchString(password) {
+		errs = append(errs, ErrPasswordSpecial)
+	}
+
+	if p.DisallowUsername && username != "" &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		errs = append(errs, ErrPasswordContainsUsername)
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		errs = append(errs, ErrPasswordBreached)
+	}
+
+	return errors.Join(errs...)
+}
+
+// BreachedList is a Bloom filter over the SHA-1 of known breached
+// passwords. It never misses a listed password and rarely flags one that
+// isn't listed.
+type BreachedList struct {
+	bits  []uint64
+	m     uint64
+	k     uint64
+	Count int
+}
+
+// LoadBreachedList reads one password per line, either in plain text or as
+// a SHA-1 hex digest. The "HASH:COUNT" lines of the Have I Been Pwned dumps
+// work as they are.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	n, err := countLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBreachedList(max(n, 1))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		b.add(digestLine(line))
+		b.Count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("user: error reading %s, %v", path, err)
+	}
+
+	return b, nil
+}
+
+func (b *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	return b.test(sum)
+}
+
+// newBreachedList sizes the filter for n entries at the target false
+// positive rate.
+func newBreachedList(n int) *BreachedList {
+	m := uint64(math.Ceil(-float64(n) * math.Log(breachedFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &BreachedList{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (b *BreachedList) add(sum [sha1.Size]byte) {
+	h1, h2 := splitDigest(sum)
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % b.m
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (b *BreachedList) test(sum [sha1.Size]byte) bool {
+	h1, h2 := splitDigest(sum)
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % b.m
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitDigest derives the two base hashes for double hashing, SHA-1 is
+// uniform enough to use its bytes directly.
+func splitDigest(sum [sha1.Size]byte) (uint64, uint64) {
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+func digestLine(line string) [sha1.Size]byte {
+	hash, _, _ := strings.Cut(line, ":")
+	if len(hash) == 2*sha1.Size {
+		var sum [sha1.Size]byte
+		if _, err := hex.Decode(sum[:], []byte(hash)); err == nil {
+			return sum
+		}
+	}
+
+	return sha1.Sum([]byte(line))
+}
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n, scanner.Err()
+}
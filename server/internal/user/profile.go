@@ -0,0 +1,225 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 32
+	maxBioLength         = 280
+	maxStatusTextLength  = 100
+	MaxAvatarSize        = 1 << 20
+)
+
+var (
+	ErrDisplayNameLength = fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	ErrBioLength         = fmt.Errorf("bio must be at most %d characters", maxBioLength)
+	ErrStatusTextLength  = fmt.Errorf("status text must be at most %d characters", maxStatusTextLength)
+	ErrInvalidTimeZone   = errors.New("invalid time zone")
+	ErrInvalidEmail      = errors.New("invalid email address")
+
+	ErrAvatarTooLarge = fmt.Errorf("avatar must be at most %d bytes", MaxAvatarSize)
+	ErrAvatarType     = errors.New("avatar must be a png, jpeg, gif or webp image")
+	ErrAvatarNotFound = errors.New("avatar not found")
+)
+
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// ProfileUpdate holds the fields of a PATCH, nil fields are left unchanged.
+// Changing the email address, where password resets go, takes the current
+// password.
+type ProfileUpdate struct {
+	DisplayName     *string `json:"display_name"`
+	Bio             *string `json:"bio"`
+	TimeZone        *string `json:"time_zone"`
+	StatusText      *string `json:"status_text"`
+	Email           *string `json:"email"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+func (s *Service) GetUser(ctx context.Context, id string) (*User, error) {
+	return s.repo.GetUserByID(ctx, id)
+}
+
+func (s *Service) UpdateProfile(ctx context.Context, id string, p ProfileUpdate) (*User, error) {
+	u, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.DisplayName != nil {
+		name := strings.TrimSpace(*p.DisplayName)
+		if utf8.RuneCountInString(name) > maxDisplayNameLength {
+			return nil, ErrDisplayNameLength
+		}
+		u.DisplayName = name
+	}
+
+	if p.Bio != nil {
+		bio := strings.TrimSpace(*p.Bio)
+		if utf8.RuneCountInString(bio) > maxBioLength {
+			return nil, ErrBioLength
+		}
+		u.Bio = bio
+	}
+
+	if p.TimeZone != nil {
+		if *p.TimeZone != "" {
+			if _, err := time.LoadLocation(*p.TimeZone); err != nil {
+				return nil, ErrInvalidTimeZone
+			}
+		}
+		u.TimeZone = *p.TimeZone
+	}
+
+	if p.StatusText != nil {
+		status := strings.TrimSpace(*p.StatusText)
+		if utf8.RuneCountInString(status) > maxStatusTextLength {
+			return nil, ErrStatusTextLength
+		}
+		u.StatusText = status
+	}
+
+	oldEmail := u.Email
+	if p.Email != nil {
+		email, err := normalizeEmail(*p.Email)
+		if err != nil {
+			return nil, err
+		}
+		if email != u.Email {
+			if err := s.checkCurrentPassword(ctx, u, p.CurrentPassword); err != nil {
+				s.recordResult(ctx, audit.Entry{Action: audit.ActionEmailChange, TargetID: u.ID}, err)
+				return nil, err
+			}
+		}
+		u.Email = email
+	}
+
+	if err := s.repo.UpdateProfile(ctx, u); err != nil {
+		return nil, fmt.Errorf("user: failed to update profile, %v", err)
+	}
+
+	s.publishProfile(ctx, u)
+
+	if u.Email != oldEmail {
+		log.Printf("user: email of %s changed", u.ID)
+		s.record(ctx, audit.Entry{
+			Action:   audit.ActionEmailChange,
+			TargetID: u.ID,
+			Details:  map[string]string{"removed": strconv.FormatBool(u.Email == "")},
+		})
+		if s.notifier != nil && oldEmail != "" {
+			go s.sendEmailChanged(u, oldEmail)
+		}
+	}
+
+	return u, nil
+}
+
+// normalizeEmail accepts a bare address, an empty string removes it.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return addr.Address, nil
+}
+
+func (s *Service) SetAvatar(ctx context.Context, id string, data []byte) (*User, error) {
+	if len(data) > MaxAvatarSize {
+		return nil, ErrAvatarTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	if !avatarTypes[contentType] {
+		return nil, ErrAvatarType
+	}
+
+	u, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Avatar = strconv.FormatInt(time.Now().UnixNano(), 36)
+	u.AvatarType = contentType
+
+	if err := s.repo.SetAvatar(ctx, u, data); err != nil {
+		return nil, fmt.Errorf("user: failed to save avatar, %v", err)
+	}
+
+	s.publishProfile(ctx, u)
+
+	return u, nil
+}
+
+func (s *Service) DeleteAvatar(ctx context.Context, id string) (*User, error) {
+	u, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Avatar = ""
+	u.AvatarType = ""
+
+	if err := s.repo.DeleteAvatar(ctx, u); err != nil {
+		return nil, fmt.Errorf("user: failed to delete avatar, %v", err)
+	}
+
+	s.publishProfile(ctx, u)
+
+	return u, nil
+}
+
+func (s *Service) GetAvatar(ctx context.Context, id string) (string, []byte, error) {
+	u, err := s.repo.GetUserByID(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Avatar == "" {
+		return "", nil, ErrAvatarNotFound
+	}
+
+	data, err := s.repo.GetAvatar(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return u.AvatarType, data, nil
+}
+
+func (s *Service) publishProfile(ctx context.Context, u *User) {
+	data, _ := json.Marshal(events.UserProfile{
+		ID:          u.ID,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		AvatarURL:   u.AvatarURL(),
+		StatusText:  u.StatusText,
+	})
+
+	if err := s.repo.PublishEvent(ctx, events.Event{Type: events.UserUpdated, Data: data}); err != nil {
+		log.Printf("user: failed to publish profile update, %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/notify"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+const (
+	passwordResetExpirationTime = time.Hour
+	// passwordResetInterval is the minimum gap between two reset mails to
+	// the same account.
+	passwordResetInterval = time.Minute
+	notifyTimeout         = 30 * time.Second
+)
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	ErrResetUnavailable  = errors.New("password reset is not configured")
+)
+
+// SetPasswordReset turns on password reset mails. The token is appended to
+// linkURL as the token query parameter.
+func (s *Service) SetPasswordReset(n notify.Notifier, linkURL string) {
+	s.notifier = n
+	s.resetURL = linkURL
+}
+
+// ChangePassword needs the current password, accounts from single sign-on
+// without one can set a first password with an empty current password.
+// Every other session is signed out.
+func (s *Service) ChangePassword(ctx context.Context, claims *CustomClaims, current, password string) error {
+	err := s.changePassword(ctx, claims, current, password)
+	if !isValidationError(err) {
+		s.recordResult(ctx, audit.Entry{
+			Action:   audit.ActionPasswordChange,
+			ActorID:  claims.UserID,
+			TargetID: claims.UserID,
+		}, err)
+	}
+	return err
+}
+
+func (s *Service) changePassword(ctx context.Context, claims *CustomClaims, current, password string) error {
+	u, err := s.GetUser(ctx, claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkCurrentPassword(ctx, u, current); err != nil {
+		return err
+	}
+
+	if err := s.setPassword(ctx, u, password); err != nil {
+		return err
+	}
+
+	if _, err := s.RevokeOtherSessions(ctx, u.ID, claims.SessionID); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkCurrentPassword guards changes to how an account is recovered.
+// Wrong guesses count towards the login lockout. Accounts without a
+// password pass.
+func (s *Service) checkCurrentPassword(ctx context.Context, u *User, current string) error {
+	attempt, err := s.reserveLoginAttempt(ctx, u.Username, "")
+	if err != nil {
+		return err
+	}
+	if u.Password == "" {
+		s.refundLoginAttempt(ctx, attempt)
+		return nil
+	}
+
+	ok, _, err := s.checkPassword(u.Password, current)
+	if err != nil {
+		s.refundLoginAttempt(ctx, attempt)
+		return fmt.Errorf("user: failed to check password, %v", err)
+	}
+	if !ok {
+		s.loginFailed(ctx, attempt)
+		return ErrInvalidCredentials
+	}
+
+	s.refundLoginAttempt(ctx, attempt)
+	return nil
+}
+
+// RequestPasswordReset mails a reset link if the account exists and has an
+// email address. It answers the same either way and sends in the
+// background, so it can't be used to find out who has an account.
+func (s *Service) RequestPasswordReset(ctx context.Context, username string) error {
+	if s.notifier == nil {
+		return ErrResetUnavailable
+	}
+
+	entry := audit.Entry{Action: audit.ActionResetRequest, Details: map[string]string{"username": username}}
+
+	u, err := s.repo.GetUserByUsername(ctx, username)
+	if err != nil || u.Email == "" {
+		entry.Outcome = audit.Failure
+		entry.Details["error"] = "no account with an email address"
+		if u != nil {
+			entry.TargetID = u.ID
+		}
+		s.record(ctx, entry)
+		return nil
+	}
+	entry.TargetID = u.ID
+
+	allowed, err := s.repo.AllowPasswordResetMail(ctx, u.ID, passwordResetInterval)
+	if err != nil {
+		return fmt.Errorf("user: failed to check reset interval, %v", err)
+	}
+	if !allowed {
+		entry.Outcome = audit.Denied
+		entry.Details["error"] = "a reset mail was sent recently"
+		s.record(ctx, entry)
+		return nil
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return fmt.Errorf("user: error generating reset token: %v", err)
+	}
+
+	if err := s.repo.CreatePasswordReset(ctx, hashToken(token), u.ID, passwordResetExpirationTime); err != nil {
+		return fmt.Errorf("user: failed to store reset token, %v", err)
+	}
+
+	go s.sendPasswordReset(u, token)
+	s.record(ctx, entry)
+
+	return nil
+}
+
+// ResetPassword sets a new password with a token from a reset mail. The
+// token works once, and every session of the account ends.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) error {
+	hash := hashToken(token)
+
+	userID, err := s.repo.GetPasswordReset(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+
+	// Validate before using up the token, so a rejected password can be
+	// retried with the same link.
+	if err := s.policy.Validate(u.Username, password); err != nil {
+		return err
+	}
+
+	if consumed, err := s.repo.ConsumePasswordReset(ctx, hash); err != nil {
+		return err
+	} else if consumed != u.ID {
+		return ErrInvalidResetToken
+	}
+
+	if err := s.setPassword(ctx, u, password); err != nil {
+		return err
+	}
+
+	if _, err := s.RevokeOtherSessions(ctx, u.ID, ""); err != nil {
+		return err
+	}
+
+	// The owner proved control of the mailbox, a lockout from someone
+	// guessing the old password shouldn't keep them out.
+	s.resetLoginFailures(ctx, u.Username)
+
+	s.record(ctx, audit.Entry{Action: audit.ActionPasswordReset, ActorID: u.ID, TargetID: u.ID})
+
+	return nil
+}
+
+// setPassword validates and stores a new password and drops any reset
+// token still out there.
+func (s *Service) setPassword(ctx context.Context, u *User, password string) error {
+	if err := s.policy.Validate(u.Username, password); err != nil {
+		return err
+	}
+
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("user: failed to hash password, %v", err)
+	}
+
+	if err := s.repo.SetPassword(ctx, u.ID, hash); err != nil {
+		return fmt.Errorf("user: failed to save password, %v", err)
+	}
+
+	if err := s.repo.DeletePasswordResets(ctx, u.ID); err != nil {
+		log.Printf("user: failed to delete reset tokens, %v", err)
+	}
+
+	return nil
+}
+
+// sendEmailChanged tells the old address that the account moved away from
+// it, so a takeover doesn't go unnoticed.
+func (s *Service) sendEmailChanged(u *User, oldEmail string) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"the email address of your chatter account was changed, mails such as password resets no longer go to this address.\n\n"+
+		"If you didn't change it, reset your password and contact an administrator.\n",
+		u.Name())
+
+	err := s.notifier.Send(ctx, notify.Message{
+		To:      oldEmail,
+		Subject: "Your chatter email address was changed",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("user: failed to send email change notice to user %s, %v", u.ID, err)
+	}
+}
+
+func (s *Service) sendPasswordReset(u *User, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	link := s.resetURL + "?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf("Hi %s,\n\n"+
+		"someone asked to reset the password of your chatter account. If that was you, open this link within %d minutes:\n\n"+
+		"%s\n\n"+
+		"If it wasn't, you can ignore this mail, your password stays the same.\n",
+		u.Name(), int(passwordResetExpirationTime.Minutes()), link)
+
+	err := s.notifier.Send(ctx, notify.Message{
+		To:      u.Email,
+		Subject: "Reset your chatter password",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("user: failed to send password reset to user %s, %v", u.ID, err)
+	}
+}
@@ -0,0 +1,231 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Role is what a user may do, globally or in one room. Roles are ordered,
+// each one can do everything the roles below it can.
+type Role string
+
+const (
+	RoleOwner     Role = "owner"
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleGuest     Role = "guest"
+)
+
+var roleRanks = map[Role]int{
+	RoleGuest:     0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+	RoleOwner:     4,
+}
+
+// Permission names an action that routes and services check for.
+type Permission string
+
+const (
+	PermSendMessages Permission = "messages:send"
+	PermModerate     Permission = "moderation"
+	PermManageRoles  Permission = "roles:manage"
+	PermViewAudit    Permission = "audit:read"
+	PermManageBots   Permission = "bots:manage"
+)
+
+// permissionRoles holds the lowest role that has each permission.
+var permissionRoles = map[Permission]Role{
+	PermSendMessages: RoleMember,
+	PermModerate:     RoleModerator,
+	PermManageRoles:  RoleAdmin,
+	PermViewAudit:    RoleAdmin,
+	PermManageBots:   RoleAdmin,
+}
+
+var (
+	ErrInvalidRole   = errors.New("role must be owner, admin, moderator, member or guest")
+	ErrInvalidRoom   = errors.New("invalid room")
+	ErrRoleForbidden = errors.New("not allowed to give or take this role")
+	ErrRoleSelf      = errors.New("can't change your own role")
+)
+
+func ParseRole(s string) (Role, error) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := roleRanks[role]; !ok {
+		return "", ErrInvalidRole
+	}
+	return role, nil
+}
+
+// orMember treats a missing role, as in accounts and tokens from before
+// roles, as member.
+func (r Role) orMember() Role {
+	if _, ok := roleRanks[r]; !ok {
+		return RoleMember
+	}
+	return r
+}
+
+func (r Role) Can(p Permission) bool {
+	min, ok := permissionRoles[p]
+	if !ok {
+		return false
+	}
+	return roleRanks[r.orMember()] >= roleRanks[min]
+}
+
+func (r Role) Outranks(other Role) bool {
+	return roleRanks[r.orMember()] > roleRanks[other.orMember()]
+}
+
+// RoleIn is the user's role in a room, the room role when one was given and
+// the global role otherwise. An empty room is the global role.
+func (c *CustomClaims) RoleIn(room string) Role {
+	if role, ok := c.RoomRoles[room]; ok && room != "" {
+		return role.orMember()
+	}
+	return c.Role.orMember()
+}
+
+func (c *CustomClaims) Can(p Permission, room string) bool {
+	return c.RoleIn(room).Can(p)
+}
+
+// RoleAssignment is a role given to a user, Room is empty for a global one.
+type RoleAssignment struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Room     string `json:"room,omitempty"`
+	Role     Role   `json:"role"`
+}
+
+func validateRoom(room string) error {
+	if len(room) > 64 || strings.ContainsAny(room, ": ") {
+		return ErrInvalidRoom
+	}
+	return nil
+}
+
+// SetRole gives userID a role, in room or globally when room is empty.
+// Giving member globally or an empty role in a room takes the role away.
+// Owners may change anyone but themselves, others only users below them
+// and only to roles below their own.
+func (s *Service) SetRole(ctx context.Context, actor *CustomClaims, userID, room string, role Role) error {
+	err := s.setRole(ctx, actor, userID, room, role)
+	if errors.Is(err, ErrRoleForbidden) || errors.Is(err, ErrRoleSelf) {
+		s.recordResult(ctx, audit.Entry{
+			Action:   audit.ActionRoleChange,
+			ActorID:  actor.UserID,
+			TargetID: userID,
+			Details:  map[string]string{"room": room, "role": string(role)},
+		}, err)
+	}
+	return err
+}
+
+func (s *Service) setRole(ctx context.Context, actor *CustomClaims, userID, room string, role Role) error {
+	if actor.UserID == userID {
+		return ErrRoleSelf
+	}
+	if err := validateRoom(room); err != nil {
+		return err
+	}
+	if !actor.Can(PermManageRoles, room) {
+		return ErrRoleForbidden
+	}
+
+	target, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	actorRole := actor.RoleIn(room)
+	if actorRole != RoleOwner {
+		current := target.Role
+		if room != "" {
+			roomRoles, err := s.repo.GetRoomRoles(ctx, userID)
+			if err != nil {
+				return fmt.Errorf("user: failed to load room roles, %v", err)
+			}
+			if roomRole, ok := roomRoles[room]; ok && roomRole.Outranks(current) {
+				current = roomRole
+			}
+		}
+		if !actorRole.Outranks(current) || (role != "" && !actorRole.Outranks(role)) {
+			return ErrRoleForbidden
+		}
+	}
+
+	return s.AssignRole(ctx, userID, room, role)
+}
+
+// AssignRole stores a role without checking who asks, for the admin
+// command and SetRole. Tokens issued before carry the old roles and are
+// rejected, clients pick up the new ones with their next refresh.
+func (s *Service) AssignRole(ctx context.Context, userID, room string, role Role) error {
+	if err := validateRoom(room); err != nil {
+		return err
+	}
+	if role != "" {
+		if _, ok := roleRanks[role]; !ok {
+			return ErrInvalidRole
+		}
+	}
+	if room == "" && role == "" {
+		role = RoleMember
+	}
+
+	if err := s.repo.SetRole(ctx, userID, room, role); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return err
+		}
+		return fmt.Errorf("user: failed to set role, %v", err)
+	}
+
+	log.Printf("user: role of %s in %q set to %q", userID, room, role)
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionRoleChange,
+		TargetID: userID,
+		Details:  map[string]string{"room": room, "role": string(role)},
+	})
+	return nil
+}
+
+// ListRoles returns everyone with a global role other than member, or with
+// any role in room when one is given.
+func (s *Service) ListRoles(ctx context.Context, room string) ([]RoleAssignment, error) {
+	if err := validateRoom(room); err != nil {
+		return nil, err
+	}
+
+	roles, err := s.repo.ListRoles(ctx, room)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to list roles, %v", err)
+	}
+
+	assignments := make([]RoleAssignment, 0, len(roles))
+	for userID, role := range roles {
+		a := RoleAssignment{UserID: userID, Room: room, Role: role}
+		if u, err := s.repo.GetUserByID(ctx, userID); err == nil {
+			a.Username = u.Username
+		}
+		assignments = append(assignments, a)
+	}
+
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Role != assignments[j].Role {
+			return assignments[i].Role.Outranks(assignments[j].Role)
+		}
+		return assignments[i].Username < assignments[j].Username
+	})
+
+	return assignments, nil
+}
@@ -1,26 +1,26 @@
 package user
 
 import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"chatter/server/internal/keys"
+	"chatter/server/internal/notify"
 	"context"
-	"crypto/rsa"
 	"errors"
 	"fmt"
-	"regexp"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-const jwtExpirationTime = 24 * time.Hour
-
 var (
 	ErrUsernameLength        = errors.New("username must be between 4 and 20 characters")
 	ErrUsernameStart         = errors.New("username must start with a letter")
 	ErrUsernameContains      = errors.New("username can only contain letters, numbers, and underscores")
 	ErrUsernameAlreadyExists = errors.New("username already exists")
 
-	ErrPasswordLength    = errors.New("password must be at least 8 characters long")
+	ErrPasswordLength    = errors.New("password is too short")
 	ErrPasswordUppercase = errors.New("password must contain at least one uppercase letter")
 	ErrPasswordLowercase = errors.New("password must contain at least one lowercase letter")
 	ErrPasswordDigit     = errors.New("password must contain at least one digit")
@@ -33,128 +33,233 @@ var (
 type Repository interface {
 	CreateUser(ctx context.Context, u *User) error
 	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	UpdateProfile(ctx context.Context, u *User) error
+	SetAvatar(ctx context.Context, u *User, data []byte) error
+	GetAvatar(ctx context.Context, id string) ([]byte, error)
+	DeleteAvatar(ctx context.Context, u *User) error
+	PublishEvent(ctx context.Context, e events.Event) error
+
+	CreateSession(ctx context.Context, session *Session, ttl time.Duration) error
+	GetSessions(ctx context.Context, userID string) ([]Session, error)
+	TouchSession(ctx context.Context, sessionID string, lastSeen time.Time, ttl time.Duration) error
+	DeleteSession(ctx context.Context, userID, sessionID string) error
+	StoreRefreshToken(ctx context.Context, hash string, rt *RefreshToken, ttl time.Duration) error
+	ConsumeRefreshToken(ctx context.Context, hash string) (*RefreshToken, error)
+	RevokeTokenID(ctx context.Context, jti string, ttl time.Duration) error
+	IsTokenRevoked(ctx context.Context, jti, sessionID, userID string, rolesVersion int) (bool, error)
+
+	SetPendingTOTP(ctx context.Context, userID, secret string) error
+	EnableTOTP(ctx context.Context, userID, secret string, step int64, backupCodes []string) error
+	DisableTOTP(ctx context.Context, userID string) error
+	UseTOTPStep(ctx context.Context, userID string, step int64) (bool, error)
+	SetBackupCodes(ctx context.Context, userID string, hashes []string) error
+	ConsumeBackupCode(ctx context.Context, userID, hash string) (bool, error)
+	CountBackupCodes(ctx context.Context, userID string) (int, error)
+	CreateLoginChallenge(ctx context.Context, hash string, lc *LoginChallenge, ttl time.Duration) error
+	AttemptLoginChallenge(ctx context.Context, hash string) (*LoginChallenge, error)
+	DeleteLoginChallenge(ctx context.Context, hash string) (bool, error)
+
+	GetLoginAttempts(ctx context.Context, scope LoginScope, id string) (*LoginAttempts, error)
+	ReserveLoginAttempt(ctx context.Context, scope LoginScope, id string, at time.Time, window time.Duration, check func(*LoginAttempts) error) (*LoginAttempts, error)
+	RefundLoginAttempt(ctx context.Context, scope LoginScope, id string, at, previous time.Time) error
+	LockLogin(ctx context.Context, scope LoginScope, id string, until time.Time) error
+	ClearLoginAttempts(ctx context.Context, scope LoginScope, id string) error
+
+	ReplacePasswordHash(ctx context.Context, userID, oldHash, newHash string) error
+	ScanUsers(ctx context.Context, fn func(*User) error) error
+	MigrateUsernameKey(ctx context.Context, userID, previous, username string) error
+	HasLegacyUsernames(ctx context.Context) (bool, error)
+	RenameUser(ctx context.Context, userID, username string, aliasTTL time.Duration) (string, error)
+	ResolveUsername(ctx context.Context, username string) (string, bool, error)
+
+	SetRole(ctx context.Context, userID, room string, role Role) error
+	GetRoomRoles(ctx context.Context, userID string) (map[string]Role, error)
+	ListRoles(ctx context.Context, room string) (map[string]Role, error)
+
+	SaveSanction(ctx context.Context, sanction *Sanction) error
+	GetSanction(ctx context.Context, id string) (*Sanction, error)
+	DeleteSanction(ctx context.Context, sanction *Sanction) error
+	ListSanctions(ctx context.Context) ([]Sanction, error)
+	ActiveSanction(ctx context.Context, kind SanctionKind, userID, ip string) (*Sanction, error)
+
+	DeleteUser(ctx context.Context, job *ErasureJob) error
+	SaveErasureJob(ctx context.Context, job *ErasureJob) error
+	GetErasureJob(ctx context.Context, id string) (*ErasureJob, error)
+	PendingErasureJobs(ctx context.Context) ([]string, error)
+	ClaimErasureJob(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	ExtendErasureClaim(ctx context.Context, id string, ttl time.Duration) error
+	ReleaseErasureJob(ctx context.Context, id string) error
+
+	SaveOIDCState(ctx context.Context, hash string, st *OIDCState, ttl time.Duration) error
+	ConsumeOIDCState(ctx context.Context, hash string) (*OIDCState, error)
+	GetUserByOIDCIdentity(ctx context.Context, issuer, subject string) (*User, error)
+	LinkOIDCIdentity(ctx context.Context, userID, issuer, subject string) error
+	UnlinkOIDCIdentity(ctx context.Context, u *User) error
+
+	CreateAccessToken(ctx context.Context, t *AccessToken, hash string) error
+	GetAccessTokenByHash(ctx context.Context, hash string) (*AccessToken, error)
+	ListAccessTokens(ctx context.Context, userID string) ([]AccessToken, error)
+	DeleteAccessToken(ctx context.Context, userID, id string) error
+	TouchAccessToken(ctx context.Context, id string, at time.Time, ip string) error
+	ListBots(ctx context.Context) ([]User, error)
+
+	SetPassword(ctx context.Context, userID, hash string) error
+	AllowPasswordResetMail(ctx context.Context, userID string, interval time.Duration) (bool, error)
+	CreatePasswordReset(ctx context.Context, hash, userID string, ttl time.Duration) error
+	GetPasswordReset(ctx context.Context, hash string) (string, error)
+	ConsumePasswordReset(ctx context.Context, hash string) (string, error)
+	DeletePasswordResets(ctx context.Context, userID string) error
 }
 
 type Service struct {
-	repo       Repository
-	privateKey *rsa.PrivateKey
+	repo   Repository
+	keys   *keys.Set
+	oidc   *OIDCProvider
+	argon2 Argon2Params
+	policy PasswordPolicy
+
+	notifier notify.Notifier
+	resetURL string
+
+	messages      MessageStore
+	erasurePolicy ErasurePolicy
+	erasureWake   chan struct{}
+
+	audit AuditLog
+
+	dummyHashOnce sync.Once
+	dummyHash     string
 }
 
 type CustomClaims struct {
-	UserID   string `json:"id"`
-	Username string `json:"username"`
+	UserID    string `json:"id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	// Role is the global role, RoomRoles the rooms where the user has
+	// another one. RolesVersion tells stale claims apart.
+	Role         Role            `json:"role,omitempty"`
+	RoomRoles    map[string]Role `json:"room_roles,omitempty"`
+	RolesVersion int             `json:"rv,omitempty"`
+	// AccessTokenID and Scopes are set for personal access tokens, never
+	// read from a JWT.
+	AccessTokenID string  `json:"-"`
+	Scopes        []Scope `json:"-"`
 	jwt.RegisteredClaims
 }
 
-func NewService(repo Repository, privateKey *rsa.PrivateKey) *Service {
+func NewService(repo Repository, keySet *keys.Set) *Service {
 	return &Service{
-		repo:       repo,
-		privateKey: privateKey,
+		repo:   repo,
+		keys:   keySet,
+		argon2: DefaultArgon2Params,
+		policy: DefaultPasswordPolicy,
 	}
 }
 
+// Register reports every failed username and password rule at once, joined
+// with errors.Join.
 func (s *Service) Register(ctx context.Context, username, password string) error {
-	if err := validateUsername(username); err != nil {
-		return err
-	}
-	_, err := s.repo.GetUserByUsername(ctx, username)
-	if err == nil {
-		return ErrUsernameAlreadyExists
-	}
-
-	if err := validatePassword(password); err != nil {
+	username = NormalizeUsername(username)
+	if err := errors.Join(validateUsername(username), s.policy.Validate(username, password)); err != nil {
 		return err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := s.hashPassword(password)
 	if err != nil {
 		return fmt.Errorf("user: failed to hash password, %v", err)
 	}
 
 	u := User{
 		Username: username,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 	}
 
 	if err := s.repo.CreateUser(ctx, &u); err != nil {
+		if errors.Is(err, ErrUsernameAlreadyExists) {
+			return err
+		}
 		return fmt.Errorf("user: failed to create user, %v", err)
 	}
 
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionRegister,
+		ActorID:  u.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"username": u.Username, "method": loginMethodPassword},
+	})
+
 	return nil
 }
 
-func (s *Service) Login(ctx context.Context, username, password string) (string, error) {
-	u, err := s.repo.GetUserByUsername(ctx, username)
+// Login checks the password. Users with 2FA get a challenge instead of
+// tokens, see VerifyLoginChallenge. Unknown users and wrong passwords fail
+// the same way and take the same time.
+func (s *Service) Login(ctx context.Context, username, password string, client ClientInfo) (*LoginResult, error) {
+	u, result, err := s.login(ctx, username, password, client)
 	if err != nil {
-		return "", ErrUserNotFound
-	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
-		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
-			return "", ErrInvalidCredentials
+		// Failures are recorded against the account when the name is
+		// known, so attempts on it show up under its ID.
+		var userID string
+		if u != nil {
+			userID = u.ID
 		}
-		return "", fmt.Errorf("user: failed to check password, %v", err)
-	}
-
-	jwtToken, err := s.generateToken(u.ID, u.Username)
-	if err != nil {
-		return "", fmt.Errorf("user: error genrating jwt token: %v", err)
-	}
-
-	return jwtToken, nil
-}
-
-func (s *Service) generateToken(userID, username string) (string, error) {
-	claims := CustomClaims{
-		UserID:   userID,
-		Username: username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(jwtExpirationTime)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+		s.recordLogin(ctx, userID, username, loginMethodPassword, err)
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-
-	return token.SignedString(s.privateKey)
+	return result, err
 }
 
-func validateUsername(username string) error {
-	if len(username) < 4 || len(username) > 20 {
-		return ErrUsernameLength
+// login returns the user the name belongs to, when there is one, along with
+// the result.
+func (s *Service) login(ctx context.Context, username, password string, client ClientInfo) (*User, *LoginResult, error) {
+	u, err := s.repo.GetUserByUsername(ctx, username)
+	if err != nil {
+		u = nil
 	}
 
-	if matched, _ := regexp.MatchString(`^[a-zA-Z]`, username); !matched {
-		return ErrUsernameStart
+	attempt, err := s.reserveLoginAttempt(ctx, username, client.IP)
+	if err != nil {
+		return u, nil, err
 	}
 
-	if matched, _ := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_]*$`, username); !matched {
-		return ErrUsernameContains
+	// Accounts created through single sign-on have no password.
+	if u == nil || u.Password == "" {
+		s.equalizeTiming(password)
+		s.loginFailed(ctx, attempt)
+		return u, nil, ErrInvalidCredentials
 	}
 
-	return nil
-}
-
-func validatePassword(password string) error {
-	if len(password) < 8 {
-		return ErrPasswordLength
+	ok, rehash, err := s.checkPassword(u.Password, password)
+	if err != nil {
+		s.refundLoginAttempt(ctx, attempt)
+		return u, nil, fmt.Errorf("user: failed to check password, %v", err)
 	}
-
-	if matched, _ := regexp.MatchString(`[A-Z]`, password); !matched {
-		return ErrPasswordUppercase
+	if !ok {
+		s.loginFailed(ctx, attempt)
+		return u, nil, ErrInvalidCredentials
 	}
-
-	if matched, _ := regexp.MatchString(`[a-z]`, password); !matched {
-		return ErrPasswordLowercase
+	if rehash {
+		s.rehashPassword(ctx, u, password)
 	}
 
-	if matched, _ := regexp.MatchString(`[0-9]`, password); !matched {
-		return ErrPasswordDigit
+	// Failures are only forgotten after the second factor, otherwise a
+	// known password would reset the count for guessing codes.
+	if u.TOTPSecret != "" {
+		s.refundLoginAttempt(ctx, attempt)
+		// startSession checks bans as well, this spares banned users the
+		// second factor.
+		if err := s.checkBan(ctx, u.ID, client.IP); err != nil {
+			return u, nil, err
+		}
+		result, err := s.createLoginChallenge(ctx, u, client)
+		return u, result, err
 	}
+	s.loginSucceeded(ctx, attempt)
 
-	if matched, _ := regexp.MatchString(`[\W_]`, password); !matched {
-		return ErrPasswordSpecial
+	tokens, err := s.startSession(ctx, u, client, loginMethodPassword)
+	if err != nil {
+		return u, nil, err
 	}
 
-	return nil
+	return u, &LoginResult{Tokens: tokens}, nil
 }
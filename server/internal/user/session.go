@@ -0,0 +1,154 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login on one device. It lives as long as its refresh
+// tokens, access tokens carry its ID and die with it.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// startSession is where every way of logging in ends, banned users are
+// turned away here whichever way they came. Successful logins are recorded
+// here, failed ones by each way in.
+func (s *Service) startSession(ctx context.Context, u *User, client ClientInfo, method string) (*Tokens, error) {
+	if err := s.checkBan(ctx, u.ID, client.IP); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:         uuid.NewString(),
+		UserID:     u.ID,
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+
+	if err := s.repo.CreateSession(ctx, &session, refreshTokenExpirationTime); err != nil {
+		return nil, fmt.Errorf("user: failed to create session, %v", err)
+	}
+
+	tokens, err := s.issueTokens(ctx, u, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordLogin(ctx, u.ID, u.Username, method, nil)
+	return tokens, nil
+}
+
+func (s *Service) GetSessions(ctx context.Context, userID, currentSessionID string) ([]Session, error) {
+	sessions, err := s.repo.GetSessions(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to load sessions, %v", err)
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	return sessions, nil
+}
+
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	sessions, err := s.repo.GetSessions(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("user: failed to load sessions, %v", err)
+	}
+
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			err := s.revokeSession(ctx, userID, sessionID)
+			s.recordResult(ctx, audit.Entry{
+				Action:   audit.ActionSessionRevoke,
+				TargetID: userID,
+				Details:  map[string]string{"session_id": sessionID},
+			}, err)
+			return err
+		}
+	}
+
+	return ErrSessionNotFound
+}
+
+// RevokeOtherSessions signs the user out everywhere except keepSessionID,
+// pass an empty ID to end every session.
+func (s *Service) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) (int, error) {
+	sessions, err := s.repo.GetSessions(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("user: failed to load sessions, %v", err)
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID == keepSessionID {
+			continue
+		}
+		if err := s.revokeSession(ctx, userID, session.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	if revoked > 0 {
+		s.record(ctx, audit.Entry{
+			Action:   audit.ActionSessionRevoke,
+			TargetID: userID,
+			Details:  map[string]string{"revoked": strconv.Itoa(revoked), "kept": keepSessionID},
+		})
+	}
+
+	return revoked, nil
+}
+
+// revokeSession deletes the session and drops the WebSockets opened with
+// it.
+func (s *Service) revokeSession(ctx context.Context, userID, sessionID string) error {
+	if err := s.repo.DeleteSession(ctx, userID, sessionID); err != nil {
+		return fmt.Errorf("user: failed to revoke session, %v", err)
+	}
+
+	s.publishSessionRevoked(ctx, userID, sessionID)
+	return nil
+}
+
+// publishSessionRevoked tells every server instance to drop the WebSockets
+// opened with the session or access token.
+func (s *Service) publishSessionRevoked(ctx context.Context, userID, sessionID string) {
+	data, _ := json.Marshal(events.RevokedSession{SessionID: sessionID})
+	err := s.repo.PublishEvent(ctx, events.Event{
+		Type:   events.SessionRevoked,
+		UserID: userID,
+		Data:   data,
+	})
+	if err != nil {
+		log.Printf("user: failed to publish session revocation, %v", err)
+	}
+}
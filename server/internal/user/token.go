@@ -0,0 +1,200 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/keys"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenExpirationTime  = 15 * time.Minute
+	refreshTokenExpirationTime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected, session revoked")
+)
+
+type Tokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// RefreshToken is the stored side of a refresh token. Every refresh consumes
+// the token and issues a new one in the same session, a consumed token that
+// is presented again means it leaked and the whole session is revoked.
+type RefreshToken struct {
+	UserID    string
+	SessionID string
+	Used      bool
+}
+
+func (s *Service) issueTokens(ctx context.Context, u *User, sessionID string) (*Tokens, error) {
+	roomRoles, err := s.repo.GetRoomRoles(ctx, u.ID)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to load room roles, %v", err)
+	}
+
+	accessToken, err := s.generateToken(u, roomRoles, sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("user: error genrating jwt token: %v", err)
+	}
+
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("user: error generating refresh token: %v", err)
+	}
+
+	rt := RefreshToken{UserID: u.ID, SessionID: sessionID}
+	if err := s.repo.StoreRefreshToken(ctx, hashToken(refreshToken), &rt, refreshTokenExpirationTime); err != nil {
+		return nil, fmt.Errorf("user: failed to store refresh token, %v", err)
+	}
+
+	return &Tokens{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenExpirationTime.Seconds()),
+	}, nil
+}
+
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*Tokens, error) {
+	rt, err := s.repo.ConsumeRefreshToken(ctx, hashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.Used {
+		log.Printf("user: refresh token reuse for session %s, revoking", rt.SessionID)
+		if err := s.revokeSession(ctx, rt.UserID, rt.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	err = s.repo.TouchSession(ctx, rt.SessionID, time.Now().UTC(), refreshTokenExpirationTime)
+	if err != nil {
+		if errors.Is(err, ErrSessionNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, fmt.Errorf("user: failed to extend session, %v", err)
+	}
+
+	u, err := s.repo.GetUserByID(ctx, rt.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	return s.issueTokens(ctx, u, rt.SessionID)
+}
+
+// Logout kills the access token it was called with and the session behind
+// it, so the refresh token stops working as well.
+func (s *Service) Logout(ctx context.Context, claims *CustomClaims) error {
+	if err := s.RevokeToken(ctx, claims); err != nil {
+		return err
+	}
+
+	if claims.SessionID != "" {
+		if err := s.revokeSession(ctx, claims.UserID, claims.SessionID); err != nil {
+			return err
+		}
+	}
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionLogout,
+		ActorID:  claims.UserID,
+		TargetID: claims.UserID,
+		Details:  map[string]string{"session_id": claims.SessionID},
+	})
+	return nil
+}
+
+// RevokeToken puts the token's jti on the denylist until it expires.
+func (s *Service) RevokeToken(ctx context.Context, claims *CustomClaims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if err := s.repo.RevokeTokenID(ctx, claims.ID, ttl); err != nil {
+		return fmt.Errorf("user: failed to revoke token, %v", err)
+	}
+
+	return nil
+}
+
+// RevokeTokenID denylists a jti without the token at hand, for as long as
+// any access token can live.
+func (s *Service) RevokeTokenID(ctx context.Context, jti string) error {
+	if err := s.repo.RevokeTokenID(ctx, jti, accessTokenExpirationTime); err != nil {
+		return fmt.Errorf("user: failed to revoke token, %v", err)
+	}
+
+	return nil
+}
+
+// IsRevoked reports whether a validly signed token must still be rejected,
+// because its jti is denylisted, its session is gone or the user's roles
+// changed since it was issued. Tokens issued before sessions existed carry
+// neither and expire on their own.
+func (s *Service) IsRevoked(ctx context.Context, claims *CustomClaims) (bool, error) {
+	return s.repo.IsTokenRevoked(ctx, claims.ID, claims.SessionID, claims.UserID, claims.RolesVersion)
+}
+
+func (s *Service) generateToken(u *User, roomRoles map[string]Role, sessionID string) (string, error) {
+	now := time.Now()
+	claims := CustomClaims{
+		UserID:       u.ID,
+		Username:     u.Username,
+		SessionID:    sessionID,
+		Role:         u.Role.orMember(),
+		RoomRoles:    roomRoles,
+		RolesVersion: u.RolesVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenExpirationTime)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	key := s.keys.SigningKey()
+	if key == nil {
+		return "", keys.ErrNoKeys
+	}
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.PrivateKey)
+}
+
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
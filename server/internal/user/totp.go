@@ -0,0 +1,384 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer = "chatter"
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+	// totpSkew is how many periods before and after the current one are
+	// accepted, to cover clock drift on the phone.
+	totpSkew = 1
+
+	backupCodeCount = 10
+
+	loginChallengeExpirationTime = 5 * time.Minute
+	maxChallengeAttempts         = 5
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotPending = errors.New("start two-factor enrollment first")
+	ErrInvalidTwoFactor    = errors.New("invalid two-factor code")
+	ErrInvalidChallenge    = errors.New("invalid or expired login challenge")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// LoginResult is either a full set of tokens, or a challenge that has to be
+// exchanged together with a second factor when the user enabled 2FA.
+type LoginResult struct {
+	*Tokens
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	Challenge         string `json:"challenge,omitempty"`
+}
+
+// LoginChallenge is the stored side of a challenge token, it remembers who
+// passed the password step and from where.
+type LoginChallenge struct {
+	UserID   string
+	Client   ClientInfo
+	Attempts int
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TwoFactorStatus struct {
+	Enabled              bool `json:"enabled"`
+	BackupCodesRemaining int  `json:"backup_codes_remaining"`
+}
+
+func (s *Service) TwoFactorStatus(ctx context.Context, userID string) (*TwoFactorStatus, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TwoFactorStatus{Enabled: u.TOTPSecret != ""}
+	if !status.Enabled {
+		return status, nil
+	}
+
+	status.BackupCodesRemaining, err = s.repo.CountBackupCodes(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to count backup codes, %v", err)
+	}
+
+	return status, nil
+}
+
+// EnrollTOTP creates a new secret that stays pending until it is confirmed
+// with a code, so a half finished enrollment can't lock the user out.
+func (s *Service) EnrollTOTP(ctx context.Context, userID string) (*TOTPEnrollment, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPSecret != "" {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("user: failed to generate totp secret, %v", err)
+	}
+	secret := totpEncoding.EncodeToString(b)
+
+	if err := s.repo.SetPendingTOTP(ctx, userID, secret); err != nil {
+		return nil, fmt.Errorf("user: failed to store totp secret, %v", err)
+	}
+
+	return &TOTPEnrollment{Secret: secret, URI: totpURI(u.Username, secret)}, nil
+}
+
+// ConfirmTOTP enables 2FA once the user proves the authenticator works and
+// returns the backup codes, which are only ever shown here.
+func (s *Service) ConfirmTOTP(ctx context.Context, userID, code string) ([]string, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPSecret != "" {
+		return nil, ErrTwoFactorEnabled
+	}
+	if u.TOTPPending == "" {
+		return nil, ErrTwoFactorNotPending
+	}
+
+	step, ok := validateTOTP(u.TOTPPending, normalizeCode(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactor
+	}
+
+	codes, hashes, err := generateBackupCodes()
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to generate backup codes, %v", err)
+	}
+
+	if err := s.repo.EnableTOTP(ctx, userID, u.TOTPPending, step, hashes); err != nil {
+		return nil, fmt.Errorf("user: failed to enable totp, %v", err)
+	}
+
+	s.record(ctx, audit.Entry{Action: audit.ActionTwoFactorEnable, TargetID: userID})
+
+	return codes, nil
+}
+
+// DisableTOTP needs a current code, wrong ones are recorded as failures.
+func (s *Service) DisableTOTP(ctx context.Context, userID, code string) error {
+	err := s.disableTOTP(ctx, userID, code)
+	if err == nil || errors.Is(err, ErrInvalidTwoFactor) {
+		s.recordResult(ctx, audit.Entry{Action: audit.ActionTwoFactorDisable, TargetID: userID}, err)
+	}
+	return err
+}
+
+func (s *Service) disableTOTP(ctx context.Context, userID, code string) error {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.TOTPSecret == "" {
+		return ErrTwoFactorNotEnabled
+	}
+
+	if err := s.verifySecondFactor(ctx, u, code); err != nil {
+		return err
+	}
+
+	if err := s.repo.DisableTOTP(ctx, userID); err != nil {
+		return fmt.Errorf("user: failed to disable totp, %v", err)
+	}
+
+	return nil
+}
+
+// RegenerateBackupCodes replaces every remaining backup code.
+func (s *Service) RegenerateBackupCodes(ctx context.Context, userID, code string) ([]string, error) {
+	u, err := s.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnabled
+	}
+
+	if err := s.verifySecondFactor(ctx, u, code); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := generateBackupCodes()
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to generate backup codes, %v", err)
+	}
+
+	if err := s.repo.SetBackupCodes(ctx, userID, hashes); err != nil {
+		return nil, fmt.Errorf("user: failed to store backup codes, %v", err)
+	}
+
+	return codes, nil
+}
+
+// VerifyLoginChallenge finishes a login that stopped at the second factor.
+// A challenge survives a few wrong codes and is gone once it is used.
+func (s *Service) VerifyLoginChallenge(ctx context.Context, challenge, code string) (*Tokens, error) {
+	u, tokens, err := s.verifyLoginChallenge(ctx, challenge, code)
+	if err != nil {
+		var userID, username string
+		if u != nil {
+			userID, username = u.ID, u.Username
+		}
+		s.recordLogin(ctx, userID, username, loginMethodTOTP, err)
+	}
+	return tokens, err
+}
+
+// verifyLoginChallenge returns the user as soon as the challenge is known,
+// so failures can be recorded against them.
+func (s *Service) verifyLoginChallenge(ctx context.Context, challenge, code string) (*User, *Tokens, error) {
+	hash := hashToken(challenge)
+
+	lc, err := s.repo.AttemptLoginChallenge(ctx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lc.Attempts > maxChallengeAttempts {
+		s.repo.DeleteLoginChallenge(ctx, hash)
+		return nil, nil, ErrInvalidChallenge
+	}
+
+	u, err := s.repo.GetUserByID(ctx, lc.UserID)
+	if err != nil {
+		return nil, nil, ErrInvalidChallenge
+	}
+
+	attempt, err := s.reserveLoginAttempt(ctx, u.Username, lc.Client.IP)
+	if err != nil {
+		return u, nil, err
+	}
+
+	if err := s.verifySecondFactor(ctx, u, code); err != nil {
+		if errors.Is(err, ErrInvalidTwoFactor) {
+			s.loginFailed(ctx, attempt)
+		} else {
+			s.refundLoginAttempt(ctx, attempt)
+		}
+		return u, nil, err
+	}
+
+	// Only one request gets to delete the challenge, a second one racing
+	// with the same code must not get its own session.
+	deleted, err := s.repo.DeleteLoginChallenge(ctx, hash)
+	if err != nil {
+		s.refundLoginAttempt(ctx, attempt)
+		return u, nil, fmt.Errorf("user: failed to delete login challenge, %v", err)
+	}
+	if !deleted {
+		s.refundLoginAttempt(ctx, attempt)
+		return u, nil, ErrInvalidChallenge
+	}
+
+	s.loginSucceeded(ctx, attempt)
+
+	tokens, err := s.startSession(ctx, u, lc.Client, loginMethodTOTP)
+	return u, tokens, err
+}
+
+func (s *Service) createLoginChallenge(ctx context.Context, u *User, client ClientInfo) (*LoginResult, error) {
+	challenge, err := generateOpaqueToken()
+	if err != nil {
+		return nil, fmt.Errorf("user: error generating login challenge: %v", err)
+	}
+
+	lc := LoginChallenge{UserID: u.ID, Client: client}
+	if err := s.repo.CreateLoginChallenge(ctx, hashToken(challenge), &lc, loginChallengeExpirationTime); err != nil {
+		return nil, fmt.Errorf("user: failed to store login challenge, %v", err)
+	}
+
+	return &LoginResult{TwoFactorRequired: true, Challenge: challenge}, nil
+}
+
+// verifySecondFactor accepts a TOTP code or one of the backup codes. A TOTP
+// code is only good once, a code from a period that was already used is
+// rejected as a replay.
+func (s *Service) verifySecondFactor(ctx context.Context, u *User, code string) error {
+	code = normalizeCode(code)
+
+	if len(code) == totpDigits {
+		step, ok := validateTOTP(u.TOTPSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactor
+		}
+
+		fresh, err := s.repo.UseTOTPStep(ctx, u.ID, step)
+		if err != nil {
+			return fmt.Errorf("user: failed to record totp use, %v", err)
+		}
+		if !fresh {
+			return ErrInvalidTwoFactor
+		}
+		return nil
+	}
+
+	used, err := s.repo.ConsumeBackupCode(ctx, u.ID, hashToken(code))
+	if err != nil {
+		return fmt.Errorf("user: failed to check backup code, %v", err)
+	}
+	if !used {
+		return ErrInvalidTwoFactor
+	}
+
+	return nil
+}
+
+// validateTOTP checks code against the periods around now and returns the
+// period it matched.
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	if secret == "" || len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// totpCode is the HOTP value (RFC 4226) for a time step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func totpURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// generateBackupCodes returns the codes to show the user, formatted as
+// xxxx-xxxx, and the hashes to store.
+func generateBackupCodes() ([]string, []string, error) {
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -1,11 +1,96 @@
 // Package user deals with user logic
 package user
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type contextKey string
+
+const ClaimsKey contextKey = "user"
 
 type User struct {
-	ID        string    `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"-"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	Password    string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	Avatar      string    `json:"-"`
+	AvatarType  string    `json:"-"`
+	TimeZone    string    `json:"time_zone"`
+	StatusText  string    `json:"status_text"`
+	Email       string    `json:"-"`
+	TOTPSecret  string    `json:"-"`
+	TOTPPending string    `json:"-"`
+	OIDCIssuer  string    `json:"-"`
+	OIDCSubject string    `json:"-"`
+	Role        Role      `json:"role"`
+	// Bot accounts have no password and act through access tokens,
+	// OwnerID is the admin who created one.
+	Bot     bool   `json:"bot,omitempty"`
+	OwnerID string `json:"owner_id,omitempty"`
+	// RolesVersion changes with every role change, tokens carrying an
+	// older one are stale.
+	RolesVersion int `json:"-"`
+}
+
+type Profile struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	Bio         string    `json:"bio"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	TimeZone    string    `json:"time_zone"`
+	StatusText  string    `json:"status_text"`
+	Email       string    `json:"email,omitempty"`
+	Role        Role      `json:"role"`
+	Bot         bool      `json:"bot,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (u *User) Profile() *Profile {
+	return &Profile{
+		ID:          u.ID,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		AvatarURL:   u.AvatarURL(),
+		TimeZone:    u.TimeZone,
+		StatusText:  u.StatusText,
+		Role:        u.Role.orMember(),
+		Bot:         u.Bot,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+// OwnProfile is the profile as the user sees it, with private fields.
+func (u *User) OwnProfile() *Profile {
+	p := u.Profile()
+	p.Email = u.Email
+	return p
+}
+
+// AvatarURL points at the avatar endpoint. The version changes with every
+// upload so clients don't keep a stale image cached.
+func (u *User) AvatarURL() string {
+	if u.Avatar == "" {
+		return ""
+	}
+	return fmt.Sprintf("/api/user/%s/avatar?v=%s", u.ID, u.Avatar)
+}
+
+// Name is what other users see, the display name when one is set.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+func ClaimsFromContext(ctx context.Context) (*CustomClaims, bool) {
+	claims, ok := ctx.Value(ClaimsKey).(*CustomClaims)
+	return claims, ok
 }
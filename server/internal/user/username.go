@@ -0,0 +1,390 @@
+package user
+
+import (
+	"chatter/server/internal/audit"
+	"chatter/server/internal/events"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// usernameAliasDuration is how long a previous username keeps pointing at
+// the user after a rename.
+const usernameAliasDuration = 14 * 24 * time.Hour
+
+var (
+	ErrUsernameReserved    = errors.New("username is reserved")
+	ErrUsernameMixedScript = errors.New("username must not mix letters from different scripts")
+	ErrUsernameUnchanged   = errors.New("username is unchanged")
+)
+
+// reservedUsernames are compared in canonical form, so case variants and
+// lookalikes such as a Cyrillic "аdmin" are caught as well.
+var reservedUsernames = canonicalSet(
+	"admin", "administrator", "root", "system", "sysop", "moderator",
+	"support", "help", "helpdesk", "staff", "official", "owner", "security",
+	"chatter", "server", "bot", "null", "undefined", "anonymous", "deleted",
+	"everyone", "here", "guest", "nobody", "postmaster", "webmaster",
+	"noreply",
+)
+
+// confusables maps letters that look like a Latin letter to it, after
+// case folding. It covers the lookalikes that are common in impersonation,
+// not the full Unicode confusables table. Digits are left alone, user1 and
+// userl are different names.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i',
+	'ј': 'j', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'ӏ': 'l', 'ь': 'b',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ω': 'w',
+	// Latin
+	'ı': 'i', 'ȷ': 'j', 'ɡ': 'g', 'ɑ': 'a',
+}
+
+var confusableSequences = strings.NewReplacer("rn", "m", "vv", "w")
+
+var caseFolder = cases.Fold()
+
+// NormalizeUsername is the form a username is stored and shown in. NFKC
+// turns compatibility characters such as fullwidth letters into their
+// plain form, case is kept.
+func NormalizeUsername(username string) string {
+	return norm.NFKC.String(strings.TrimSpace(username))
+}
+
+// CanonicalUsername is the key usernames are unique under. Names that
+// differ only in case or in lookalike characters share a canonical form.
+func CanonicalUsername(username string) string {
+	folded := caseFolder.String(NormalizeUsername(username))
+
+	var b strings.Builder
+	for _, r := range folded {
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(r)
+	}
+
+	return norm.NFKC.String(confusableSequences.Replace(b.String()))
+}
+
+func isReservedUsername(username string) bool {
+	return reservedUsernames[CanonicalUsername(username)]
+}
+
+// validateUsername expects a normalized username.
+func validateUsername(username string) error {
+	if n := utf8.RuneCountInString(username); n < 4 || n > 20 {
+		return ErrUsernameLength
+	}
+
+	if first, _ := utf8.DecodeRuneInString(username); !unicode.IsLetter(first) {
+		return ErrUsernameStart
+	}
+
+	for _, r := range username {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) && (r < '0' || r > '9') && r != '_' {
+			return ErrUsernameContains
+		}
+	}
+
+	if !singleScript(username) {
+		return ErrUsernameMixedScript
+	}
+
+	if isReservedUsername(username) {
+		return ErrUsernameReserved
+	}
+
+	return nil
+}
+
+var usernameScripts = []string{
+	"Latin", "Greek", "Cyrillic", "Armenian", "Georgian", "Hebrew", "Arabic",
+	"Devanagari", "Bengali", "Tamil", "Telugu", "Thai", "Hangul", "Hiragana",
+	"Katakana", "Han",
+}
+
+// singleScript accepts letters from one script. Japanese mixes Han with the
+// kana and Korean mixes it with Hangul, so those combinations pass too.
+func singleScript(username string) bool {
+	found := make(map[string]bool)
+	for _, r := range username {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		script := "Other"
+		for _, name := range usernameScripts {
+			if unicode.Is(unicode.Scripts[name], r) {
+				script = name
+				break
+			}
+		}
+		found[script] = true
+	}
+
+	if len(found) <= 1 {
+		return true
+	}
+
+	for _, group := range [][]string{{"Han", "Hiragana", "Katakana"}, {"Han", "Hangul"}} {
+		n := 0
+		for _, script := range group {
+			if found[script] {
+				n++
+			}
+		}
+		if n == len(found) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func canonicalSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[CanonicalUsername(name)] = true
+	}
+	return set
+}
+
+type UsernameConflict struct {
+	Canonical string
+	Kept      *User
+	Others    []*User
+	// Renamed holds the names Others were given, in the same order. It is
+	// empty for a dry run.
+	Renamed []string
+}
+
+type UsernameMigration struct {
+	Total     int
+	Migrated  int
+	Conflicts []UsernameConflict
+}
+
+// MigrateUsernames moves the username index to canonical keys. The oldest
+// account of a canonical name keeps it, the others get the name with a
+// number appended.
+func (s *Service) MigrateUsernames(ctx context.Context, dryRun bool) (*UsernameMigration, error) {
+	groups := make(map[string][]*User)
+	var migration UsernameMigration
+
+	err := s.repo.ScanUsers(ctx, func(u *User) error {
+		migration.Total++
+		canonical := CanonicalUsername(u.Username)
+		groups[canonical] = append(groups[canonical], u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("user: failed to scan users, %v", err)
+	}
+
+	canonicals := make([]string, 0, len(groups))
+	for canonical := range groups {
+		canonicals = append(canonicals, canonical)
+	}
+	sort.Strings(canonicals)
+
+	for _, canonical := range canonicals {
+		users := groups[canonical]
+		sort.Slice(users, func(i, j int) bool {
+			return users[i].CreatedAt.Before(users[j].CreatedAt)
+		})
+
+		if len(users) > 1 {
+			migration.Conflicts = append(migration.Conflicts, UsernameConflict{
+				Canonical: canonical,
+				Kept:      users[0],
+				Others:    users[1:],
+			})
+		}
+
+		if dryRun {
+			migration.Migrated++
+			continue
+		}
+		if err := s.repo.MigrateUsernameKey(ctx, users[0].ID, users[0].Username, users[0].Username); err != nil {
+			return nil, fmt.Errorf("user: failed to migrate %q, %v", users[0].Username, err)
+		}
+		migration.Migrated++
+	}
+
+	if dryRun {
+		return &migration, nil
+	}
+
+	// Every kept name holds its canonical key by now, so a new name can't
+	// take one from an account migrated later.
+	for i := range migration.Conflicts {
+		c := &migration.Conflicts[i]
+		for _, u := range c.Others {
+			username, err := s.renameCollision(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+			c.Renamed = append(c.Renamed, username)
+		}
+	}
+
+	return &migration, nil
+}
+
+// renameCollision gives an account that lost its name to an older one the
+// first free numbered variant of it.
+func (s *Service) renameCollision(ctx context.Context, u *User) (string, error) {
+	for i := 1; i < 100; i++ {
+		candidate := usernameCandidate(u.Username, i)
+		if isReservedUsername(candidate) {
+			continue
+		}
+
+		err := s.repo.MigrateUsernameKey(ctx, u.ID, u.Username, candidate)
+		if errors.Is(err, ErrUsernameAlreadyExists) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("user: failed to rename %q, %v", u.Username, err)
+		}
+
+		s.record(ctx, audit.Entry{
+			Action:   audit.ActionUsernameChange,
+			TargetID: u.ID,
+			Details:  map[string]string{"from": u.Username, "to": candidate, "reason": "username collision"},
+		})
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("user: no free username for %q", u.Username)
+}
+
+// MigrateLegacyUsernames runs MigrateUsernames when names indexed before
+// canonical keys remain. The server does it before taking requests, so a
+// new account can't take the name of an old one that differs only in case.
+func (s *Service) MigrateLegacyUsernames(ctx context.Context) error {
+	legacy, err := s.repo.HasLegacyUsernames(ctx)
+	if err != nil {
+		return fmt.Errorf("user: failed to look for legacy usernames, %v", err)
+	}
+	if !legacy {
+		return nil
+	}
+
+	migration, err := s.MigrateUsernames(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range migration.Conflicts {
+		for i, u := range c.Others {
+			log.Printf("user: %s renamed %q to %q, the name is kept by %s", u.ID, u.Username, c.Renamed[i], c.Kept.ID)
+		}
+	}
+	log.Printf("user: migrated %d usernames of %d accounts, %d collisions", migration.Migrated, migration.Total, len(migration.Conflicts))
+
+	return nil
+}
+
+// usernameCandidate is base for i 0, and base with i+1 appended otherwise,
+// cut to fit the length limit.
+func usernameCandidate(base string, i int) string {
+	if i == 0 {
+		return base
+	}
+
+	suffix := strconv.Itoa(i + 1)
+	runes := []rune(base)
+	return string(runes[:min(len(runes), 20-len(suffix))]) + suffix
+}
+
+// RenameResult carries fresh tokens, the old ones still name the previous
+// username.
+type RenameResult struct {
+	*Tokens
+	User *Profile `json:"user"`
+}
+
+// ChangeUsername renames the user. The old name stays reserved for the user
+// and resolves to them for usernameAliasDuration, so links and mentions
+// keep working while people catch up.
+func (s *Service) ChangeUsername(ctx context.Context, claims *CustomClaims, username string) (*RenameResult, error) {
+	username = NormalizeUsername(username)
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	previous, err := s.repo.RenameUser(ctx, claims.UserID, username, usernameAliasDuration)
+	if err != nil {
+		if errors.Is(err, ErrUsernameAlreadyExists) || errors.Is(err, ErrUsernameUnchanged) || errors.Is(err, ErrUserNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("user: failed to rename user, %v", err)
+	}
+
+	s.record(ctx, audit.Entry{
+		Action:   audit.ActionUsernameChange,
+		ActorID:  claims.UserID,
+		TargetID: claims.UserID,
+		Details:  map[string]string{"from": previous, "to": username},
+	})
+
+	u, err := s.repo.GetUserByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.issueTokens(ctx, u, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.RevokeToken(ctx, claims); err != nil {
+		log.Printf("user: failed to revoke token after rename, %v", err)
+	}
+
+	data, _ := json.Marshal(events.UserProfile{
+		ID:               u.ID,
+		Username:         u.Username,
+		PreviousUsername: previous,
+		DisplayName:      u.DisplayName,
+		AvatarURL:        u.AvatarURL(),
+		StatusText:       u.StatusText,
+	})
+	if err := s.repo.PublishEvent(ctx, events.Event{Type: events.UserUpdated, Data: data}); err != nil {
+		log.Printf("user: failed to publish rename, %v", err)
+	}
+
+	return &RenameResult{Tokens: tokens, User: u.OwnProfile()}, nil
+}
+
+// GetUserByUsername finds a user by current name or by a name they gave up
+// less than usernameAliasDuration ago, aliased tells which.
+func (s *Service) GetUserByUsername(ctx context.Context, username string) (u *User, aliased bool, err error) {
+	userID, aliased, err := s.repo.ResolveUsername(ctx, username)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u, err = s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return u, aliased, nil
+}
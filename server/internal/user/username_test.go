@@ -0,0 +1,90 @@
+package user
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalUsername(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"case", "Alice", "aLICE", true},
+		{"fullwidth", "ａｌｉｃｅ", "alice", true},
+		{"surrounding space", "  alice ", "alice", true},
+		{"cyrillic a", "аlice", "alice", true},
+		{"cyrillic o and e", "bоbеrt", "bobert", true},
+		{"greek omicron", "bοb", "bob", true},
+		{"dotless i", "ıvan", "ivan", true},
+		{"rn as m", "rnary", "mary", true},
+		{"vv as w", "vvendy", "wendy", true},
+		{"digit one is not l", "user1", "userl", false},
+		{"digit zero is not o", "b0b", "bob", false},
+		{"different names", "alice", "alicia", false},
+		{"underscore kept", "al_ice", "alice", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := CanonicalUsername(tt.a), CanonicalUsername(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("CanonicalUsername(%q) = %q, CanonicalUsername(%q) = %q, want same %v", tt.a, a, tt.b, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Alice", "Alice"},
+		{" Alice ", "Alice"},
+		{"Ａｌｉｃｅ", "Alice"},
+		{"аlice", "аlice"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeUsername(tt.in); got != tt.want {
+			t.Errorf("NormalizeUsername(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     error
+	}{
+		{"latin", "alice", nil},
+		{"digits and underscore", "alice_42", nil},
+		{"cyrillic", "наташа", nil},
+		{"japanese", "たなか太郎", nil},
+		{"korean with han", "김민준金", nil},
+		{"too short", "abc", ErrUsernameLength},
+		{"too long", "abcdefghijklmnopqrstu", ErrUsernameLength},
+		{"starts with digit", "1alice", ErrUsernameStart},
+		{"starts with underscore", "_alice", ErrUsernameStart},
+		{"dash", "al-ice", ErrUsernameContains},
+		{"space", "al ice", ErrUsernameContains},
+		{"mixed latin and cyrillic", "alicе", ErrUsernameMixedScript},
+		{"mixed latin and greek", "bοbby", ErrUsernameMixedScript},
+		{"reserved", "admin", ErrUsernameReserved},
+		{"reserved in another case", "AdMiN", ErrUsernameReserved},
+		{"reserved in cyrillic lookalikes", "һеӏр", ErrUsernameReserved},
+		{"reserved with rn", "adrnin", ErrUsernameReserved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUsername(NormalizeUsername(tt.username))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("validateUsername(%q) = %v, want %v", tt.username, err, tt.want)
+			}
+		})
+	}
+}